@@ -16,9 +16,17 @@ type Service interface {
 	AuthnVerify(w http.ResponseWriter, r *http.Request)
 
 	OIDCConfiguration(w http.ResponseWriter, r *http.Request)
+	WebFinger(w http.ResponseWriter, r *http.Request)
 
 	Keys(w http.ResponseWriter, r *http.Request)
+	KeyStatus(w http.ResponseWriter, r *http.Request)
 	Tokens(w http.ResponseWriter, r *http.Request)
+	Introspect(w http.ResponseWriter, r *http.Request)
+
+	UserInfo(w http.ResponseWriter, r *http.Request)
+
+	// releases the stores once the servers have stopped
+	Close() error
 }
 
 func New(cfg *config.Config, service Service) (http.Handler, http.Handler) {
@@ -36,10 +44,23 @@ func New(cfg *config.Config, service Service) (http.Handler, http.Handler) {
 	b := chi.NewRouter()
 
 	b.Use(trace.New)
-	b.Use(clientauth.New(cfg.Clients))
+
+	// discovery is public so clients can find us before they authenticate
 	b.Get("/.well-known/openid-configuration", service.OIDCConfiguration)
-	b.Get("/keys", service.Keys)
-	b.Post("/token", service.Tokens)
+	b.Get("/.well-known/oauth-authorization-server", service.OIDCConfiguration)
+	b.Get("/.well-known/webfinger", service.WebFinger)
+
+	// userinfo is authorized by the bearer token, not the client
+	b.Get("/userinfo", service.UserInfo)
+	b.Post("/userinfo", service.UserInfo)
+
+	b.Group(func(b chi.Router) {
+		b.Use(clientauth.New(cfg.Clients))
+		b.Get("/keys", service.Keys)
+		b.Get("/keys/status", service.KeyStatus)
+		b.Post("/token", service.Tokens)
+		b.Post("/introspect", service.Introspect)
+	})
 
 	return f, b
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/parlaynu/studio1767-idp/internal/config"
+)
+
+// administrative commands for the idp
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "secret":
+		err = secret(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  secret    generate a client secret and its hash for the client config\n")
+	os.Exit(2)
+}
+
+func secret(args []string) error {
+	// parse command line
+	flags := flag.NewFlagSet("secret", flag.ExitOnError)
+	scheme := flags.String("hash", config.HashBcrypt, "hash scheme, bcrypt or argon2id")
+	expires := flags.Duration("expires", 0, "how long the secret is valid for, forever if zero")
+	flags.Parse(args)
+
+	// generate and hash the secret
+	secret, err := config.GenerateSecret()
+	if err != nil {
+		return fmt.Errorf("failed to generate secret: %w", err)
+	}
+	hash, err := config.HashSecret(secret, *scheme)
+	if err != nil {
+		return fmt.Errorf("failed to hash secret: %w", err)
+	}
+
+	// the secret goes to the client, the entry into the client config
+	fmt.Printf("client_secret: %s\n\n", secret)
+	fmt.Printf("secrets:\n")
+	fmt.Printf("  - secret: '%s'\n", hash)
+	if *expires > 0 {
+		fmt.Printf("    expires: %s\n", time.Now().Add(*expires).UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
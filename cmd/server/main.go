@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -51,23 +54,43 @@ func main() {
 	// run the server
 	//   if the listener scheme is http, run a http server, otherwise, https
 	cafile, certfile, keyfile := cfg.Https.CaCertFile, cfg.Https.CertFile, cfg.Https.KeyFile
-	if strings.HasPrefix(cfg.Listeners.Frontend, "http://") {
-		go func() {
-			RunHTTP(cfg.Listeners.Frontend, fe)
-		}()
-	} else {
-		go func() {
-			RunHTTPS(cfg.Listeners.Frontend, fe, cafile, certfile, keyfile)
-		}()
+	servers := []*http.Server{}
+	for _, l := range []struct {
+		listener string
+		handler  http.Handler
+	}{
+		{cfg.Listeners.Frontend, fe},
+		{cfg.Listeners.Backend, be},
+	} {
+		if strings.HasPrefix(l.listener, "http://") {
+			servers = append(servers, RunHTTP(l.listener, l.handler))
+		} else {
+			servers = append(servers, RunHTTPS(l.listener, l.handler, cafile, certfile, keyfile))
+		}
 	}
-	if strings.HasPrefix(cfg.Listeners.Backend, "http://") {
-		RunHTTP(cfg.Listeners.Backend, be)
-	} else {
-		RunHTTPS(cfg.Listeners.Backend, be, cafile, certfile, keyfile)
+
+	// run until we're told to stop, then let the requests in flight finish
+	//   before shutting down the service
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("failed to shut down server: %v", err)
+		}
+	}
+	err = svc.Close()
+	if err != nil {
+		log.Errorf("failed to close service: %v", err)
 	}
 }
 
-func RunHTTP(listener string, handler http.Handler) {
+func RunHTTP(listener string, handler http.Handler) *http.Server {
 	address := strings.TrimPrefix(listener, "http://")
 	srv := &http.Server{
 		Addr:         address,
@@ -77,10 +100,16 @@ func RunHTTP(listener string, handler http.Handler) {
 		IdleTimeout:  60 * time.Second,
 	}
 	log.Infof("Server listening at %s\n", listener)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
 }
 
-func RunHTTPS(listener string, handler http.Handler, cafile, certfile, keyfile string) {
+func RunHTTPS(listener string, handler http.Handler, cafile, certfile, keyfile string) *http.Server {
 
 	// create a certificate pool with the ca certificate
 	cacert, err := os.ReadFile(cafile)
@@ -109,5 +138,11 @@ func RunHTTPS(listener string, handler http.Handler, cafile, certfile, keyfile s
 	}
 
 	log.Infof("Server listening at %s\n", listener)
-	log.Fatal(srv.ListenAndServeTLS(certfile, keyfile))
+	go func() {
+		err := srv.ListenAndServeTLS(certfile, keyfile)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystoreremote"
+)
+
+// a reference external signer, holding the keys in a local keystore and
+//   serving them to the idp over a unix socket
+
+func main() {
+	// setup logging
+	log.SetLevel(log.TraceLevel)
+	formatter := &log.TextFormatter{
+		TimestampFormat: "2006-01-02 15:04:05.000",
+		FullTimestamp:   true,
+	}
+	log.SetFormatter(formatter)
+
+	// parse command line
+	dir := flag.String("dir", "", "directory to persist keys in")
+	passfile := flag.String("passphrase-file", "", "file holding the key passphrase")
+	algs := flag.String("algorithms", "RS256", "comma separated signing algorithms")
+	period := flag.Duration("rotation-period", 0, "key rotation period")
+	retain := flag.Duration("retain", 0, "how long retired keys are published, at least the idp's longest token lifetime (required)")
+	caCert := flag.String("ca-cert", "", "CA certificate to issue key certificates with")
+	caKey := flag.String("ca-key", "", "CA private key to issue key certificates with")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [options] <socket-path>", filepath.Base(os.Args[0]))
+	}
+	socket := flag.Arg(0)
+
+	// tokens signed by a retired key can only be checked while it's published,
+	//   and the signer can't know how long the idp's tokens last
+	if *retain <= 0 {
+		log.Fatalf("-retain is required, and must be at least the idp's longest token lifetime")
+	}
+
+	// create the keystore
+	var err error
+	var passphrase []byte
+	if *passfile != "" {
+		data, err := os.ReadFile(*passfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		passphrase = bytes.TrimSpace(data)
+	}
+	var issuer *keystore.Issuer
+	if *caKey != "" {
+		issuer, err = keystore.LoadIssuer(*caCert, *caKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var storage keystore.Storage
+	if *dir != "" {
+		storage = keystore.NewDirStorage(*dir)
+	}
+	ks, err := keystore.New(storage, passphrase, strings.Split(*algs, ","), *period, *retain, issuer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// listen on the socket, only the owner can connect
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler:      keystoreremote.NewServer(ks),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	log.Infof("Signer listening at %s\n", socket)
+	log.Fatal(srv.Serve(listener))
+}
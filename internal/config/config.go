@@ -1,10 +1,12 @@
 package config
 
 import (
+	"crypto"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -31,12 +33,36 @@ type Config struct {
 	Clients   []*ClientConfig
 
 	UserDb UserDb `yaml:"user_db"`
+
+	Tokens Tokens `yaml:"tokens"`
+
+	Keys Keys `yaml:"keys"`
+
+	State State `yaml:"state"`
 }
 
 type ClientConfig struct {
-	Id           string   `yaml:"id"`
-	Secret       string   `yaml:"secret"`
-	RedirectURLs []string `yaml:"redirect_urls"`
+	Id                 string         `yaml:"id"`
+	Secret             string         `yaml:"secret"`
+	Secrets            []ClientSecret `yaml:"secrets"`
+	RedirectURLs       []string       `yaml:"redirect_urls"`
+	AccessTokenProfile string         `yaml:"access_token_profile"`
+	Audience           string         `yaml:"audience"`
+	Lifetimes          Lifetimes      `yaml:"lifetimes"`
+	IdTokenSignedAlg   string         `yaml:"id_token_signed_response_alg"`
+	UserInfoSignedAlg  string         `yaml:"userinfo_signed_response_alg"`
+
+	// resource servers can introspect tokens issued to any client, and admins
+	//   can see the key status
+	Introspect bool `yaml:"introspect"`
+	Admin      bool `yaml:"admin"`
+
+	EncryptionKeyFile    string           `yaml:"encryption_key_file"`
+	EncryptionKey        crypto.PublicKey `yaml:"-"`
+	IdTokenEncryptedAlg  string           `yaml:"id_token_encrypted_response_alg"`
+	IdTokenEncryptedEnc  string           `yaml:"id_token_encrypted_response_enc"`
+	UserInfoEncryptedAlg string           `yaml:"userinfo_encrypted_response_alg"`
+	UserInfoEncryptedEnc string           `yaml:"userinfo_encrypted_response_enc"`
 }
 
 type UserDb struct {
@@ -47,8 +73,162 @@ type UserDb struct {
 	SearchBase string `yaml:"search_base"`
 	SearchDn   string `yaml:"search_dn"`
 	SearchPw   string `yaml:"search_pw"`
+	IdAttr     string `yaml:"id_attribute"`
+
+	// the files that go with the passwd and htpasswd files
+	ShadowPath string `yaml:"shadow_path"`
+	GroupPath  string `yaml:"group_path"`
+
+	Schema      string            `yaml:"schema"`
+	UserFilter  string            `yaml:"user_filter"`
+	LoginAttr   string            `yaml:"login_attribute"`
+	GroupFilter string            `yaml:"group_filter"`
+	GroupAttr   string            `yaml:"group_attribute"`
+	MemberAttr  string            `yaml:"member_attribute"`
+	MemberValue string            `yaml:"member_value"`
+	Attributes  map[string]string `yaml:"attributes"`
+
+	MemberOfAttr string `yaml:"member_of_attribute"`
+	NestedDepth  int    `yaml:"nested_group_depth"`
+	InChain      bool   `yaml:"in_chain_groups"`
+
+	LdapURLs   []string `yaml:"ldap_urls"`
+	Failover   string   `yaml:"failover"`
+	CaCertFile string   `yaml:"ca_cert_file"`
+	CertFile   string   `yaml:"cert_file"`
+	KeyFile    string   `yaml:"key_file"`
+
+	PoolSize        int           `yaml:"pool_size"`
+	PoolIdleTimeout time.Duration `yaml:"pool_idle_timeout"`
+	GroupCacheTTL   time.Duration `yaml:"group_cache_ttl"`
+
+	CacheTTL         time.Duration `yaml:"cache_ttl"`
+	CacheNegativeTTL time.Duration `yaml:"cache_negative_ttl"`
+	CacheSize        int           `yaml:"cache_size"`
+
+	// the databases a chain consults in order, and the users each one owns
+	Backends    []*UserDb `yaml:"backends"`
+	Match       []string  `yaml:"match"`
+	Domains     []string  `yaml:"domains"`
+	StripDomain bool      `yaml:"strip_domain"`
+	MergeGroups bool      `yaml:"merge_groups"`
+}
+
+type Tokens struct {
+	Subject            string    `yaml:"subject"`
+	AccessTokenProfile string    `yaml:"access_token_profile"`
+	Audience           string    `yaml:"audience"`
+	Lifetimes          Lifetimes `yaml:"lifetimes"`
+}
+
+// the audience of access tokens: the resource servers they're for, or the
+// issuer if none is configured
+func (t *Tokens) DefaultAudience(issuer string) string {
+	if t.Audience != "" {
+		return t.Audience
+	}
+	return issuer
+}
+
+type Keys struct {
+	Dir            string        `yaml:"dir"`
+	PassphraseFile string        `yaml:"passphrase_file"`
+	RotationPeriod time.Duration `yaml:"rotation_period"`
+	Algorithms     []string      `yaml:"algorithms"`
+	Signer         string        `yaml:"signer"`
+	CaCertFile     string        `yaml:"ca_cert_file"`
+	CaKeyFile      string        `yaml:"ca_key_file"`
+}
+
+// the supported JWS signing algorithms
+var SigningAlgs = []string{
+	"RS256",
+	"PS256",
+	"ES256",
+	"ES384",
+	"EdDSA",
+}
+
+// the signing algorithm to use when nothing else is configured or registered
+const DefaultSigningAlg = "RS256"
+
+func (k *Keys) SupportsAlg(alg string) bool {
+	for _, a := range k.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// the first configured algorithm is the default, the same as the keystore uses
+func (k *Keys) DefaultAlg() string {
+	if len(k.Algorithms) == 0 {
+		return DefaultSigningAlg
+	}
+	return k.Algorithms[0]
+}
+
+type State struct {
+	Type     string `yaml:"type"`
+	Path     string `yaml:"path"`
+	RedisURL string `yaml:"redis_url"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// the backends for the server state
+const (
+	StateMemory = "memory" // lost on restart
+	StateBolt   = "bolt"   // an embedded database file
+	StateRedis  = "redis"  // shared by a cluster of servers, along with the keys
+)
+
+type Lifetimes struct {
+	AccessToken time.Duration `yaml:"access_token"`
+	IdToken     time.Duration `yaml:"id_token"`
+	Code        time.Duration `yaml:"code"`
+}
+
+var DefaultLifetimes = Lifetimes{
+	AccessToken: 24 * time.Hour,
+	IdToken:     24 * time.Hour,
+	Code:        10 * time.Minute,
 }
 
+func (lt Lifetimes) Inherit(defaults Lifetimes) Lifetimes {
+	if lt.AccessToken == 0 {
+		lt.AccessToken = defaults.AccessToken
+	}
+	if lt.IdToken == 0 {
+		lt.IdToken = defaults.IdToken
+	}
+	if lt.Code == 0 {
+		lt.Code = defaults.Code
+	}
+	return lt
+}
+
+func (lt Lifetimes) validate() error {
+	if lt.AccessToken < 0 || lt.IdToken < 0 || lt.Code < 0 {
+		return fmt.Errorf("lifetimes must not be negative")
+	}
+	return nil
+}
+
+// the sources for the token subject claim
+const (
+	SubjectLegacy = "legacy" // base64 encoded email, as emitted by earlier versions
+	SubjectId     = "id"     // the immutable id from the user database
+	SubjectUid    = "uid"    // the uid number
+)
+
+// the formats for access tokens
+const (
+	ProfileLegacy  = "legacy"  // the original cognito style claims
+	ProfileRFC9068 = "rfc9068" // the JWT profile for access tokens
+	ProfileOpaque  = "opaque"  // random references to claims held by the server
+)
+
 func Load(file string) (*Config, error) {
 	// load the config
 	fh, err := os.Open(file)
@@ -69,7 +249,7 @@ func Load(file string) (*Config, error) {
 	cfg.ConfigFile = file
 
 	configdir := filepath.Dir(file)
-	if !strings.HasPrefix(cfg.Https.CaCertFile, "/") {
+	if cfg.Https.CaCertFile != "" && !strings.HasPrefix(cfg.Https.CaCertFile, "/") {
 		cfg.Https.CaCertFile = filepath.Join(configdir, cfg.Https.CaCertFile)
 	}
 	if !strings.HasPrefix(cfg.Https.KeyFile, "/") {
@@ -81,12 +261,100 @@ func Load(file string) (*Config, error) {
 	if !strings.HasPrefix(cfg.ClientDir, "/") {
 		cfg.ClientDir = filepath.Join(configdir, cfg.ClientDir)
 	}
+	if cfg.Keys.Dir != "" && !strings.HasPrefix(cfg.Keys.Dir, "/") {
+		cfg.Keys.Dir = filepath.Join(configdir, cfg.Keys.Dir)
+	}
+	if cfg.Keys.CaKeyFile != "" && cfg.Keys.CaCertFile == "" {
+		cfg.Keys.CaCertFile = cfg.Https.CaCertFile
+	}
+	if cfg.Keys.CaCertFile != "" && !strings.HasPrefix(cfg.Keys.CaCertFile, "/") {
+		cfg.Keys.CaCertFile = filepath.Join(configdir, cfg.Keys.CaCertFile)
+	}
+	if cfg.Keys.CaKeyFile != "" && !strings.HasPrefix(cfg.Keys.CaKeyFile, "/") {
+		cfg.Keys.CaKeyFile = filepath.Join(configdir, cfg.Keys.CaKeyFile)
+	}
+	if cfg.State.Path != "" && !strings.HasPrefix(cfg.State.Path, "/") {
+		cfg.State.Path = filepath.Join(configdir, cfg.State.Path)
+	}
+	if cfg.Keys.Signer != "" && !strings.HasPrefix(cfg.Keys.Signer, "/") {
+		cfg.Keys.Signer = filepath.Join(configdir, cfg.Keys.Signer)
+	}
+	if cfg.Keys.PassphraseFile != "" && !strings.HasPrefix(cfg.Keys.PassphraseFile, "/") {
+		cfg.Keys.PassphraseFile = filepath.Join(configdir, cfg.Keys.PassphraseFile)
+	}
 
 	cfg.Listeners.Backend = strings.TrimRight(cfg.Listeners.Backend, "/")
 	cfg.Listeners.Frontend = strings.TrimRight(cfg.Listeners.Frontend, "/")
 	cfg.IssuerURL = cfg.Listeners.Backend
 	cfg.AuthURL = strings.Join([]string{cfg.Listeners.Frontend, "auth"}, "/")
 
+	// validate the token settings
+	switch cfg.Tokens.Subject {
+	case "":
+		cfg.Tokens.Subject = SubjectLegacy
+	case SubjectLegacy, SubjectId, SubjectUid:
+	default:
+		return nil, fmt.Errorf("unknown token subject source: %s", cfg.Tokens.Subject)
+	}
+	switch cfg.Tokens.AccessTokenProfile {
+	case "":
+		cfg.Tokens.AccessTokenProfile = ProfileLegacy
+	case ProfileLegacy, ProfileRFC9068, ProfileOpaque:
+	default:
+		return nil, fmt.Errorf("unknown access token profile: %s", cfg.Tokens.AccessTokenProfile)
+	}
+	if err := cfg.Tokens.Lifetimes.validate(); err != nil {
+		return nil, fmt.Errorf("invalid token settings: %w", err)
+	}
+	if err := cfg.UserDb.load(configdir, cfg.Https.CaCertFile, true); err != nil {
+		return nil, fmt.Errorf("invalid user db settings: %w", err)
+	}
+	if cfg.Keys.RotationPeriod < 0 {
+		return nil, fmt.Errorf("invalid key rotation period: %s", cfg.Keys.RotationPeriod)
+	}
+	switch cfg.State.Type {
+	case "":
+		cfg.State.Type = StateMemory
+	case StateMemory:
+	case StateBolt:
+		if cfg.State.Path == "" {
+			return nil, fmt.Errorf("state type %s needs a path", cfg.State.Type)
+		}
+	case StateRedis:
+		if cfg.State.RedisURL == "" {
+			return nil, fmt.Errorf("state type %s needs a redis url", cfg.State.Type)
+		}
+		if cfg.Keys.Dir != "" {
+			return nil, fmt.Errorf("keys are shared through redis, the key directory can't be used")
+		}
+		if cfg.Keys.PassphraseFile == "" && cfg.Keys.Signer == "" {
+			return nil, fmt.Errorf("keys shared through redis need a passphrase file")
+		}
+		if cfg.State.Prefix == "" {
+			cfg.State.Prefix = "idp"
+		}
+	default:
+		return nil, fmt.Errorf("unknown state type: %s", cfg.State.Type)
+	}
+	if len(cfg.Keys.Algorithms) == 0 {
+		cfg.Keys.Algorithms = []string{DefaultSigningAlg}
+	}
+	for i, alg := range cfg.Keys.Algorithms {
+		supported := false
+		for _, a := range SigningAlgs {
+			supported = supported || a == alg
+		}
+		if !supported {
+			return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+		}
+		for _, a := range cfg.Keys.Algorithms[:i] {
+			if a == alg {
+				return nil, fmt.Errorf("duplicate signing algorithm: %s", alg)
+			}
+		}
+	}
+	cfg.Tokens.Lifetimes = cfg.Tokens.Lifetimes.Inherit(DefaultLifetimes)
+
 	// load the client configs
 	entries, err := os.ReadDir(cfg.ClientDir)
 	if err != nil {
@@ -116,8 +384,49 @@ func Load(file string) (*Config, error) {
 			return nil, fmt.Errorf("failed to read client configuration file: %w", err)
 		}
 
+		if err := ccfg.loadSecrets(); err != nil {
+			return nil, fmt.Errorf("invalid secrets for client %s: %w", ccfg.Id, err)
+		}
+		switch ccfg.AccessTokenProfile {
+		case "", ProfileLegacy, ProfileRFC9068, ProfileOpaque:
+		default:
+			return nil, fmt.Errorf("unknown access token profile for client %s: %s", ccfg.Id, ccfg.AccessTokenProfile)
+		}
+		if err := ccfg.Lifetimes.validate(); err != nil {
+			return nil, fmt.Errorf("invalid token settings for client %s: %w", ccfg.Id, err)
+		}
+		if ccfg.IdTokenSignedAlg != "" && !cfg.Keys.SupportsAlg(ccfg.IdTokenSignedAlg) {
+			return nil, fmt.Errorf("signing algorithm for client %s is not configured: %s", ccfg.Id, ccfg.IdTokenSignedAlg)
+		}
+		if ccfg.UserInfoSignedAlg != "" && !cfg.Keys.SupportsAlg(ccfg.UserInfoSignedAlg) {
+			return nil, fmt.Errorf("userinfo signing algorithm for client %s is not configured: %s", ccfg.Id, ccfg.UserInfoSignedAlg)
+		}
+		if err := ccfg.loadEncryption(cfg.ClientDir); err != nil {
+			return nil, fmt.Errorf("invalid encryption settings for client %s: %w", ccfg.Id, err)
+		}
+
 		cfg.Clients = append(cfg.Clients, &ccfg)
 	}
 
 	return &cfg, nil
 }
+
+func (cfg *Config) MaxSignedLifetime() time.Duration {
+	// the longest any signed token can be valid for
+	max := func(lt Lifetimes, cur time.Duration) time.Duration {
+		lt = lt.Inherit(cfg.Tokens.Lifetimes.Inherit(DefaultLifetimes))
+		if lt.AccessToken > cur {
+			cur = lt.AccessToken
+		}
+		if lt.IdToken > cur {
+			cur = lt.IdToken
+		}
+		return cur
+	}
+
+	lifetime := max(cfg.Tokens.Lifetimes, 0)
+	for _, client := range cfg.Clients {
+		lifetime = max(client.Lifetimes, lifetime)
+	}
+	return lifetime
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the supported key management algorithms, and the key type they need
+var EncryptionAlgs = map[string]string{
+	"RSA-OAEP":       "RSA",
+	"RSA-OAEP-256":   "RSA",
+	"ECDH-ES":        "EC",
+	"ECDH-ES+A256KW": "EC",
+}
+
+// the supported content encryption algorithms
+var EncryptionEncs = []string{
+	"A128CBC-HS256",
+	"A256GCM",
+}
+
+// the content encryption to use when the client registers only the algorithm
+const DefaultEncryptionEnc = "A128CBC-HS256"
+
+func (ccfg *ClientConfig) loadEncryption(clientDir string) error {
+
+	// nothing to do if the client hasn't asked for encryption
+	if ccfg.IdTokenEncryptedAlg == "" && ccfg.UserInfoEncryptedAlg == "" {
+		if ccfg.IdTokenEncryptedEnc != "" || ccfg.UserInfoEncryptedEnc != "" {
+			return errors.New("encryption enc registered without alg")
+		}
+		return nil
+	}
+	if ccfg.EncryptionKeyFile == "" {
+		return errors.New("encryption requested without an encryption key")
+	}
+
+	// load the key
+	kpath := ccfg.EncryptionKeyFile
+	if !strings.HasPrefix(kpath, "/") {
+		kpath = filepath.Join(clientDir, kpath)
+	}
+	key, err := loadPublicKey(kpath)
+	if err != nil {
+		return err
+	}
+	ccfg.EncryptionKey = key
+
+	// fill in the defaults and check the algorithms work with the key
+	if ccfg.IdTokenEncryptedAlg != "" && ccfg.IdTokenEncryptedEnc == "" {
+		ccfg.IdTokenEncryptedEnc = DefaultEncryptionEnc
+	}
+	if ccfg.UserInfoEncryptedAlg != "" && ccfg.UserInfoEncryptedEnc == "" {
+		ccfg.UserInfoEncryptedEnc = DefaultEncryptionEnc
+	}
+
+	err = checkEncryption(key, ccfg.IdTokenEncryptedAlg, ccfg.IdTokenEncryptedEnc)
+	if err != nil {
+		return err
+	}
+	return checkEncryption(key, ccfg.UserInfoEncryptedAlg, ccfg.UserInfoEncryptedEnc)
+}
+
+func checkEncryption(key crypto.PublicKey, alg, enc string) error {
+	if alg == "" {
+		return nil
+	}
+
+	kty, ok := EncryptionAlgs[alg]
+	if !ok {
+		return fmt.Errorf("unsupported encryption alg: %s", alg)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		ok = kty == "RSA"
+	case *ecdsa.PublicKey:
+		ok = kty == "EC"
+	default:
+		ok = false
+	}
+	if !ok {
+		return fmt.Errorf("encryption key type doesn't match alg %s", alg)
+	}
+
+	for _, e := range EncryptionEncs {
+		if e == enc {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported encryption enc: %s", enc)
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in encryption key file %s", path)
+	}
+
+	// accept either a bare public key or a certificate
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block in encryption key file: %s", block.Type)
+}
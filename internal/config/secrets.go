@@ -0,0 +1,129 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/pwhash"
+)
+
+// a client secret, either in plaintext or hashed, valid until it expires
+type ClientSecret struct {
+	Secret  string    `yaml:"secret"`
+	Expires time.Time `yaml:"expires"`
+}
+
+// the schemes secrets can be hashed with
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// the argon2id parameters for new hashes
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func HashSecret(secret, scheme string) (string, error) {
+	switch scheme {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		b64 := base64.RawStdEncoding
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("unknown hash scheme: %s", scheme)
+}
+
+// a secret matches if any of the unexpired secrets match it
+func CheckSecret(secrets []ClientSecret, secret string) bool {
+	if secret == "" {
+		return false
+	}
+
+	now := time.Now()
+	for _, cs := range secrets {
+		if !cs.Expires.IsZero() && now.After(cs.Expires) {
+			continue
+		}
+		if matchSecret(cs.Secret, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSecret(stored, secret string) bool {
+	if pwhash.Supported(stored) {
+		return pwhash.Verify(stored, secret) == nil
+	}
+
+	// plaintext... compare the digests so the lengths aren't leaked
+	s1, s2 := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(s1[:], s2[:]) == 1
+}
+
+func (ccfg *ClientConfig) loadSecrets() error {
+
+	// the single secret is the same as a list of one that doesn't expire
+	if ccfg.Secret != "" {
+		ccfg.Secrets = append([]ClientSecret{{Secret: ccfg.Secret}}, ccfg.Secrets...)
+	}
+	if len(ccfg.Secrets) == 0 {
+		return errors.New("no client secret")
+	}
+
+	// make sure the hashes can be used
+	for _, cs := range ccfg.Secrets {
+		switch {
+		case cs.Secret == "":
+			return errors.New("empty client secret")
+		case pwhash.Supported(cs.Secret):
+			// checking against anything shows whether the hash is usable
+			err := pwhash.Verify(cs.Secret, "")
+			if err != nil && !errors.Is(err, pwhash.ErrMismatch) {
+				return fmt.Errorf("malformed client secret hash: %w", err)
+			}
+		case strings.HasPrefix(cs.Secret, "$"):
+			// anything else that looks like a hash would silently be compared
+			//   as plaintext
+			return errors.New("unsupported client secret hash")
+		}
+	}
+	return nil
+}
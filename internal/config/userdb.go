@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func (udb *UserDb) load(configdir, caCertFile string, top bool) error {
+
+	if udb.CacheTTL < 0 || udb.CacheNegativeTTL < 0 || udb.CacheSize < 0 || udb.GroupCacheTTL < 0 {
+		return errors.New("cache settings must not be negative")
+	}
+
+	// only backends in a chain can own some of the users
+	if top && (len(udb.Match) > 0 || len(udb.Domains) > 0 || udb.StripDomain || udb.MergeGroups) {
+		return errors.New("user matching is only for chained backends")
+	}
+	if udb.StripDomain && len(udb.Domains) == 0 {
+		return errors.New("stripping the domain needs the domains to be listed")
+	}
+	for _, pattern := range udb.Match {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid user match %s: %w", pattern, err)
+		}
+	}
+	if udb.Type != "chain" && len(udb.Backends) > 0 {
+		return errors.New("backends are only for chained user dbs")
+	}
+
+	switch udb.Type {
+	case "chain":
+		if !top {
+			return errors.New("chains can't be nested")
+		}
+		if len(udb.Backends) == 0 {
+			return errors.New("chain needs backends")
+		}
+		for i, backend := range udb.Backends {
+			if err := backend.load(configdir, caCertFile, false); err != nil {
+				return fmt.Errorf("backend %d: %w", i+1, err)
+			}
+		}
+
+	case "yaml", "sql":
+		if udb.Path != "" && !strings.HasPrefix(udb.Path, "/") {
+			udb.Path = filepath.Join(configdir, udb.Path)
+		}
+
+	case "passwd", "htpasswd":
+		// the system's own files if none are given
+		if udb.Type == "passwd" && udb.Path == "" {
+			udb.Path, udb.ShadowPath, udb.GroupPath = "/etc/passwd", "/etc/shadow", "/etc/group"
+		}
+		if udb.Path == "" {
+			return fmt.Errorf("%s user db needs a path", udb.Type)
+		}
+		for _, path := range []*string{&udb.Path, &udb.ShadowPath, &udb.GroupPath} {
+			if *path != "" && !strings.HasPrefix(*path, "/") {
+				*path = filepath.Join(configdir, *path)
+			}
+		}
+
+	case "ldap":
+		// the single server is the same as a list of one
+		if len(udb.LdapURLs) == 0 && udb.LdapServer != "" {
+			u := url.URL{Scheme: "ldap", Host: udb.LdapServer}
+			if udb.LdapPort != 0 {
+				u.Host = net.JoinHostPort(udb.LdapServer, strconv.Itoa(udb.LdapPort))
+			}
+			udb.LdapURLs = []string{u.String()}
+		}
+		// the server's own ca if there isn't one for the directory, or the
+		//   system's if there's neither
+		if udb.CaCertFile == "" {
+			udb.CaCertFile = caCertFile
+		}
+		if udb.CaCertFile != "" && !strings.HasPrefix(udb.CaCertFile, "/") {
+			udb.CaCertFile = filepath.Join(configdir, udb.CaCertFile)
+		}
+		if udb.CertFile != "" && !strings.HasPrefix(udb.CertFile, "/") {
+			udb.CertFile = filepath.Join(configdir, udb.CertFile)
+		}
+		if udb.KeyFile != "" && !strings.HasPrefix(udb.KeyFile, "/") {
+			udb.KeyFile = filepath.Join(configdir, udb.KeyFile)
+		}
+	}
+
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/authcommon"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/utils"
+	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
@@ -88,5 +89,5 @@ func (ab *authBasic) authVerify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ab.auth.Authenticate(w, r, user)
+	ab.auth.Authenticate(w, r, user, tokenstore.AuthMethodPassword)
 }
@@ -3,6 +3,7 @@ package authcommon
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -13,7 +14,7 @@ import (
 )
 
 type Authenticator interface {
-	Authenticate(w http.ResponseWriter, r *http.Request, user *userdb.User)
+	Authenticate(w http.ResponseWriter, r *http.Request, user *userdb.User, method string)
 }
 
 func New(cs clientstore.ClientStore, ts tokenstore.TokenStore) Authenticator {
@@ -29,7 +30,7 @@ type authenticator struct {
 	tstore tokenstore.TokenStore
 }
 
-func (au *authenticator) Authenticate(w http.ResponseWriter, r *http.Request, user *userdb.User) {
+func (au *authenticator) Authenticate(w http.ResponseWriter, r *http.Request, user *userdb.User, method string) {
 	// check for required paramaters
 	required := []string{
 		"client_id",
@@ -51,6 +52,8 @@ func (au *authenticator) Authenticate(w http.ResponseWriter, r *http.Request, us
 	nonce := r.FormValue("nonce")
 	state := r.FormValue("state")
 	response_type := r.FormValue("response_type")
+	challenge := r.FormValue("code_challenge")
+	challenge_method := r.FormValue("code_challenge_method")
 
 	scopes := make(map[string]bool)
 	for _, s := range strings.Split(r.FormValue("scope"), " ") {
@@ -77,7 +80,21 @@ func (au *authenticator) Authenticate(w http.ResponseWriter, r *http.Request, us
 		return
 	}
 
-	// create the token
+	// the code can be bound to a PKCE challenge
+	switch challenge_method {
+	case "", tokenstore.ChallengePlain, tokenstore.ChallengeS256:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		log.Errorf("authcommon: unsupported code challenge method %s", challenge_method)
+		return
+	}
+	if challenge == "" && challenge_method != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Error("authcommon: code challenge method without a challenge")
+		return
+	}
+
+	// store the grant
 	ti := tokenstore.TokenInfo{
 		User:         user,
 		ClientID:     client_id,
@@ -86,17 +103,21 @@ func (au *authenticator) Authenticate(w http.ResponseWriter, r *http.Request, us
 		Nonce:        nonce,
 		State:        state,
 		ResponseType: response_type,
+		AuthTime:     time.Now(),
+		AuthMethod:   method,
+
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: challenge_method,
 	}
 
-	token, err := au.tstore.NewToken(&ti)
+	// the tokens are minted when the code is redeemed
+	code, err := au.tstore.Put(&ti)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Errorf("failed to create token: %v", err)
+		log.Errorf("failed to store grant: %v", err)
 		return
 	}
 
-	code := au.tstore.Put(ti.ClientID, token)
-
 	url := ti.RedirectURL
 	url += "?state=" + ti.State
 	url += "&code=" + code
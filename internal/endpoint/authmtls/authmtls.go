@@ -7,6 +7,7 @@ import (
 
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/authcommon"
 	"github.com/parlaynu/studio1767-idp/internal/middleware/mtls"
+	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
@@ -43,5 +44,5 @@ func (am *authMtls) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	am.auth.Authenticate(w, r, user)
+	am.auth.Authenticate(w, r, user, tokenstore.AuthMethodMtls)
 }
@@ -0,0 +1,96 @@
+package introspect
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/utils"
+	"github.com/parlaynu/studio1767-idp/internal/middleware/clientauth"
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
+)
+
+func New(cs clientstore.ClientStore, ts tokenstore.TokenStore) http.Handler {
+	h := introspectHandler{
+		clStore: cs,
+		tkStore: ts,
+	}
+	return &h
+}
+
+type introspectHandler struct {
+	clStore clientstore.ClientStore
+	tkStore tokenstore.TokenStore
+}
+
+func (ih *introspectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// check for required paramaters
+	required := []string{
+		"token",
+	}
+	if utils.CheckParameters(r, required) == false {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Errorf("introspect: missing token parameter")
+		return
+	}
+
+	// anything we can't resolve is simply inactive
+	response := map[string]interface{}{
+		"active": false,
+	}
+
+	// clients can only see their own tokens, unless they're a resource server
+	clientID := clientauth.ClientID(r)
+	claims, err := ih.tkStore.Lookup(r.FormValue("token"))
+	if err != nil {
+		log.Debugf("introspect: inactive token: %v", err)
+	} else if !ih.allowed(clientID, claims) {
+		log.Warnf("introspect: client %s not allowed to introspect token", clientID)
+	} else {
+		for k, v := range claims {
+			response[k] = v
+		}
+		response["active"] = true
+		response["token_type"] = "Bearer"
+	}
+
+	jdata, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("introspect: failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jdata)
+}
+
+func (ih *introspectHandler) allowed(clientID string, claims map[string]interface{}) bool {
+	client := ih.clStore.Get(clientID)
+	if client == nil {
+		return false
+	}
+	if client.Introspect {
+		return true
+	}
+	if owner, ok := claims["client_id"].(string); ok {
+		return owner == clientID
+	}
+
+	// legacy tokens only carry the client in the audience
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,14 +1,22 @@
 package keys
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"math/big"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/utils"
 	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
 )
 
@@ -20,50 +28,146 @@ func New(ks keystore.KeyStore) http.Handler {
 }
 
 type keysHandler struct {
-	kStore keystore.KeyStore
+	kStore      keystore.KeyStore
+	mutex       sync.Mutex
+	fingerprint [sha256.Size]byte
+	serialized  []byte
+	etag        string
 }
 
 func (kh *keysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	keys, err := kh.getPublicKeys()
+	jdata, etag, err := kh.getPublicKeys()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("keys: failed to get public keys: %v", err)
 		return
 	}
 
+	// the set can be cached until the keys next change, and verifiers refetch
+	//   when they see an unknown kid... it's only for authenticated clients, so
+	//   shared caches mustn't keep it
+	maxAge := int(kh.maxAge(time.Now()).Seconds())
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("ETag", etag)
+
+	if utils.ETagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, keys)
+	w.Write(jdata)
+}
+
+// the longest the key set is cached for
+const maxCacheAge = 15 * time.Minute
+
+// how long until the key set changes, at the next rotation or key removal
+func (kh *keysHandler) maxAge(now time.Time) time.Duration {
+	status := kh.kStore.Status()
+
+	next := now.Add(maxCacheAge)
+	if !status.NextRotation.IsZero() && status.NextRotation.Before(next) {
+		next = status.NextRotation
+	}
+	for _, key := range status.Keys {
+		if !key.Removal.IsZero() && key.Removal.Before(next) {
+			next = key.Removal
+		}
+	}
+
+	if next.Before(now) {
+		return 0
+	}
+	return next.Sub(now)
 }
 
 type pubkey struct {
-	Use string `json:"use"`
-	Kty string `json:"kty"`
-	Kid string `json:"kid"`
-	Alg string `json:"alg"`
-	N   string `json:"n"`
-	E   string `json:"e"`
+	Use     string   `json:"use"`
+	Kty     string   `json:"kty"`
+	Kid     string   `json:"kid"`
+	Alg     string   `json:"alg"`
+	Crv     string   `json:"crv,omitempty"`
+	N       string   `json:"n,omitempty"`
+	E       string   `json:"e,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	X5c     []string `json:"x5c,omitempty"`
+	X5tS256 string   `json:"x5t#S256,omitempty"`
 }
 
-func (kh *keysHandler) getPublicKeys() (string, error) {
+func (kh *keysHandler) getPublicKeys() ([]byte, string, error) {
 
-	// get the public keys and convert into the Oauth2 format
+	// the key set only changes when keys come and go or their certificates
+	//   are reissued, so reuse the last serialization until then
 	keys := kh.kStore.GetPublicKeys()
 
-	var pubkeys []*pubkey
-	for kid, key := range keys {
-		N := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	h := sha256.New()
+	for _, kid := range kids {
+		fmt.Fprintf(h, "%s\x00%s\x00", kid, keys[kid].Alg)
+		for _, cert := range keys[kid].Certificates {
+			fmt.Fprintf(h, "%d\x00", len(cert.Raw))
+			h.Write(cert.Raw)
+		}
+		h.Write([]byte{0})
+	}
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+
+	kh.mutex.Lock()
+	defer kh.mutex.Unlock()
 
-		ebig := big.NewInt(int64(key.E))
-		E := base64.RawURLEncoding.EncodeToString(ebig.Bytes())
+	if kh.serialized != nil && kh.fingerprint == fingerprint {
+		return kh.serialized, kh.etag, nil
+	}
 
+	// convert into the Oauth2 format
+	pubkeys := []*pubkey{}
+	for _, kid := range kids {
+		key := keys[kid]
 		pk := pubkey{
 			Use: "sig",
-			Kty: "RSA",
 			Kid: kid,
-			Alg: "RS256",
-			N:   N,
-			E:   E,
+			Alg: key.Alg,
+		}
+
+		switch k := key.Key.(type) {
+		case *rsa.PublicKey:
+			pk.Kty = "RSA"
+			pk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+			pk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+
+		case *ecdsa.PublicKey:
+			// the coordinates are always the full size of the curve
+			size := (k.Curve.Params().BitSize + 7) / 8
+			pk.Kty = "EC"
+			pk.Crv = k.Curve.Params().Name
+			pk.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size)))
+			pk.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size)))
+
+		case ed25519.PublicKey:
+			pk.Kty = "OKP"
+			pk.Crv = "Ed25519"
+			pk.X = base64.RawURLEncoding.EncodeToString(k)
+
+		default:
+			return nil, "", fmt.Errorf("keys: unsupported key type %T", key.Key)
+		}
+
+		// the chain is standard base64, the thumbprint is of the leaf
+		for _, cert := range key.Certificates {
+			pk.X5c = append(pk.X5c, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+		if len(key.Certificates) > 0 {
+			thumb := sha256.Sum256(key.Certificates[0].Raw)
+			pk.X5tS256 = base64.RawURLEncoding.EncodeToString(thumb[:])
 		}
 
 		pubkeys = append(pubkeys, &pk)
@@ -75,8 +179,13 @@ func (kh *keysHandler) getPublicKeys() (string, error) {
 
 	jdata, err := json.MarshalIndent(&pubmap, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("keys: failed to marshal key data")
+		return nil, "", fmt.Errorf("keys: failed to marshal key data")
 	}
+	etag := sha256.Sum256(jdata)
+
+	kh.fingerprint = fingerprint
+	kh.serialized = jdata
+	kh.etag = `"` + base64.RawURLEncoding.EncodeToString(etag[:16]) + `"`
 
-	return string(jdata), nil
+	return kh.serialized, kh.etag, nil
 }
@@ -0,0 +1,95 @@
+package keys
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/middleware/clientauth"
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+func NewStatus(cs clientstore.ClientStore, ks keystore.KeyStore) http.Handler {
+	h := statusHandler{
+		clStore: cs,
+		kStore:  ks,
+	}
+	return &h
+}
+
+type statusHandler struct {
+	clStore clientstore.ClientStore
+	kStore  keystore.KeyStore
+}
+
+type keyStatus struct {
+	Kid     string `json:"kid"`
+	Alg     string `json:"alg"`
+	State   string `json:"state"`
+	Created string `json:"created"`
+	Since   string `json:"since"`
+	Removal string `json:"removal,omitempty"`
+}
+
+type storeStatus struct {
+	RotationPeriod string       `json:"rotation_period,omitempty"`
+	NextRotation   string       `json:"next_rotation,omitempty"`
+	Keys           []*keyStatus `json:"keys"`
+}
+
+func (sh *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only for admin clients
+	clientID := clientauth.ClientID(r)
+	client := sh.clStore.Get(clientID)
+	if client == nil || !client.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		log.Errorf("keys: client %s not allowed to see key status", clientID)
+		return
+	}
+
+	status := sh.kStore.Status()
+
+	ss := storeStatus{
+		RotationPeriod: formatDuration(status.RotationPeriod),
+		NextRotation:   formatTime(status.NextRotation),
+	}
+	for _, key := range status.Keys {
+		ss.Keys = append(ss.Keys, &keyStatus{
+			Kid:     key.Kid,
+			Alg:     key.Alg,
+			State:   key.State,
+			Created: formatTime(key.Created),
+			Since:   formatTime(key.Since),
+			Removal: formatTime(key.Removal),
+		})
+	}
+
+	jdata, err := json.MarshalIndent(&ss, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("keys: failed to marshal key status: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jdata)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
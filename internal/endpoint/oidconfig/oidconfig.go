@@ -1,78 +1,130 @@
 package oidconfig
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+
+	"github.com/parlaynu/studio1767-idp/internal/config"
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/utils"
+	"github.com/parlaynu/studio1767-idp/internal/middleware/clientauth"
+	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 )
 
-func New(issuerURL, authURL string) (http.Handler, error) {
+func New(cfg *config.Config) (http.Handler, error) {
 
-	h := configHandler{
-		Issuer:        issuerURL,
-		AuthEndpoint:  authURL,
-		TokenEndpoint: issuerURL + "/token",
-		TokenEndpointAuthSupported: []string{
-			"client_secret_basic",
-		},
-		JwksURI: issuerURL + "/keys",
-		ScopesSupported: []string{
-			"openid",
-			"email",
-			"profile",
-		},
-		ClaimsSupported: []string{
-			"aud",
-			"email",
-			"email_verified",
-			"exp",
-			"iat",
-			"iss",
-			"locale",
-			"name",
-			"sub",
-		},
+	md := metadata{
+		Issuer:                             cfg.IssuerURL,
+		AuthEndpoint:                       cfg.AuthURL,
+		TokenEndpoint:                      cfg.IssuerURL + "/token",
+		TokenEndpointAuthSupported:         clientauth.Methods,
+		UserInfoEndpoint:                   cfg.IssuerURL + "/userinfo",
+		IntrospectionEndpoint:              cfg.IssuerURL + "/introspect",
+		IntrospectionEndpointAuthSupported: clientauth.Methods,
+		JwksURI:                            cfg.IssuerURL + "/keys",
+		ScopesSupported:                    tokenstore.Scopes,
+		ClaimsSupported:                    claimsSupported(),
 		GrantTypesSupported: []string{
 			"authorization_code",
 		},
 		ResponseTypesSupported: []string{
 			"code",
 		},
-		IdTokenSigningAlgsSupported: []string{
-			"RS256",
+		ResponseModesSupported: []string{
+			"query",
 		},
+		CodeChallengeMethodsSupported: tokenstore.ChallengeMethods,
+		IdTokenSigningAlgsSupported:   cfg.Keys.Algorithms,
 		SubjectTypesSupported: []string{
 			"public",
 		},
+		RequestURIParameterSupported: false,
 	}
 
-	jdata, err := json.MarshalIndent(&h, "", "  ")
+	// the encryption options
+	for alg := range config.EncryptionAlgs {
+		md.IdTokenEncryptionAlgsSupported = append(md.IdTokenEncryptionAlgsSupported, alg)
+	}
+	sort.Strings(md.IdTokenEncryptionAlgsSupported)
+	md.IdTokenEncryptionEncsSupported = config.EncryptionEncs
+	md.UserInfoSigningAlgsSupported = cfg.Keys.Algorithms
+	md.UserInfoEncryptionAlgsSupported = md.IdTokenEncryptionAlgsSupported
+	md.UserInfoEncryptionEncsSupported = md.IdTokenEncryptionEncsSupported
+
+	jdata, err := json.MarshalIndent(&md, "", "  ")
 	if err != nil {
-		return nil, fmt.Errorf("oidconfig: failed to marhshal configuration")
+		return nil, fmt.Errorf("oidconfig: failed to marshal configuration")
 	}
+	etag := sha256.Sum256(jdata)
 
-	h.Serialized = string(jdata)
+	h := configHandler{
+		serialized: jdata,
+		etag:       `"` + base64.RawURLEncoding.EncodeToString(etag[:16]) + `"`,
+	}
 
 	return &h, nil
 }
 
+// the claims in id tokens and userinfo responses
+func claimsSupported() []string {
+	seen := make(map[string]bool)
+	var claims []string
+	for _, list := range [][]string{tokenstore.IdTokenClaims, tokenstore.UserClaims} {
+		for _, claim := range list {
+			if !seen[claim] {
+				seen[claim] = true
+				claims = append(claims, claim)
+			}
+		}
+	}
+	sort.Strings(claims)
+	return claims
+}
+
+type metadata struct {
+	Issuer                             string   `json:"issuer"`
+	AuthEndpoint                       string   `json:"authorization_endpoint"`
+	JwksURI                            string   `json:"jwks_uri"`
+	TokenEndpoint                      string   `json:"token_endpoint"`
+	UserInfoEndpoint                   string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint              string   `json:"introspection_endpoint"`
+	IntrospectionEndpointAuthSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	ClaimsSupported                    []string `json:"claims_supported"`
+	GrantTypesSupported                []string `json:"grant_types_supported"`
+	IdTokenSigningAlgsSupported        []string `json:"id_token_signing_alg_values_supported"`
+	IdTokenEncryptionAlgsSupported     []string `json:"id_token_encryption_alg_values_supported"`
+	IdTokenEncryptionEncsSupported     []string `json:"id_token_encryption_enc_values_supported"`
+	UserInfoSigningAlgsSupported       []string `json:"userinfo_signing_alg_values_supported"`
+	UserInfoEncryptionAlgsSupported    []string `json:"userinfo_encryption_alg_values_supported"`
+	UserInfoEncryptionEncsSupported    []string `json:"userinfo_encryption_enc_values_supported"`
+	ResponseTypesSupported             []string `json:"response_types_supported"`
+	ResponseModesSupported             []string `json:"response_modes_supported"`
+	CodeChallengeMethodsSupported      []string `json:"code_challenge_methods_supported"`
+	ScopesSupported                    []string `json:"scopes_supported"`
+	SubjectTypesSupported              []string `json:"subject_types_supported"`
+	TokenEndpointAuthSupported         []string `json:"token_endpoint_auth_methods_supported"`
+	RequestURIParameterSupported       bool     `json:"request_uri_parameter_supported"`
+}
+
 type configHandler struct {
-	Issuer                      string   `json:"issuer"`
-	AuthEndpoint                string   `json:"authorization_endpoint"`
-	JwksURI                     string   `json:"jwks_uri"`
-	TokenEndpoint               string   `json:"token_endpoint"`
-	ClaimsSupported             []string `json:"claims_supported"`
-	GrantTypesSupported         []string `json:"grant_types_supported"`
-	IdTokenSigningAlgsSupported []string `json:"id_token_signing_alg_values_supported"`
-	ResponseTypesSupported      []string `json:"response_types_supported"`
-	ScopesSupported             []string `json:"scopes_supported"`
-	SubjectTypesSupported       []string `json:"subject_types_supported"`
-	TokenEndpointAuthSupported  []string `json:"token_endpoint_auth_methods_supported"`
-	Serialized                  string   `json:"serialized,omitempty"`
+	serialized []byte
+	etag       string
 }
 
 func (ch *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the document only changes on restart, so let clients cache it
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("ETag", ch.etag)
+
+	if utils.ETagMatches(r, ch.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, ch.Serialized)
+	w.Write(ch.serialized)
 }
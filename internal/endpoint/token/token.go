@@ -7,6 +7,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/utils"
+	"github.com/parlaynu/studio1767-idp/internal/middleware/clientauth"
 	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 )
@@ -28,8 +29,6 @@ func (th *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// check for required paramaters
 	required := []string{
 		"grant_type",
-		"client_id",
-		"client_secret",
 		"redirect_uri",
 		"code",
 	}
@@ -47,23 +46,15 @@ func (th *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the client id
-	clientID := r.FormValue("client_id")
+	// the client has already been authenticated
+	clientID := clientauth.ClientID(r)
 	client := th.clStore.Get(clientID)
 	if client == nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusUnauthorized)
 		log.Errorf("token: client id not in store: %s", clientID)
 		return
 	}
 
-	// verify the client secret
-	clientSecret := r.FormValue("client_secret")
-	if clientSecret != client.Secret {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Errorf("token: client secret mismatch for client %s", clientID)
-		return
-	}
-
 	// verify the redirect url
 	redirectURL := r.FormValue("redirect_uri")
 
@@ -80,13 +71,23 @@ func (th *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the code and token
+	// redeem the code for its grant, the code is bound to the redirect url and any
+	//   PKCE challenge from the authorization request
 	code := r.FormValue("code")
+	verifier := r.FormValue("code_verifier")
 
-	token, err := th.tkStore.Get(clientID, code)
+	ti, err := th.tkStore.Redeem(clientID, code, redirectURL, verifier)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Errorf("token: no token for client: %v", err)
+		log.Errorf("token: no grant for client: %v", err)
+		return
+	}
+
+	// mint the tokens now, so they're valid from when the client gets them
+	token, err := th.tkStore.NewToken(ti)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("token: failed to create token: %v", err)
 		return
 	}
 
@@ -0,0 +1,86 @@
+package userinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
+)
+
+func New(cs clientstore.ClientStore, ts tokenstore.TokenStore) http.Handler {
+	h := userinfoHandler{
+		clStore: cs,
+		tkStore: ts,
+	}
+	return &h
+}
+
+type userinfoHandler struct {
+	clStore clientstore.ClientStore
+	tkStore tokenstore.TokenStore
+}
+
+func (uh *userinfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the token can be in the header or, as per RFC 6750, the form
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.FormValue("access_token")
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Error("userinfo: no access token in request")
+		return
+	}
+
+	claims, err := uh.tkStore.Lookup(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Errorf("userinfo: %v", err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	for _, name := range tokenstore.UserClaims {
+		if v, ok := claims[name]; ok {
+			response[name] = v
+		}
+	}
+
+	// clients that registered for encrypted responses get a nested JWT
+	clientID, _ := claims["client_id"].(string)
+	if clientID == "" {
+		clientID, _ = claims["aud"].(string)
+	}
+	if client := uh.clStore.Get(clientID); client != nil && client.UserInfoEncryption != nil {
+		token, err := uh.tkStore.UserInfoToken(clientID, response)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Errorf("userinfo: failed to create response token: %v", err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/jwt")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(token))
+		return
+	}
+
+	jdata, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("userinfo: failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jdata)
+}
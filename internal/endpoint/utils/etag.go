@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+)
+
+// whether the request's If-None-Match matches the etag... the header can be
+// a list, and uses the weak comparison from RFC 9110
+func ETagMatches(r *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
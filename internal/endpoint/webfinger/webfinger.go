@@ -0,0 +1,73 @@
+package webfinger
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const issuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+func New(issuerURL string) http.Handler {
+	h := webfingerHandler{
+		issuer: issuerURL,
+	}
+	return &h
+}
+
+type webfingerHandler struct {
+	issuer string
+}
+
+type link struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+type response struct {
+	Subject string  `json:"subject"`
+	Links   []*link `json:"links"`
+}
+
+func (wh *webfingerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the resource is required, all else is optional
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Error("webfinger: missing resource parameter")
+		return
+	}
+
+	// we only know about the issuer relation, so if the client asked for
+	//   specific relations and that isn't one of them, return no links
+	resp := response{
+		Subject: resource,
+		Links:   []*link{},
+	}
+
+	rels := r.URL.Query()["rel"]
+	wanted := len(rels) == 0
+	for _, rel := range rels {
+		if rel == issuerRel {
+			wanted = true
+			break
+		}
+	}
+	if wanted {
+		resp.Links = append(resp.Links, &link{Rel: issuerRel, Href: wh.issuer})
+	}
+
+	jdata, err := json.Marshal(&resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("webfinger: failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/jrd+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jdata)
+}
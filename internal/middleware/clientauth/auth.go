@@ -1,6 +1,7 @@
 package clientauth
 
 import (
+	"context"
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
@@ -8,6 +9,9 @@ import (
 	"github.com/parlaynu/studio1767-idp/internal/config"
 )
 
+// the ways clients can authenticate, as named in the discovery metadata
+var Methods = []string{"client_secret_post"}
+
 func New(clients []*config.ClientConfig) func(http.Handler) http.Handler {
 	cmap := make(map[string]*config.ClientConfig)
 	for _, client := range clients {
@@ -23,6 +27,14 @@ func New(clients []*config.ClientConfig) func(http.Handler) http.Handler {
 	}
 }
 
+// the authenticated client's id is in the request context under this key
+type ClientKey struct{}
+
+func ClientID(r *http.Request) string {
+	id, _ := r.Context().Value(ClientKey{}).(string)
+	return id
+}
+
 type clientAuth struct {
 	clients map[string]*config.ClientConfig
 	next    http.Handler
@@ -40,15 +52,16 @@ func (cauth *clientAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ccfg, exists := cauth.clients[id]
-	if exists == false || secret != ccfg.Secret {
+	if exists == false || !config.CheckSecret(ccfg.Secrets, secret) {
 		w.WriteHeader(http.StatusUnauthorized)
 		if exists == false {
 			log.Errorf("clientauth: clientid not found (%s)", id)
 		} else {
-			log.Errorf("clientauth: client secret does not match (%s:%s)", id, secret)
+			log.Errorf("clientauth: client secret does not match (%s)", id)
 		}
 		return
 	}
 
-	cauth.next.ServeHTTP(w, r)
+	ctx := context.WithValue(r.Context(), ClientKey{}, id)
+	cauth.next.ServeHTTP(w, r.WithContext(ctx))
 }
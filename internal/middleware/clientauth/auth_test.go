@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -19,7 +21,7 @@ func TestClientAuth(t *testing.T) {
 
 	// test with auth
 	{
-		url := fmt.Sprintf("http://127.0.0.1/blah?client_id=%s&client_secret=%s", cfg[0].Id, cfg[0].Secret)
+		url := fmt.Sprintf("http://127.0.0.1/blah?client_id=%s&client_secret=%s", cfg[0].Id, cfg[0].Secrets[0].Secret)
 		request, err := http.NewRequest("GET", url, strings.NewReader("hello world"))
 		require.NoError(t, err)
 		rec := httptest.NewRecorder()
@@ -30,7 +32,7 @@ func TestClientAuth(t *testing.T) {
 	}
 	// test with bad auth
 	{
-		url := fmt.Sprintf("http://127.0.0.1/blah?client_id=%s&client_secret=%s", cfg[0].Id, cfg[1].Secret)
+		url := fmt.Sprintf("http://127.0.0.1/blah?client_id=%s&client_secret=%s", cfg[0].Id, cfg[1].Secrets[0].Secret)
 		request, err := http.NewRequest("GET", url, strings.NewReader("hello world"))
 		require.NoError(t, err)
 		rec := httptest.NewRecorder()
@@ -52,9 +54,52 @@ func TestClientAuth(t *testing.T) {
 
 }
 
+func TestClientAuthSecrets(t *testing.T) {
+	bhash, err := config.HashSecret("bcrypt-secret", config.HashBcrypt)
+	require.NoError(t, err)
+	ahash, err := config.HashSecret("argon2-secret", config.HashArgon2id)
+	require.NoError(t, err)
+
+	cfg := []*config.ClientConfig{
+		{
+			Id: "client",
+			Secrets: []config.ClientSecret{
+				{Secret: bhash},
+				{Secret: ahash, Expires: time.Now().Add(time.Hour)},
+				{Secret: "expired-secret", Expires: time.Now().Add(-time.Hour)},
+			},
+		},
+	}
+	mware := clientauth.New(cfg)(&handler{})
+
+	status := func(secret string) int {
+		target := fmt.Sprintf("http://127.0.0.1/blah?client_id=client&client_secret=%s", url.QueryEscape(secret))
+		request, err := http.NewRequest("GET", target, nil)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+
+		mware.ServeHTTP(rec, request)
+		return rec.Result().StatusCode
+	}
+
+	// any of the current secrets work, hashed or not
+	require.Equal(t, http.StatusOK, status("bcrypt-secret"))
+	require.Equal(t, http.StatusOK, status("argon2-secret"))
+
+	// the hashes themselves and expired secrets don't
+	require.Equal(t, http.StatusUnauthorized, status(ahash))
+	require.Equal(t, http.StatusUnauthorized, status("expired-secret"))
+	require.Equal(t, http.StatusUnauthorized, status("wrong-secret"))
+}
+
 type handler struct{}
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only authenticated clients get through
+	if clientauth.ClientID(r) != r.FormValue("client_id") {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Hello World"))
 }
@@ -65,7 +110,7 @@ func createConfig() []*config.ClientConfig {
 	for i := 0; i < nclients; i++ {
 		client := config.ClientConfig{
 			Id:           fmt.Sprintf("Id%d", i),
-			Secret:       fmt.Sprintf("Secret%d", i),
+			Secrets:      []config.ClientSecret{{Secret: fmt.Sprintf("Secret%d", i)}},
 			RedirectURLs: []string{fmt.Sprintf("http://server%d.example.com", i)},
 		}
 		clients = append(clients, &client)
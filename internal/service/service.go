@@ -1,24 +1,39 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
-	"path/filepath"
+	"os"
+
+	"github.com/redis/go-redis/v9"
 
 	"github.com/parlaynu/studio1767-idp/api"
 	"github.com/parlaynu/studio1767-idp/internal/config"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/authbasic"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/authcommon"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/authmtls"
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/introspect"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/keys"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/oidconfig"
 	"github.com/parlaynu/studio1767-idp/internal/endpoint/token"
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/userinfo"
+	"github.com/parlaynu/studio1767-idp/internal/endpoint/webfinger"
 	"github.com/parlaynu/studio1767-idp/internal/middleware/mtls"
 	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystoreremote"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestorebolt"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestoreredis"
 	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbcache"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbchain"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdbldap"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbsql"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbunix"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdbyaml"
 )
 
@@ -27,34 +42,21 @@ func New(cfg *config.Config) (api.Service, error) {
 	var err error
 
 	// create the stores
-	var udb userdb.UserDb
-	switch cfg.UserDb.Type {
-	case "ldap":
-		ldapServer, ldapPort := cfg.UserDb.LdapServer, cfg.UserDb.LdapPort
-		sBase, sDn, sPw := cfg.UserDb.SearchBase, cfg.UserDb.SearchDn, cfg.UserDb.SearchPw
-		udb, err = userdbldap.NewUserDb(ldapServer, ldapPort, sBase, sDn, sPw, cfg.Https.CaCertFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create user db: %w", err)
-		}
-	case "yaml":
-		dbpath := cfg.UserDb.Path
-		if !filepath.IsAbs(dbpath) {
-			dbpath = filepath.Join(filepath.Dir(cfg.ConfigFile), cfg.UserDb.Path)
-		}
-		udb, err = userdbyaml.NewUserDb(dbpath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create user db: %w", err)
-		}
-	default:
-		return nil, fmt.Errorf("unknown userdb type: %s", cfg.UserDb.Type)
+	udb, err := newUserDb(&cfg.UserDb, cfg.Tokens.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user db: %w", err)
 	}
 
 	cstore := clientstore.New(cfg)
-	kstore, err := keystore.New(5)
+	sstore, kstorage, err := newStateStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state store: %w", err)
+	}
+	kstore, err := newKeyStore(cfg, kstorage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create keystore: %w", err)
 	}
-	tstore := tokenstore.New(cfg.IssuerURL, kstore)
+	tstore := tokenstore.New(cfg, cstore, kstore, sstore)
 
 	// create the endpoint handlers
 	cauth := authcommon.New(cstore, tstore)
@@ -63,44 +65,258 @@ func New(cfg *config.Config) (api.Service, error) {
 		return nil, fmt.Errorf("failed to create basic auth handler: %w", err)
 	}
 	mauth := authmtls.New(cauth, udb)
-	oconfig, err := oidconfig.New(cfg.IssuerURL, cfg.AuthURL)
+	oconfig, err := oidconfig.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create oidc config handler: %w", err)
 	}
+	wfinger := webfinger.New(cfg.IssuerURL)
 	khandler := keys.New(kstore)
+	kshandler := keys.NewStatus(cstore, kstore)
 	thandler := token.New(cstore, tstore)
+	ihandler := introspect.New(cstore, tstore)
+	uhandler := userinfo.New(cstore, tstore)
 
 	// create the service
 	svc := service{
-		authBasic: bauth,
-		authMtls:  mauth,
-		oidConfig: oconfig,
-		keys:      khandler,
-		token:     thandler,
+		authBasic:  bauth,
+		authMtls:   mauth,
+		oidConfig:  oconfig,
+		webFinger:  wfinger,
+		keys:       khandler,
+		keyStatus:  kshandler,
+		token:      thandler,
+		introspect: ihandler,
+		userInfo:   uhandler,
+		tstore:     tstore,
+		kstore:     kstore,
+		sstore:     sstore,
+		udb:        udb,
 	}
 	return &svc, nil
 }
 
+func newUserDb(cfg *config.UserDb, subject string) (userdb.UserDb, error) {
+
+	var udb userdb.UserDb
+	var err error
+
+	switch cfg.Type {
+	case "chain":
+		backends := make([]*userdbchain.Backend, 0, len(cfg.Backends))
+		for _, bcfg := range cfg.Backends {
+			budb, err := newUserDb(bcfg, subject)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, &userdbchain.Backend{
+				UserDb:      budb,
+				Match:       bcfg.Match,
+				Domains:     bcfg.Domains,
+				StripDomain: bcfg.StripDomain,
+				MergeGroups: bcfg.MergeGroups,
+			})
+		}
+		udb = userdbchain.NewUserDb(backends)
+	case "ldap":
+		schema, err := newLdapSchema(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := userdbldap.NewTLSConfig(cfg.CaCertFile, cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		udb, err = userdbldap.NewUserDb(cfg.LdapURLs, cfg.Failover, cfg.SearchBase, cfg.SearchDn, cfg.SearchPw, schema, tlsConfig, cfg.PoolSize, cfg.PoolIdleTimeout, cfg.GroupCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+	case "yaml":
+		udb, err = userdbyaml.NewUserDb(cfg.Path, subject)
+		if err != nil {
+			return nil, err
+		}
+	case "sql":
+		udb, err = userdbsql.NewUserDb(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+	case "passwd":
+		udb, err = userdbunix.NewPasswdDb(cfg.Path, cfg.ShadowPath, cfg.GroupPath)
+		if err != nil {
+			return nil, err
+		}
+	case "htpasswd":
+		udb, err = userdbunix.NewHtpasswdDb(cfg.Path, cfg.GroupPath)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown userdb type: %s", cfg.Type)
+	}
+
+	// save going back to the source for every lookup
+	if cfg.CacheTTL > 0 {
+		udb = userdbcache.NewUserDb(udb, cfg.CacheTTL, cfg.CacheNegativeTTL, cfg.CacheSize)
+	}
+
+	return udb, nil
+}
+
+func newLdapSchema(cfg *config.UserDb) (*userdbldap.Schema, error) {
+	overrides := userdbldap.Schema{
+		UserFilter:  cfg.UserFilter,
+		LoginAttr:   cfg.LoginAttr,
+		GroupFilter: cfg.GroupFilter,
+		GroupAttr:   cfg.GroupAttr,
+		MemberAttr:  cfg.MemberAttr,
+		MemberValue: cfg.MemberValue,
+
+		MemberOfAttr: cfg.MemberOfAttr,
+		NestedDepth:  cfg.NestedDepth,
+		InChain:      cfg.InChain,
+
+		Attributes: make(map[string]string),
+	}
+	for field, attr := range cfg.Attributes {
+		overrides.Attributes[field] = attr
+	}
+
+	// the id attribute predates the mappings
+	if cfg.IdAttr != "" {
+		overrides.Attributes[userdbldap.FieldId] = cfg.IdAttr
+	}
+
+	return userdbldap.LoadSchema(cfg.Schema, &overrides)
+}
+
+func newStateStore(cfg *config.Config) (statestore.StateStore, keystore.Storage, error) {
+
+	// the keys are kept in the directory unless they're shared
+	var kstorage keystore.Storage
+	if cfg.Keys.Dir != "" {
+		kstorage = keystore.NewDirStorage(cfg.Keys.Dir)
+	}
+
+	switch cfg.State.Type {
+	case config.StateRedis:
+		opts, err := redis.ParseURL(cfg.State.RedisURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid redis url: %w", err)
+		}
+		client := redis.NewClient(opts)
+		err = client.Ping(context.Background()).Err()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to redis: %w", err)
+		}
+		kstorage = statestoreredis.NewKeyStorage(client, cfg.State.Prefix)
+		return statestoreredis.New(client, cfg.State.Prefix), kstorage, nil
+
+	case config.StateBolt:
+		sstore, err := statestorebolt.New(cfg.State.Path)
+		return sstore, kstorage, err
+
+	case config.StateMemory:
+		return statestore.NewMemory(), kstorage, nil
+	}
+	return nil, nil, fmt.Errorf("unknown state type: %s", cfg.State.Type)
+}
+
+func newKeyStore(cfg *config.Config, storage keystore.Storage) (keystore.KeyStore, error) {
+
+	// an external signer holds the keys and looks after their rotation
+	if cfg.Keys.Signer != "" {
+		return keystoreremote.New(cfg.Keys.Signer, cfg.Keys.Algorithms)
+	}
+
+	var passphrase []byte
+	if cfg.Keys.PassphraseFile != "" {
+		data, err := os.ReadFile(cfg.Keys.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key passphrase: %w", err)
+		}
+		passphrase = bytes.TrimSpace(data)
+	}
+
+	// the private keys are never written to redis in the clear
+	if cfg.State.Type == config.StateRedis && len(passphrase) == 0 {
+		return nil, fmt.Errorf("keys shared through redis need a passphrase")
+	}
+
+	// keys get certificates if we have the CA key to issue them
+	var issuer *keystore.Issuer
+	if cfg.Keys.CaKeyFile != "" {
+		var err error
+		issuer, err = keystore.LoadIssuer(cfg.Keys.CaCertFile, cfg.Keys.CaKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key CA: %w", err)
+		}
+	}
+
+	return keystore.New(storage, passphrase, cfg.Keys.Algorithms, cfg.Keys.RotationPeriod, cfg.MaxSignedLifetime(), issuer)
+}
+
 type service struct {
-	authBasic http.Handler
-	authMtls  http.Handler
-	oidConfig http.Handler
-	keys      http.Handler
-	token     http.Handler
+	authBasic  http.Handler
+	authMtls   http.Handler
+	oidConfig  http.Handler
+	webFinger  http.Handler
+	keys       http.Handler
+	keyStatus  http.Handler
+	token      http.Handler
+	introspect http.Handler
+	userInfo   http.Handler
+
+	tstore tokenstore.TokenStore
+	kstore keystore.KeyStore
+	sstore statestore.StateStore
+	udb    userdb.UserDb
+}
+
+func (s *service) Close() error {
+	// the state store goes last, the others use it
+	err := s.udb.Close()
+	if err != nil {
+		return err
+	}
+	err = s.tstore.Close()
+	if err != nil {
+		return err
+	}
+	err = s.kstore.Close()
+	if err != nil {
+		return err
+	}
+	return s.sstore.Close()
 }
 
 func (s *service) OIDCConfiguration(w http.ResponseWriter, r *http.Request) {
 	s.oidConfig.ServeHTTP(w, r)
 }
 
+func (s *service) WebFinger(w http.ResponseWriter, r *http.Request) {
+	s.webFinger.ServeHTTP(w, r)
+}
+
 func (s *service) Keys(w http.ResponseWriter, r *http.Request) {
 	s.keys.ServeHTTP(w, r)
 }
 
+func (s *service) KeyStatus(w http.ResponseWriter, r *http.Request) {
+	s.keyStatus.ServeHTTP(w, r)
+}
+
 func (s *service) Tokens(w http.ResponseWriter, r *http.Request) {
 	s.token.ServeHTTP(w, r)
 }
 
+func (s *service) Introspect(w http.ResponseWriter, r *http.Request) {
+	s.introspect.ServeHTTP(w, r)
+}
+
+func (s *service) UserInfo(w http.ResponseWriter, r *http.Request) {
+	s.userInfo.ServeHTTP(w, r)
+}
+
 func (s *service) AuthnStart(w http.ResponseWriter, r *http.Request) {
 	if r.Context().Value(mtls.MTLSKey{}) != nil {
 		s.authMtls.ServeHTTP(w, r)
@@ -1,13 +1,30 @@
 package clientstore
 
 import (
+	"crypto"
+
 	"github.com/parlaynu/studio1767-idp/internal/config"
 )
 
 type Client struct {
-	Id           string
-	Secret       string
-	RedirectURLs []string
+	Id                 string
+	Secrets            []config.ClientSecret
+	RedirectURLs       []string
+	AccessTokenProfile string
+	Audience           string
+	Lifetimes          config.Lifetimes
+	IdTokenSignedAlg   string
+	UserInfoSignedAlg  string
+	Introspect         bool
+	Admin              bool
+	IdTokenEncryption  *Encryption
+	UserInfoEncryption *Encryption
+}
+
+type Encryption struct {
+	Key crypto.PublicKey
+	Alg string
+	Enc string
 }
 
 type ClientStore interface {
@@ -19,11 +36,46 @@ func New(cfg *config.Config) ClientStore {
 		clients: make(map[string]*Client),
 	}
 
+	lifetimes := cfg.Tokens.Lifetimes.Inherit(config.DefaultLifetimes)
+
 	for _, client := range cfg.Clients {
 		cl := Client{
-			Id:           client.Id,
-			Secret:       client.Secret,
-			RedirectURLs: client.RedirectURLs,
+			Id:                 client.Id,
+			Secrets:            client.Secrets,
+			RedirectURLs:       client.RedirectURLs,
+			AccessTokenProfile: client.AccessTokenProfile,
+			Audience:           client.Audience,
+			Lifetimes:          client.Lifetimes.Inherit(lifetimes),
+			IdTokenSignedAlg:   client.IdTokenSignedAlg,
+			UserInfoSignedAlg:  client.UserInfoSignedAlg,
+			Introspect:         client.Introspect,
+			Admin:              client.Admin,
+		}
+		if cl.AccessTokenProfile == "" {
+			cl.AccessTokenProfile = cfg.Tokens.AccessTokenProfile
+		}
+		if cl.Audience == "" {
+			cl.Audience = cfg.Tokens.DefaultAudience(cfg.IssuerURL)
+		}
+		if cl.IdTokenSignedAlg == "" {
+			cl.IdTokenSignedAlg = cfg.Keys.DefaultAlg()
+		}
+		if cl.UserInfoSignedAlg == "" {
+			cl.UserInfoSignedAlg = cl.IdTokenSignedAlg
+		}
+		if client.IdTokenEncryptedAlg != "" {
+			cl.IdTokenEncryption = &Encryption{
+				Key: client.EncryptionKey,
+				Alg: client.IdTokenEncryptedAlg,
+				Enc: client.IdTokenEncryptedEnc,
+			}
+		}
+		if client.UserInfoEncryptedAlg != "" {
+			cl.UserInfoEncryption = &Encryption{
+				Key: client.EncryptionKey,
+				Alg: client.UserInfoEncryptedAlg,
+				Enc: client.UserInfoEncryptedEnc,
+			}
 		}
 		cs.clients[client.Id] = &cl
 	}
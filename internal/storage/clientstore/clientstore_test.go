@@ -18,21 +18,21 @@ func TestClientStore(t *testing.T) {
 
 	for _, cfgcl := range cfg.Clients {
 		cl := cs.Get(cfgcl.Id)
-		require.Equal(t, cfgcl.Secret, cl.Secret)
+		require.Equal(t, cfgcl.Secrets, cl.Secrets)
 		require.Equal(t, cfgcl.RedirectURLs[0], cl.RedirectURLs[0])
 	}
 }
 
 func createConfig() *config.Config {
-	clients := []config.ClientConfig{}
+	clients := []*config.ClientConfig{}
 	nclients := 5
 	for i := 0; i < nclients; i++ {
 		client := config.ClientConfig{
 			Id:           fmt.Sprintf("Id%d", i),
-			Secret:       fmt.Sprintf("Secret%d", i),
+			Secrets:      []config.ClientSecret{{Secret: fmt.Sprintf("Secret%d", i)}},
 			RedirectURLs: []string{fmt.Sprintf("http://server%d.example.com", i)},
 		}
-		clients = append(clients, client)
+		clients = append(clients, &client)
 	}
 
 	cfg := config.Config{
@@ -0,0 +1,121 @@
+package filewatch
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long the files have to be quiet before they're reloaded
+const reloadDelay = 100 * time.Millisecond
+
+// call reload when any of the files change, until it's closed
+func New(paths []string, reload func()) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := Watcher{
+		watcher: watcher,
+		paths:   make(map[string]bool),
+		reload:  reload,
+		done:    make(chan struct{}),
+	}
+
+	// watch the directories, as editors and the tools that manage the files
+	//   replace them rather than writing to them
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		w.paths[path] = true
+
+		dir := filepath.Dir(path)
+		if watched[dir] {
+			continue
+		}
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		watched[dir] = true
+	}
+
+	go w.run()
+
+	return &w, nil
+}
+
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	paths   map[string]bool
+	reload  func()
+	done    chan struct{}
+
+	mutex  sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+func (w *Watcher) Close() error {
+	w.mutex.Lock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mutex.Unlock()
+
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.paths[filepath.Clean(event.Name)] {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+
+			// editors can take a few writes to save a file
+			w.mutex.Lock()
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			w.timer = time.AfterFunc(reloadDelay, w.fire)
+			w.mutex.Unlock()
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("filewatch: watch failed: %v", err)
+		}
+	}
+}
+
+// reloads are done holding the lock, so none is left running once it's closed
+func (w *Watcher) fire() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.closed {
+		w.reload()
+	}
+}
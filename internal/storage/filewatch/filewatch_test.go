@@ -0,0 +1,58 @@
+package filewatch_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/filewatch"
+)
+
+func TestWatcher(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	path1, path2 := filepath.Join(dir1, "file1"), filepath.Join(dir2, "file2")
+
+	var reloads atomic.Int32
+	w, err := filewatch.New([]string{path1, path2, ""}, func() {
+		reloads.Add(1)
+	})
+	require.NoError(t, err)
+
+	// a burst of writes is one reload
+	for i := 0; i < 5; i++ {
+		err = os.WriteFile(path1, []byte("content"), 0600)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return reloads.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// files replaced in the other directory are seen too
+	tmp := filepath.Join(dir2, "tmp")
+	err = os.WriteFile(tmp, []byte("content"), 0600)
+	require.NoError(t, err)
+	err = os.Rename(tmp, path2)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return reloads.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// but other files aren't
+	err = os.WriteFile(filepath.Join(dir1, "other"), []byte("content"), 0600)
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(2), reloads.Load())
+
+	// and nothing is reloaded once it's closed, even if it was about to be
+	err = os.WriteFile(path1, []byte("content"), 0600)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	err = w.Close()
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(2), reloads.Load())
+}
@@ -0,0 +1,117 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/parlaynu/studio1767-idp/internal/config"
+)
+
+type PublicKey struct {
+	Alg          string
+	Key          crypto.PublicKey
+	Certificates []*x509.Certificate
+}
+
+func validAlgorithm(alg string) bool {
+	for _, a := range config.SigningAlgs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256", "PS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+}
+
+func checkKey(alg string, key crypto.PublicKey) error {
+	ok := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		ok = alg == "RS256" || alg == "PS256"
+	case *ecdsa.PublicKey:
+		ok = (alg == "ES256" && k.Curve == elliptic.P256()) || (alg == "ES384" && k.Curve == elliptic.P384())
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA"
+	}
+	if !ok {
+		return fmt.Errorf("key type %T can't be used for %s", key, alg)
+	}
+	return nil
+}
+
+func SignerOpts(alg string) (crypto.SignerOpts, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "ES384":
+		return crypto.SHA384, nil
+	case "PS256":
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, nil
+	case "EdDSA":
+		// EdDSA signs the message directly, the others sign a digest
+		return crypto.Hash(0), nil
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+}
+
+func Sign(signer crypto.Signer, alg string, input []byte) ([]byte, error) {
+	opts, err := SignerOpts(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := input
+	if hash := opts.HashFunc(); hash != 0 {
+		h := hash.New()
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// ECDSA signers return ASN.1, but JWS wants the fixed size R || S form
+	if pub, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		return ecdsaRaw(sig, (pub.Curve.Params().BitSize+7)/8)
+	}
+
+	return sig, nil
+}
+
+func ecdsaRaw(der []byte, size int) ([]byte, error) {
+	var parsed struct {
+		R, S *big.Int
+	}
+	_, err := asn1.Unmarshal(der, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ecdsa signature: %w", err)
+	}
+
+	raw := make([]byte, 2*size)
+	parsed.R.FillBytes(raw[:size])
+	parsed.S.FillBytes(raw[size:])
+	return raw, nil
+}
@@ -0,0 +1,104 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"time"
+)
+
+// the CA that issues certificates for the signing keys, so they can be published with x5c chains
+type Issuer struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+func LoadIssuer(certFile, keyFile string) (*Issuer, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if !reflect.DeepEqual(key.Public(), cert.PublicKey) {
+		return nil, fmt.Errorf("private key doesn't match the certificate")
+	}
+
+	issuer := Issuer{
+		Cert: cert,
+		Key:  key,
+	}
+	return &issuer, nil
+}
+
+func (is *Issuer) issue(entry *keyEntry) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	// the certificate can't outlive the CA, and the key will be gone long before then
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: entry.kid},
+		NotBefore:             entry.created.Add(-time.Minute),
+		NotAfter:              is.Cert.NotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, is.Cert, entry.key.Public(), is.Key)
+	if err != nil {
+		return fmt.Errorf("failed to issue certificate for key %s: %w", entry.kid, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	entry.certs = []*x509.Certificate{cert, is.Cert}
+	return nil
+}
+
+func (is *Issuer) issued(entry *keyEntry) bool {
+	return len(entry.certs) > 0 && entry.certs[0].CheckSignatureFrom(is.Cert) == nil
+}
@@ -0,0 +1,9 @@
+package keystore
+
+func Rotate(ks KeyStore) error {
+	return ks.(*keyStore).rotate()
+}
+
+func Sync(ks KeyStore) error {
+	return ks.(*keyStore).sync()
+}
@@ -1,79 +1,557 @@
 package keystore
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
 	"fmt"
-	mrand "math/rand"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/config"
 )
 
 type KeyStore interface {
-	GetPublicKeys() map[string]*rsa.PublicKey
-	GetPrivateKey() (string, *rsa.PrivateKey)
+	GetPublicKeys() map[string]*PublicKey
+	GetSigningKey(alg string) (string, crypto.Signer, error)
+	GetKey(kid string) (crypto.Signer, error)
+	Algorithms() []string
+	Status() *Status
+	Close() error
+}
+
+// the lifecycle of a key
+//
+//	pending: published but not yet used for signing
+//	active:  the one key for its algorithm used for signing
+//	retired: no longer used for signing, but published until its tokens expire
+const (
+	StatePending = "pending"
+	StateActive  = "active"
+	StateRetired = "retired"
+)
+
+type Status struct {
+	RotationPeriod time.Duration
+	NextRotation   time.Time
+	Keys           []*KeyInfo
 }
 
-func New(nkeys int) (KeyStore, error) {
+type KeyInfo struct {
+	Kid     string
+	Alg     string
+	State   string
+	Created time.Time
+	Since   time.Time
+	Removal time.Time
+}
+
+// for instances sharing key storage
+const (
+	syncInterval = 30 * time.Second // how often they pick up each other's changes
+	syncWait     = 30 * time.Second // how long a new one waits for the leader to create keys
+)
+
+func New(storage Storage, passphrase []byte, algs []string, period, retain time.Duration, issuer *Issuer) (KeyStore, error) {
+
+	if len(algs) == 0 {
+		algs = []string{config.DefaultSigningAlg}
+	}
 
 	ks := keyStore{
-		nkeys: nkeys,
-		keys:  make(map[string]*rsa.PrivateKey),
+		storage: storage,
+		algs:    algs,
+		period:  period,
+		retain:  retain,
+		issuer:  issuer,
+		timers:  make(map[*time.Timer]struct{}),
+		done:    make(chan struct{}),
+	}
+	if len(passphrase) > 0 {
+		ks.passphrase = passphrase
+	}
+	if storage != nil {
+		ks.leader, _ = storage.(Leader)
+	}
+	for _, alg := range algs {
+		if !validAlgorithm(alg) {
+			return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+		}
+	}
+
+	// shared keys are managed by the leader, with everyone keeping in sync
+	if ks.leader != nil {
+		err := ks.startSync()
+		if err != nil {
+			return nil, err
+		}
+		ks.logKeys()
+		return &ks, nil
 	}
-	err := ks.createKeys()
+
+	// load any keys from previous runs and bring them up to date
+	entries, err := ks.loadKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
+	}
+
+	err = ks.restore(entries, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create keys: %w", err)
 	}
+	ks.logKeys()
 
 	return &ks, nil
 }
 
+type keyEntry struct {
+	kid     string
+	alg     string
+	key     crypto.Signer
+	certs   []*x509.Certificate
+	state   string
+	created time.Time
+	since   time.Time
+	removal time.Time
+}
+
+type algKeys struct {
+	active  *keyEntry
+	pending *keyEntry
+}
+
 type keyStore struct {
-	nkeys int
-	keys  map[string]*rsa.PrivateKey
-	kids  []string
+	mutex      sync.RWMutex
+	storage    Storage
+	leader     Leader
+	passphrase []byte
+	algs       []string
+	period     time.Duration
+	retain     time.Duration
+	issuer     *Issuer
+	keys       map[string]*keyEntry
+	signers    map[string]*algKeys
+	next       time.Time
+
+	// the scheduled rotations and removals and the sync, stopped on close
+	tmutex sync.Mutex
+	timers map[*time.Timer]struct{}
+	done   chan struct{}
+	closed bool
 }
 
-func (ks *keyStore) GetPublicKeys() map[string]*rsa.PublicKey {
+func (ks *keyStore) GetPublicKeys() map[string]*PublicKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
 
-	pubkeys := make(map[string]*rsa.PublicKey)
-	for kid, key := range ks.keys {
-		pubkeys[kid] = key.Public().(*rsa.PublicKey)
+	pubkeys := make(map[string]*PublicKey)
+	for kid, entry := range ks.keys {
+		pubkeys[kid] = &PublicKey{
+			Alg:          entry.alg,
+			Key:          entry.key.Public(),
+			Certificates: entry.certs,
+		}
 	}
 
 	return pubkeys
 }
 
-func (ks *keyStore) GetPrivateKey() (string, *rsa.PrivateKey) {
+func (ks *keyStore) GetSigningKey(alg string) (string, crypto.Signer, error) {
+	if alg == "" {
+		alg = ks.algs[0]
+	}
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
 
-	// choose a key at random
-	kid := ks.kids[mrand.Intn(ks.nkeys)]
-	key := ks.keys[kid]
+	ak := ks.signers[alg]
+	if ak == nil || ak.active == nil {
+		return "", nil, fmt.Errorf("keystore: no key for algorithm %s", alg)
+	}
 
-	return kid, key
+	return ak.active.kid, ak.active.key, nil
 }
 
-func (ks *keyStore) createKeys() error {
+func (ks *keyStore) GetKey(kid string) (crypto.Signer, error) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	// only active keys sign... pending keys aren't in use yet, and retired keys
+	//   are only published so the tokens they've signed can still be checked
+	entry := ks.keys[kid]
+	if entry == nil || entry.state != StateActive {
+		return nil, fmt.Errorf("keystore: no signing key with id %s", kid)
+	}
+
+	return entry.key, nil
+}
+
+func (ks *keyStore) Algorithms() []string {
+	return ks.algs
+}
 
-	// create the encryption keys
-	keys := make(map[string]*rsa.PrivateKey)
-	kids := make([]string, ks.nkeys)
+func (ks *keyStore) Status() *Status {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
 
-	for i := 0; i < ks.nkeys; i++ {
-		kid := uuid.New().String()
+	status := Status{
+		RotationPeriod: ks.period,
+		NextRotation:   ks.next,
+	}
+	for _, entry := range ks.keys {
+		status.Keys = append(status.Keys, &KeyInfo{
+			Kid:     entry.kid,
+			Alg:     entry.alg,
+			State:   entry.state,
+			Created: entry.created,
+			Since:   entry.since,
+			Removal: entry.removal,
+		})
+	}
+	sort.Slice(status.Keys, func(i, j int) bool {
+		ki, kj := status.Keys[i], status.Keys[j]
+		if !ki.Created.Equal(kj.Created) {
+			return ki.Created.Before(kj.Created)
+		}
+		return ki.Kid < kj.Kid
+	})
+
+	return &status
+}
+
+func (ks *keyStore) Close() error {
+	ks.tmutex.Lock()
+	defer ks.tmutex.Unlock()
+
+	if ks.closed {
+		return nil
+	}
+	ks.closed = true
+	for t := range ks.timers {
+		t.Stop()
+	}
+	ks.timers = nil
+	close(ks.done)
+
+	if ks.leader != nil {
+		return ks.leader.Close()
+	}
+	return nil
+}
+
+// runs f after d, unless the keystore is closed first
+func (ks *keyStore) after(d time.Duration, f func()) {
+	ks.tmutex.Lock()
+	defer ks.tmutex.Unlock()
+
+	if ks.closed {
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		ks.tmutex.Lock()
+		delete(ks.timers, t)
+		ks.tmutex.Unlock()
+
+		f()
+	})
+	ks.timers[t] = struct{}{}
+}
+
+func (ks *keyStore) logKeys() {
+	for _, alg := range ks.algs {
+		ak := ks.signers[alg]
+		if ak.pending == nil {
+			log.Infof("keystore: %s active key %s, rotation disabled", alg, ak.active.kid)
+		} else {
+			log.Infof("keystore: %s active key %s, next key %s, rotating at %s", alg, ak.active.kid, ak.pending.kid, ks.next.Format(time.RFC3339))
+		}
+	}
+}
+
+func (ks *keyStore) reset() {
+	ks.keys = make(map[string]*keyEntry)
+	ks.signers = make(map[string]*algKeys)
+	for _, alg := range ks.algs {
+		ks.signers[alg] = &algKeys{}
+	}
+	ks.next = time.Time{}
+}
+
+func (ks *keyStore) restore(entries []*keyEntry, now time.Time) error {
+	ks.reset()
+
+	// process the keys oldest first, so any duplicated states resolve to the newest
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].created.Before(entries[j].created)
+	})
+
+	for _, entry := range entries {
+		// make sure the keys have certificates from the current CA
+		expired := entry.state == StateRetired && now.After(entry.removal)
+		if ks.issuer != nil && !expired && !ks.issuer.issued(entry) {
+			err := ks.issuer.issue(entry)
+			if err != nil {
+				return err
+			}
+			err = ks.saveKey(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		// keys for algorithms no longer configured are retired
+		ak := ks.signers[entry.alg]
+		if ak == nil && entry.state != StateRetired {
+			err := ks.retire(entry, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch entry.state {
+		case StateRetired:
+			if now.After(entry.removal) {
+				err := ks.deleteKey(entry.kid)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			ks.keys[entry.kid] = entry
+			ks.scheduleRemoval(entry, now)
+
+		case StateActive:
+			if ak.active != nil {
+				err := ks.retire(ak.active, now)
+				if err != nil {
+					return err
+				}
+			}
+			ak.active = entry
+			ks.keys[entry.kid] = entry
+
+		case StatePending:
+			// a pending key has never signed anything, so extras can just go
+			if ak.pending != nil {
+				delete(ks.keys, ak.pending.kid)
+				err := ks.deleteKey(ak.pending.kid)
+				if err != nil {
+					return err
+				}
+			}
+			ak.pending = entry
+			ks.keys[entry.kid] = entry
+		}
+	}
 
-		key, err := rsa.GenerateKey(rand.Reader, 2048)
+	// make sure there is an active key for each algorithm, preferring the
+	//   published pending key
+	for _, alg := range ks.algs {
+		ak := ks.signers[alg]
+		if ak.active != nil {
+			continue
+		}
+
+		if ak.pending != nil {
+			ak.active, ak.pending = ak.pending, nil
+		} else {
+			entry, err := ks.newKeyEntry(alg, now)
+			if err != nil {
+				return err
+			}
+			ak.active = entry
+			ks.keys[entry.kid] = entry
+		}
+		ak.active.state, ak.active.since = StateActive, now
+
+		err := ks.saveKey(ak.active)
 		if err != nil {
 			return err
 		}
+	}
+
+	// without a rotation period, there's nothing more to do, otherwise the next
+	//   key is published a full period before it becomes active, and retired keys
+	//   are published for long enough to cover the tokens they signed
+	if ks.period == 0 {
+		return nil
+	}
+
+	for _, alg := range ks.algs {
+		ak := ks.signers[alg]
+		if ak.pending != nil {
+			continue
+		}
+
+		entry, err := ks.newKeyEntry(alg, now)
+		if err != nil {
+			return err
+		}
+		err = ks.saveKey(entry)
+		if err != nil {
+			return err
+		}
+		ak.pending = entry
+		ks.keys[entry.kid] = entry
+	}
+
+	// all algorithms rotate together, driven by the oldest active key
+	for _, alg := range ks.algs {
+		next := ks.signers[alg].active.since.Add(ks.period)
+		if ks.next.IsZero() || next.Before(ks.next) {
+			ks.next = next
+		}
+	}
+	if ks.next.Before(now) {
+		ks.next = now
+	}
+
+	// shared keys are rotated by the sync
+	if ks.leader == nil {
+		ks.after(ks.next.Sub(now), ks.scheduledRotate)
+	}
+
+	return nil
+}
+
+func (ks *keyStore) scheduledRotate() {
+	err := ks.rotate()
+	if err != nil {
+		log.Errorf("keystore: rotation failed, retrying in a minute: %v", err)
+		ks.after(time.Minute, ks.scheduledRotate)
+		return
+	}
+	ks.after(ks.period, ks.scheduledRotate)
+}
+
+func (ks *keyStore) rotate() error {
+
+	// generate the new keys before taking the lock, it takes a while
+	now := time.Now()
+	pending := make(map[string]*keyEntry)
+	for _, alg := range ks.algs {
+		entry, err := ks.newKeyEntry(alg, now)
+		if err != nil {
+			return err
+		}
+		pending[alg] = entry
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// save the new states before switching to them, the new pending keys last so
+	//   that an interrupted rotation is completed when the keys are next loaded
+	retired := make(map[string]*keyEntry)
+	active := make(map[string]*keyEntry)
+	for _, alg := range ks.algs {
+		ak := ks.signers[alg]
+
+		r := *ak.active
+		r.state, r.since = StateRetired, now
+		r.removal = now.Add(ks.retain)
+		retired[alg] = &r
+
+		a := *ak.pending
+		a.state, a.since = StateActive, now
+		active[alg] = &a
+	}
+
+	for _, states := range []map[string]*keyEntry{retired, active, pending} {
+		for _, alg := range ks.algs {
+			err := ks.saveKey(states[alg])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, alg := range ks.algs {
+		ak := ks.signers[alg]
+
+		// retire the active key and schedule its removal
+		ks.keys[retired[alg].kid] = retired[alg]
+		ks.scheduleRemoval(retired[alg], now)
+
+		// promote the pending key and publish the next one
+		ak.active = active[alg]
+		ks.keys[ak.active.kid] = ak.active
 
-		keys[kid] = key
-		kids[i] = kid
+		ak.pending = pending[alg]
+		ks.keys[ak.pending.kid] = ak.pending
+
+		log.Infof("keystore: rotated %s keys, active %s, next %s, retired %s until %s",
+			alg, ak.active.kid, ak.pending.kid, retired[alg].kid, retired[alg].removal.Format(time.RFC3339))
 	}
+	ks.next = now.Add(ks.period)
 
-	// success, so store in the keystore
-	ks.keys = keys
-	ks.kids = kids
+	return nil
+}
+
+func (ks *keyStore) retire(entry *keyEntry, now time.Time) error {
+	entry.state, entry.since = StateRetired, now
+	entry.removal = now.Add(ks.retain)
+
+	err := ks.saveKey(entry)
+	if err != nil {
+		return err
+	}
+	ks.scheduleRemoval(entry, now)
 
 	return nil
 }
+
+func (ks *keyStore) scheduleRemoval(entry *keyEntry, now time.Time) {
+	// shared keys are removed by the sync
+	if ks.leader != nil {
+		return
+	}
+
+	kid := entry.kid
+	ks.after(entry.removal.Sub(now), func() {
+		ks.remove(kid)
+	})
+}
+
+func (ks *keyStore) remove(kid string) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	delete(ks.keys, kid)
+
+	err := ks.deleteKey(kid)
+	if err != nil {
+		log.Errorf("keystore: failed to delete retired key %s: %v", kid, err)
+		return
+	}
+
+	log.Infof("keystore: removed retired key %s", kid)
+}
+
+func (ks *keyStore) newKeyEntry(alg string, now time.Time) (*keyEntry, error) {
+	key, err := generateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := keyEntry{
+		kid:     uuid.New().String(),
+		alg:     alg,
+		key:     key,
+		state:   StatePending,
+		created: now,
+		since:   now,
+	}
+	if ks.issuer != nil {
+		err = ks.issuer.issue(&entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &entry, nil
+}
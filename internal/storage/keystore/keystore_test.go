@@ -1,8 +1,23 @@
 package keystore_test
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -10,14 +25,283 @@ import (
 )
 
 func TestKeyStore(t *testing.T) {
-	ks, err := keystore.New(5)
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
 	require.NoError(t, err)
 
 	pubkeys := ks.GetPublicKeys()
+	require.Len(t, pubkeys, 1)
 	for i := 0; i < 10; i++ {
-		kid, key := ks.GetPrivateKey()
+		kid, key, err := ks.GetSigningKey("")
+		require.NoError(t, err)
 		pubkey := key.Public().(*rsa.PublicKey)
 
-		require.Equal(t, pubkeys[kid], pubkey)
+		require.Equal(t, "RS256", pubkeys[kid].Alg)
+		require.Equal(t, pubkeys[kid].Key, pubkey)
+	}
+
+	_, _, err = ks.GetSigningKey("ES256")
+	require.Error(t, err)
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	algs := []string{"ES256", "PS256", "EdDSA", "ES384", "RS256"}
+	dir := t.TempDir()
+
+	ks, err := keystore.New(keystore.NewDirStorage(dir), []byte("secret passphrase"), algs, 0, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, algs, ks.Algorithms())
+	require.Len(t, ks.GetPublicKeys(), len(algs))
+
+	// the keys are reloaded with their algorithms
+	ks2, err := keystore.New(keystore.NewDirStorage(dir), []byte("secret passphrase"), algs, 0, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, ks.GetPublicKeys(), ks2.GetPublicKeys())
+
+	input := []byte("header.payload")
+	for _, alg := range algs {
+		kid, signer, err := ks2.GetSigningKey(alg)
+		require.NoError(t, err)
+
+		pubkey := ks2.GetPublicKeys()[kid]
+		require.Equal(t, alg, pubkey.Alg)
+
+		sig, err := keystore.Sign(signer, alg, input)
+		require.NoError(t, err)
+
+		switch alg {
+		case "RS256":
+			sum := sha256.Sum256(input)
+			require.NoError(t, rsa.VerifyPKCS1v15(pubkey.Key.(*rsa.PublicKey), crypto.SHA256, sum[:], sig))
+		case "PS256":
+			sum := sha256.Sum256(input)
+			require.NoError(t, rsa.VerifyPSS(pubkey.Key.(*rsa.PublicKey), crypto.SHA256, sum[:], sig, nil))
+		case "ES256":
+			sum := sha256.Sum256(input)
+			require.Len(t, sig, 64)
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			require.True(t, ecdsa.Verify(pubkey.Key.(*ecdsa.PublicKey), sum[:], r, s))
+		case "ES384":
+			sum := sha512.Sum384(input)
+			require.Len(t, sig, 96)
+			r, s := new(big.Int).SetBytes(sig[:48]), new(big.Int).SetBytes(sig[48:])
+			require.True(t, ecdsa.Verify(pubkey.Key.(*ecdsa.PublicKey), sum[:], r, s))
+		case "EdDSA":
+			require.True(t, ed25519.Verify(pubkey.Key.(ed25519.PublicKey), input, sig))
+		}
+	}
+
+	// dropping an algorithm retires its key
+	ks3, err := keystore.New(keystore.NewDirStorage(dir), []byte("secret passphrase"), []string{"ES256"}, 0, time.Hour, nil)
+	require.NoError(t, err)
+	for _, key := range ks3.Status().Keys {
+		if key.Alg == "ES256" {
+			require.Equal(t, keystore.StateActive, key.State)
+		} else {
+			require.Equal(t, keystore.StateRetired, key.State)
+		}
+	}
+
+	_, err = keystore.New(nil, nil, []string{"HS256"}, 0, 0, nil)
+	require.Error(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, time.Hour, 50*time.Millisecond, nil)
+	require.NoError(t, err)
+
+	// the next key is published before it's used
+	status := ks.Status()
+	require.Len(t, status.Keys, 2)
+	require.Equal(t, keystore.StateActive, status.Keys[0].State)
+	require.Equal(t, keystore.StatePending, status.Keys[1].State)
+
+	active, _, _ := ks.GetSigningKey("")
+	pending := status.Keys[1].Kid
+	require.Equal(t, status.Keys[0].Kid, active)
+	require.Contains(t, ks.GetPublicKeys(), pending)
+	_, err = ks.GetKey(pending)
+	require.Error(t, err)
+
+	// after rotation, the pending key is used and the old one is still published
+	err = keystore.Rotate(ks)
+	require.NoError(t, err)
+
+	kid, _, _ := ks.GetSigningKey("")
+	require.Equal(t, pending, kid)
+
+	pubkeys := ks.GetPublicKeys()
+	require.Len(t, pubkeys, 3)
+	require.Contains(t, pubkeys, active)
+
+	// but can't sign anything more
+	_, err = ks.GetKey(active)
+	require.Error(t, err)
+	_, err = ks.GetKey(pending)
+	require.NoError(t, err)
+
+	// and is removed once its retention has passed
+	require.Eventually(t, func() bool {
+		_, ok := ks.GetPublicKeys()[active]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, ks.GetPublicKeys(), 2)
+}
+
+func TestKeyPersistence(t *testing.T) {
+	for _, passphrase := range [][]byte{nil, []byte("secret passphrase")} {
+		dir := t.TempDir()
+
+		ks, err := keystore.New(keystore.NewDirStorage(dir), passphrase, nil, time.Hour, time.Hour, nil)
+		require.NoError(t, err)
+
+		kid, _, _ := ks.GetSigningKey("")
+		pubkeys := ks.GetPublicKeys()
+		require.Len(t, pubkeys, 2)
+
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+
+		// reloading gives the same keys in the same states
+		ks2, err := keystore.New(keystore.NewDirStorage(dir), passphrase, nil, time.Hour, time.Hour, nil)
+		require.NoError(t, err)
+
+		kid2, _, _ := ks2.GetSigningKey("")
+		require.Equal(t, kid, kid2)
+		require.Equal(t, pubkeys, ks2.GetPublicKeys())
+
+		// rotation is persisted too
+		err = keystore.Rotate(ks2)
+		require.NoError(t, err)
+
+		ks3, err := keystore.New(keystore.NewDirStorage(dir), passphrase, nil, time.Hour, time.Hour, nil)
+		require.NoError(t, err)
+
+		status2, status3 := ks2.Status(), ks3.Status()
+		require.Len(t, status3.Keys, 3)
+		for i, key := range status2.Keys {
+			require.Equal(t, key.Kid, status3.Keys[i].Kid)
+			require.Equal(t, key.State, status3.Keys[i].State)
+			require.True(t, key.Removal.Equal(status3.Keys[i].Removal))
+		}
+	}
+}
+
+// directory storage with a leader lease that can be taken away
+type leaderStorage struct {
+	keystore.Storage
+	leading atomic.Bool
+}
+
+func (ls *leaderStorage) IsLeader() bool {
+	return ls.leading.Load()
+}
+
+func (ls *leaderStorage) Close() error {
+	return nil
+}
+
+func TestKeyLeader(t *testing.T) {
+	dir := t.TempDir()
+	storage := leaderStorage{Storage: keystore.NewDirStorage(dir)}
+	storage.leading.Store(true)
+
+	ks, err := keystore.New(&storage, nil, nil, time.Hour, time.Hour, nil)
+	require.NoError(t, err)
+	defer ks.Close()
+
+	kid, _, _ := ks.GetSigningKey("")
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// a leader that loses its lease while generating keys doesn't save them
+	storage.leading.Store(false)
+	err = keystore.Rotate(ks)
+	require.Error(t, err)
+
+	nfiles, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	require.NoError(t, err)
+	require.Equal(t, files, nfiles)
+	nkid, _, _ := ks.GetSigningKey("")
+	require.Equal(t, kid, nkid)
+
+	// and follows what's saved from then on
+	err = keystore.Sync(ks)
+	require.NoError(t, err)
+	nkid, _, _ = ks.GetSigningKey("")
+	require.Equal(t, kid, nkid)
+	require.Len(t, ks.GetPublicKeys(), 2)
+}
+
+func TestKeyPassphrase(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := keystore.New(keystore.NewDirStorage(dir), []byte("secret passphrase"), nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	_, err = keystore.New(keystore.NewDirStorage(dir), []byte("wrong passphrase"), nil, 0, 0, nil)
+	require.Error(t, err)
+
+	_, err = keystore.New(keystore.NewDirStorage(dir), nil, nil, 0, 0, nil)
+	require.Error(t, err)
+}
+
+func TestKeyCertificates(t *testing.T) {
+	dir := t.TempDir()
+
+	// create a CA to issue the key certificates
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, caKey.Public(), caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(caKey)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	issuer, err := keystore.LoadIssuer(certFile, keyFile)
+	require.NoError(t, err)
+
+	// the keys are issued certificates that chain to the CA
+	keyDir := filepath.Join(dir, "keys")
+	ks, err := keystore.New(keystore.NewDirStorage(keyDir), nil, []string{"RS256", "EdDSA"}, 0, 0, issuer)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(issuer.Cert)
+	for _, pubkey := range ks.GetPublicKeys() {
+		require.Len(t, pubkey.Certificates, 2)
+		require.Equal(t, pubkey.Key, pubkey.Certificates[0].PublicKey)
+		_, err := pubkey.Certificates[0].Verify(x509.VerifyOptions{Roots: roots})
+		require.NoError(t, err)
+	}
+
+	// and they're kept with the keys
+	ks2, err := keystore.New(keystore.NewDirStorage(keyDir), nil, []string{"RS256", "EdDSA"}, 0, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, ks.GetPublicKeys(), ks2.GetPublicKeys())
+
+	// keys without certificates get them when a CA is configured
+	ks3, err := keystore.New(keystore.NewDirStorage(filepath.Join(dir, "other")), nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+	for _, pubkey := range ks3.GetPublicKeys() {
+		require.Empty(t, pubkey.Certificates)
+	}
+	ks4, err := keystore.New(keystore.NewDirStorage(filepath.Join(dir, "other")), nil, nil, 0, 0, issuer)
+	require.NoError(t, err)
+	for _, pubkey := range ks4.GetPublicKeys() {
+		require.Len(t, pubkey.Certificates, 2)
 	}
 }
@@ -0,0 +1,260 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+// keys are stored as PKCS#8 PEM, encrypted if there is a passphrase, with the
+//   lifecycle state held in the PEM headers and any certificates following
+
+// where the keys are kept between restarts, and shared between instances
+type Storage interface {
+	Load() (map[string][]byte, error)
+	Save(kid string, data []byte) error
+	Delete(kid string) error
+}
+
+// storage shared between instances elects one of them to manage the keys, and
+// the instance stands down when it's closed
+type Leader interface {
+	IsLeader() bool
+	Close() error
+}
+
+func (ks *keyStore) loadKeys() ([]*keyEntry, error) {
+	if ks.storage == nil {
+		return nil, nil
+	}
+
+	keys, err := ks.storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*keyEntry
+	for kid, data := range keys {
+		entry, err := ks.parseKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", kid, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (ks *keyStore) parseKey(kid string, data []byte) (*keyEntry, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	var err error
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if ks.passphrase == nil {
+			return nil, fmt.Errorf("key is encrypted and no passphrase is configured")
+		}
+		parsed, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, ks.passphrase)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	// keys saved before the algorithm was recorded are all RS256
+	alg := block.Headers["Alg"]
+	if alg == "" {
+		alg = "RS256"
+	}
+	err = checkKey(alg, key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	entry := keyEntry{
+		kid:   kid,
+		alg:   alg,
+		key:   key,
+		state: block.Headers["State"],
+	}
+	if entry.created, err = parseTime(block.Headers["Created"]); err != nil {
+		return nil, err
+	}
+	if entry.since, err = parseTime(block.Headers["Since"]); err != nil {
+		return nil, err
+	}
+	if entry.removal, err = parseTime(block.Headers["Removal"]); err != nil {
+		return nil, err
+	}
+
+	switch entry.state {
+	case StatePending, StateActive, StateRetired:
+	default:
+		return nil, fmt.Errorf("unknown key state %s", entry.state)
+	}
+
+	// any certificate chain follows the key
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type %s", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		entry.certs = append(entry.certs, cert)
+	}
+
+	return &entry, nil
+}
+
+func (ks *keyStore) saveKey(entry *keyEntry) error {
+	if ks.storage == nil {
+		return nil
+	}
+	if !ks.leading() {
+		return errNotLeader
+	}
+
+	der, err := pkcs8.MarshalPrivateKey(entry.key, ks.passphrase, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encode key %s: %w", entry.kid, err)
+	}
+
+	block := pem.Block{
+		Type: "PRIVATE KEY",
+		Headers: map[string]string{
+			"Alg":     entry.alg,
+			"State":   entry.state,
+			"Created": formatTime(entry.created),
+			"Since":   formatTime(entry.since),
+		},
+		Bytes: der,
+	}
+	if ks.passphrase != nil {
+		block.Type = "ENCRYPTED PRIVATE KEY"
+	}
+	if !entry.removal.IsZero() {
+		block.Headers["Removal"] = formatTime(entry.removal)
+	}
+
+	data := pem.EncodeToMemory(&block)
+	for _, cert := range entry.certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	err = ks.storage.Save(entry.kid, data)
+	if err != nil {
+		return fmt.Errorf("failed to save key %s: %w", entry.kid, err)
+	}
+
+	return nil
+}
+
+func (ks *keyStore) deleteKey(kid string) error {
+	if ks.storage == nil {
+		return nil
+	}
+	if !ks.leading() {
+		return errNotLeader
+	}
+	return ks.storage.Delete(kid)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// keys are stored one per file in a directory
+func NewDirStorage(dir string) Storage {
+	return &dirStorage{
+		dir: dir,
+	}
+}
+
+type dirStorage struct {
+	dir string
+}
+
+func (ds *dirStorage) Load() (map[string][]byte, error) {
+	err := os.MkdirAll(ds.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(ds.dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys[strings.TrimSuffix(filepath.Base(file), ".pem")] = data
+	}
+
+	return keys, nil
+}
+
+func (ds *dirStorage) Save(kid string, data []byte) error {
+	// write to a temporary file and move into place so a key is never half written
+	tmp, err := os.CreateTemp(ds.dir, ".key-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(ds.dir, kid+".pem"))
+}
+
+func (ds *dirStorage) Delete(kid string) error {
+	err := os.Remove(filepath.Join(ds.dir, kid+".pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
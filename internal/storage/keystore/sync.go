@@ -0,0 +1,148 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// with shared storage, the leader manages the keys as a single instance would,
+//   and the others follow what it has saved
+
+var (
+	errNoKeys    = errors.New("keystore: no active keys in shared storage")
+	errNotLeader = errors.New("keystore: no longer the leader")
+)
+
+// generating keys takes a while, and the lease can be lost in the meantime, so
+// it's checked again before anything is written
+func (ks *keyStore) leading() bool {
+	return ks.leader == nil || ks.leader.IsLeader()
+}
+
+func (ks *keyStore) startSync() error {
+	deadline := time.Now().Add(syncWait)
+	for {
+		err := ks.sync()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errNoKeys) || time.Now().After(deadline) {
+			return fmt.Errorf("failed to load shared keys: %w", err)
+		}
+
+		// the leader hasn't created the keys yet
+		log.Infof("keystore: waiting for the leader to create keys")
+		time.Sleep(time.Second)
+	}
+
+	go func() {
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := ks.sync()
+				if err != nil {
+					log.Errorf("keystore: failed to sync shared keys: %v", err)
+				}
+			case <-ks.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ks *keyStore) sync() error {
+	entries, err := ks.loadKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	if !ks.leader.IsLeader() {
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+
+		return ks.follow(entries, now)
+	}
+
+	ks.mutex.Lock()
+	err = ks.restore(entries, now)
+	due := ks.period != 0 && !now.Before(ks.next)
+	ks.mutex.Unlock()
+	if err == nil && due {
+		err = ks.rotate()
+	}
+
+	// the new leader carries on from what's been saved, and this one follows it
+	if errors.Is(err, errNotLeader) {
+		log.Infof("keystore: lost the leader lease, following the new leader")
+
+		entries, err = ks.loadKeys()
+		if err != nil {
+			return err
+		}
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+
+		return ks.follow(entries, time.Now())
+	}
+	return err
+}
+
+func (ks *keyStore) follow(entries []*keyEntry, now time.Time) error {
+
+	// the newest key in each state wins, the same as the leader does
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].created.Before(entries[j].created)
+	})
+
+	keys := make(map[string]*keyEntry)
+	signers := make(map[string]*algKeys)
+	for _, alg := range ks.algs {
+		signers[alg] = &algKeys{}
+	}
+
+	for _, entry := range entries {
+		if entry.state == StateRetired && now.After(entry.removal) {
+			continue
+		}
+		keys[entry.kid] = entry
+
+		ak := signers[entry.alg]
+		if ak == nil {
+			continue
+		}
+		switch entry.state {
+		case StateActive:
+			ak.active = entry
+		case StatePending:
+			ak.pending = entry
+		}
+	}
+
+	var next time.Time
+	for _, alg := range ks.algs {
+		ak := signers[alg]
+		if ak.active == nil {
+			return fmt.Errorf("%w for %s", errNoKeys, alg)
+		}
+		if ks.period != 0 {
+			n := ak.active.since.Add(ks.period)
+			if next.IsZero() || n.Before(next) {
+				next = n
+			}
+		}
+	}
+
+	ks.keys, ks.signers, ks.next = keys, signers, next
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package keystoreremote
+
+import (
+	"time"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+// makes the key list stale and returns the current retry wait
+func Expire(ks keystore.KeyStore) time.Duration {
+	rks := ks.(*keyStore)
+
+	rks.mutex.Lock()
+	defer rks.mutex.Unlock()
+
+	rks.next = time.Time{}
+	return rks.retry
+}
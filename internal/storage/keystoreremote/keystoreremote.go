@@ -0,0 +1,326 @@
+package keystoreremote
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/config"
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+// how long the key list is used, and the first wait when the signer can't be reached
+const (
+	refreshInterval = 30 * time.Second
+	retryMin        = time.Second
+)
+
+func New(socket string, algs []string) (keystore.KeyStore, error) {
+
+	if len(algs) == 0 {
+		algs = []string{config.DefaultSigningAlg}
+	}
+
+	// all requests go to the unix socket, the host in the url is ignored
+	transport := http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	ks := keyStore{
+		algs: algs,
+		client: &http.Client{
+			Transport: &transport,
+			Timeout:   5 * time.Second,
+		},
+	}
+
+	keys, err := ks.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact signer: %w", err)
+	}
+	ks.update(keys)
+
+	// the signer needs an active key for every algorithm we sign with
+	for _, alg := range algs {
+		if ks.signers[alg] == "" {
+			return nil, fmt.Errorf("signer has no active key for algorithm %s", alg)
+		}
+	}
+
+	log.Infof("keystore: using external signer at %s", socket)
+
+	return &ks, nil
+}
+
+type keyStore struct {
+	mutex      sync.Mutex
+	algs       []string
+	client     *http.Client
+	next       time.Time
+	retry      time.Duration
+	refreshing bool
+	status     *keystore.Status
+	pubkeys    map[string]*keystore.PublicKey
+	signers    map[string]string
+}
+
+// the keys as the signer last reported them
+type keySet struct {
+	status  *keystore.Status
+	pubkeys map[string]*keystore.PublicKey
+	signers map[string]string
+}
+
+func (ks *keyStore) GetPublicKeys() map[string]*keystore.PublicKey {
+	ks.refreshIfStale()
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	pubkeys := make(map[string]*keystore.PublicKey)
+	for kid, key := range ks.pubkeys {
+		pubkeys[kid] = key
+	}
+	return pubkeys
+}
+
+func (ks *keyStore) GetSigningKey(alg string) (string, crypto.Signer, error) {
+	if alg == "" {
+		alg = ks.algs[0]
+	}
+
+	ks.refreshIfStale()
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	kid := ks.signers[alg]
+	if kid == "" {
+		return "", nil, fmt.Errorf("keystore: no key for algorithm %s", alg)
+	}
+
+	return kid, ks.signer(kid), nil
+}
+
+func (ks *keyStore) GetKey(kid string) (crypto.Signer, error) {
+	ks.refreshIfStale()
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// like the local keystore, only the active keys sign
+	for _, signer := range ks.signers {
+		if signer == kid {
+			return ks.signer(kid), nil
+		}
+	}
+	return nil, fmt.Errorf("keystore: no signing key with id %s", kid)
+}
+
+func (ks *keyStore) Algorithms() []string {
+	return ks.algs
+}
+
+func (ks *keyStore) Close() error {
+	ks.client.CloseIdleConnections()
+	return nil
+}
+
+func (ks *keyStore) Status() *keystore.Status {
+	ks.refreshIfStale()
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	return ks.status
+}
+
+func (ks *keyStore) signer(kid string) crypto.Signer {
+	// called with the mutex held
+	rs := remoteSigner{
+		ks:  ks,
+		kid: kid,
+		alg: ks.pubkeys[kid].Alg,
+		pub: ks.pubkeys[kid].Key,
+	}
+	return &rs
+}
+
+func (ks *keyStore) refreshIfStale() {
+	// one caller fetches the keys, without holding the mutex, and the others
+	//   carry on with the last list
+	ks.mutex.Lock()
+	if ks.refreshing || time.Now().Before(ks.next) {
+		ks.mutex.Unlock()
+		return
+	}
+	ks.refreshing = true
+	ks.mutex.Unlock()
+
+	keys, err := ks.fetch()
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.refreshing = false
+
+	// keep using the last list if the signer can't be reached, the signing
+	//   requests will fail anyway, and back off so it isn't asked on every request
+	if err != nil {
+		ks.retry = ks.retry * 2
+		if ks.retry < retryMin {
+			ks.retry = retryMin
+		}
+		if ks.retry > refreshInterval {
+			ks.retry = refreshInterval
+		}
+		ks.next = time.Now().Add(ks.retry)
+		log.Errorf("keystore: failed to refresh keys from signer, retrying in %s: %v", ks.retry, err)
+		return
+	}
+	ks.update(keys)
+}
+
+func (ks *keyStore) update(keys *keySet) {
+	// called with the mutex held
+	ks.status, ks.pubkeys, ks.signers = keys.status, keys.pubkeys, keys.signers
+	ks.retry = 0
+
+	// the signer won't sign with the keys it's retired, so the new keys are
+	//   picked up as soon as they're due
+	now := time.Now()
+	ks.next = now.Add(refreshInterval)
+	if rotation := keys.status.NextRotation; !rotation.IsZero() {
+		if !rotation.After(now) {
+			ks.next = now.Add(retryMin)
+		} else if rotation.Before(ks.next) {
+			ks.next = rotation
+		}
+	}
+}
+
+func (ks *keyStore) fetch() (*keySet, error) {
+	var resp keysResponse
+	err := ks.call(http.MethodGet, keysPath, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	status := keystore.Status{
+		NextRotation: resp.NextRotation,
+	}
+	if resp.RotationPeriod != "" {
+		status.RotationPeriod, err = time.ParseDuration(resp.RotationPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotation period: %w", err)
+		}
+	}
+
+	pubkeys := make(map[string]*keystore.PublicKey)
+	signers := make(map[string]string)
+	for _, key := range resp.Keys {
+		pub, err := x509.ParsePKIXPublicKey(key.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s: %w", key.Kid, err)
+		}
+		pubkey := keystore.PublicKey{
+			Alg: key.Alg,
+			Key: pub,
+		}
+		for _, der := range key.CertChain {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate for key %s: %w", key.Kid, err)
+			}
+			pubkey.Certificates = append(pubkey.Certificates, cert)
+		}
+		pubkeys[key.Kid] = &pubkey
+		if key.State == keystore.StateActive {
+			signers[key.Alg] = key.Kid
+		}
+		status.Keys = append(status.Keys, &keystore.KeyInfo{
+			Kid:     key.Kid,
+			Alg:     key.Alg,
+			State:   key.State,
+			Created: key.Created,
+			Since:   key.Since,
+			Removal: key.Removal,
+		})
+	}
+
+	keys := keySet{
+		status:  &status,
+		pubkeys: pubkeys,
+		signers: signers,
+	}
+	return &keys, nil
+}
+
+func (ks *keyStore) call(method, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		jdata, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jdata)
+	}
+
+	hreq, err := http.NewRequest(method, "http://signer"+path, body)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+
+	hresp, err := ks.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(hresp.Body, 512))
+		return fmt.Errorf("signer returned %s: %s", hresp.Status, bytes.TrimSpace(msg))
+	}
+
+	return json.NewDecoder(hresp.Body).Decode(resp)
+}
+
+type remoteSigner struct {
+	ks  *keyStore
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+func (rs *remoteSigner) Public() crypto.PublicKey {
+	return rs.pub
+}
+
+func (rs *remoteSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	// the key's algorithm decides the signing options on the other side
+	req := signRequest{
+		Kid:    rs.kid,
+		Alg:    rs.alg,
+		Digest: digest,
+	}
+	var resp signResponse
+	err := rs.ks.call(http.MethodPost, signPath, &req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: external signing with key %s failed: %w", rs.kid, err)
+	}
+	return resp.Signature, nil
+}
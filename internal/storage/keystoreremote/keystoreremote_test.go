@@ -0,0 +1,141 @@
+package keystoreremote_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystoreremote"
+)
+
+func startSigner(t *testing.T, ks keystore.KeyStore) (string, *http.Server) {
+	socket := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := http.Server{Handler: keystoreremote.NewServer(ks)}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return socket, &srv
+}
+
+func TestRemoteKeyStore(t *testing.T) {
+	algs := []string{"PS256", "ES256", "EdDSA", "RS256"}
+	local, err := keystore.New(nil, nil, algs, 0, 0, nil)
+	require.NoError(t, err)
+	socket, _ := startSigner(t, local)
+
+	ks, err := keystoreremote.New(socket, algs)
+	require.NoError(t, err)
+	require.Equal(t, local.GetPublicKeys(), ks.GetPublicKeys())
+
+	lstatus, status := local.Status(), ks.Status()
+	require.Len(t, status.Keys, len(lstatus.Keys))
+	for i, key := range lstatus.Keys {
+		require.Equal(t, key.Kid, status.Keys[i].Kid)
+		require.Equal(t, key.Alg, status.Keys[i].Alg)
+		require.Equal(t, key.State, status.Keys[i].State)
+		require.True(t, key.Created.Equal(status.Keys[i].Created))
+	}
+
+	input := []byte("header.payload")
+	sum := sha256.Sum256(input)
+	for _, alg := range algs {
+		kid, signer, err := ks.GetSigningKey(alg)
+		require.NoError(t, err)
+
+		lkid, _, err := local.GetSigningKey(alg)
+		require.NoError(t, err)
+		require.Equal(t, lkid, kid)
+
+		sig, err := keystore.Sign(signer, alg, input)
+		require.NoError(t, err)
+
+		pubkey := ks.GetPublicKeys()[kid].Key
+		switch alg {
+		case "RS256":
+			require.NoError(t, rsa.VerifyPKCS1v15(pubkey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig))
+		case "PS256":
+			require.NoError(t, rsa.VerifyPSS(pubkey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig, nil))
+		case "ES256":
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			require.True(t, ecdsa.Verify(pubkey.(*ecdsa.PublicKey), sum[:], r, s))
+		case "EdDSA":
+			require.True(t, ed25519.Verify(pubkey.(ed25519.PublicKey), input, sig))
+		}
+	}
+}
+
+func TestRemoteKeyRotation(t *testing.T) {
+	local, err := keystore.New(nil, nil, []string{"ES256"}, 500*time.Millisecond, time.Hour, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+	socket, _ := startSigner(t, local)
+
+	ks, err := keystoreremote.New(socket, []string{"ES256"})
+	require.NoError(t, err)
+	kid, signer, err := ks.GetSigningKey("")
+	require.NoError(t, err)
+
+	// the new key is used once the signer rotates, without waiting for the refresh
+	require.Eventually(t, func() bool {
+		nkid, _, err := ks.GetSigningKey("")
+		return err == nil && nkid != kid
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and the old one is still published, but the signer won't sign with it
+	require.Contains(t, ks.GetPublicKeys(), kid)
+	_, err = keystore.Sign(signer, "ES256", []byte("header.payload"))
+	require.Error(t, err)
+	_, err = ks.GetKey(kid)
+	require.Error(t, err)
+}
+
+func TestRemoteKeyStoreErrors(t *testing.T) {
+	local, err := keystore.New(nil, nil, []string{"ES256"}, 0, 0, nil)
+	require.NoError(t, err)
+	socket, srv := startSigner(t, local)
+
+	// the signer has to have keys for all the algorithms
+	_, err = keystoreremote.New(socket, []string{"RS256"})
+	require.Error(t, err)
+
+	_, err = keystoreremote.New(filepath.Join(t.TempDir(), "missing.sock"), nil)
+	require.Error(t, err)
+
+	// signing fails once the signer goes away
+	ks, err := keystoreremote.New(socket, []string{"ES256"})
+	require.NoError(t, err)
+	_, signer, err := ks.GetSigningKey("")
+	require.NoError(t, err)
+
+	_, err = ks.GetKey("unknown")
+	require.Error(t, err)
+
+	_, err = keystore.Sign(signer, "ES256", []byte("header.payload"))
+	require.NoError(t, err)
+
+	srv.Close()
+	_, err = keystore.Sign(signer, "ES256", []byte("header.payload"))
+	require.Error(t, err)
+
+	// the last keys are kept while the signer is down, with the retries backing off
+	pubkeys := ks.GetPublicKeys()
+	require.Zero(t, keystoreremote.Expire(ks))
+	require.Equal(t, pubkeys, ks.GetPublicKeys())
+	require.Equal(t, time.Second, keystoreremote.Expire(ks))
+	require.Equal(t, pubkeys, ks.GetPublicKeys())
+	require.Equal(t, 2*time.Second, keystoreremote.Expire(ks))
+}
@@ -0,0 +1,46 @@
+package keystoreremote
+
+import (
+	"time"
+)
+
+// the signer protocol is JSON over HTTP on a unix socket
+//
+//	GET  /keys  lists the published keys and the algorithms the signer supports
+//	POST /sign  signs a digest (or the message itself for EdDSA) with a key
+//
+// signatures are returned as produced by a crypto.Signer, so ECDSA signatures
+// are ASN.1 encoded
+
+const (
+	keysPath = "/keys"
+	signPath = "/sign"
+)
+
+type keysResponse struct {
+	Algorithms     []string   `json:"algorithms"`
+	RotationPeriod string     `json:"rotation_period,omitempty"`
+	NextRotation   time.Time  `json:"next_rotation,omitempty"`
+	Keys           []*keyData `json:"keys"`
+}
+
+type keyData struct {
+	Kid       string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	State     string    `json:"state"`
+	Created   time.Time `json:"created"`
+	Since     time.Time `json:"since"`
+	Removal   time.Time `json:"removal,omitempty"`
+	PublicKey []byte    `json:"public_key"`
+	CertChain [][]byte  `json:"cert_chain,omitempty"`
+}
+
+type signRequest struct {
+	Kid    string `json:"kid"`
+	Alg    string `json:"alg"`
+	Digest []byte `json:"digest"`
+}
+
+type signResponse struct {
+	Signature []byte `json:"signature"`
+}
@@ -0,0 +1,132 @@
+package keystoreremote
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+// the reference signer, serving the protocol from a local keystore
+
+func NewServer(ks keystore.KeyStore) http.Handler {
+	mux := http.NewServeMux()
+
+	h := serverHandler{
+		kStore: ks,
+	}
+	mux.HandleFunc(keysPath, h.keys)
+	mux.HandleFunc(signPath, h.sign)
+
+	return mux
+}
+
+type serverHandler struct {
+	kStore keystore.KeyStore
+}
+
+func (sh *serverHandler) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := sh.kStore.Status()
+	pubkeys := sh.kStore.GetPublicKeys()
+
+	resp := keysResponse{
+		Algorithms:   sh.kStore.Algorithms(),
+		NextRotation: status.NextRotation,
+	}
+	if status.RotationPeriod != 0 {
+		resp.RotationPeriod = status.RotationPeriod.String()
+	}
+	for _, key := range status.Keys {
+		pubkey := pubkeys[key.Kid]
+		if pubkey == nil {
+			continue
+		}
+		der, err := x509.MarshalPKIXPublicKey(pubkey.Key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Errorf("signer: failed to marshal key %s: %v", key.Kid, err)
+			return
+		}
+		kd := keyData{
+			Kid:       key.Kid,
+			Alg:       key.Alg,
+			State:     key.State,
+			Created:   key.Created,
+			Since:     key.Since,
+			Removal:   key.Removal,
+			PublicKey: der,
+		}
+		for _, cert := range pubkey.Certificates {
+			kd.CertChain = append(kd.CertChain, cert.Raw)
+		}
+		resp.Keys = append(resp.Keys, &kd)
+	}
+
+	writeJSON(w, &resp)
+}
+
+func (sh *serverHandler) sign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req signRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		log.Errorf("signer: failed to decode request: %v", err)
+		return
+	}
+
+	// the algorithm has to match the one the key was created for
+	pubkey := sh.kStore.GetPublicKeys()[req.Kid]
+	if pubkey == nil || pubkey.Alg != req.Alg {
+		http.Error(w, "unknown key", http.StatusNotFound)
+		log.Errorf("signer: no %s key with id %s", req.Alg, req.Kid)
+		return
+	}
+	signer, err := sh.kStore.GetKey(req.Kid)
+	if err != nil {
+		http.Error(w, "unknown key", http.StatusNotFound)
+		log.Errorf("signer: %v", err)
+		return
+	}
+	opts, err := keystore.SignerOpts(req.Alg)
+	if err != nil {
+		http.Error(w, "unsupported algorithm", http.StatusBadRequest)
+		log.Errorf("signer: %v", err)
+		return
+	}
+
+	sig, err := signer.Sign(rand.Reader, req.Digest, opts)
+	if err != nil {
+		http.Error(w, "signing failed", http.StatusBadRequest)
+		log.Errorf("signer: failed to sign with key %s: %v", req.Kid, err)
+		return
+	}
+
+	writeJSON(w, &signResponse{Signature: sig})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jdata, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("signer: failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jdata)
+}
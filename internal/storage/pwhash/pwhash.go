@@ -0,0 +1,119 @@
+package pwhash
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrMismatch    = errors.New("password doesn't match")
+	ErrUnsupported = errors.New("unsupported password hash")
+)
+
+// the crypt alphabet used by sha-crypt and yescrypt
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// the most an argon2 hash can ask for... far more than the recommended
+// settings, but a hash asking for gigabytes is a way to take down the server
+const (
+	argon2MemoryLimit  = 256 * 1024 // KiB
+	argon2TimeLimit    = 16
+	argon2ThreadsLimit = 16
+)
+
+// check the password against a crypt(3) style hash
+func Verify(hash, password string) error {
+	var computed string
+	var err error
+
+	switch {
+	case strings.HasPrefix(hash, "$6$"):
+		computed, err = sha512Crypt(password, hash)
+	case strings.HasPrefix(hash, "$y$"):
+		computed, err = yescrypt(password, hash)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		computed, err = argon2Hash(password, hash)
+	default:
+		return ErrUnsupported
+	}
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// whether the hash is one that can be verified... locked accounts and empty
+// passwords aren't
+func Supported(hash string) bool {
+	for _, prefix := range []string{"$6$", "$y$", "$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// the phc string for the password with the hash's parameters
+func argon2Hash(password, hash string) (string, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return "", errors.New("malformed argon2 hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil {
+		return "", fmt.Errorf("malformed argon2 version: %w", err)
+	}
+	if version != argon2.Version {
+		return "", fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return "", fmt.Errorf("malformed argon2 parameters: %w", err)
+	}
+	if time < 1 || threads < 1 {
+		return "", errors.New("invalid argon2 parameters")
+	}
+	if memory > argon2MemoryLimit || time > argon2TimeLimit || threads > argon2ThreadsLimit {
+		return "", errors.New("argon2 parameters over the limits")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return "", fmt.Errorf("malformed argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return "", errors.New("malformed argon2 key")
+	}
+
+	keyLen := uint32(len(key))
+	if fields[1] == "argon2id" {
+		key = argon2.IDKey([]byte(password), salt, time, memory, threads, keyLen)
+	} else {
+		key = argon2.Key([]byte(password), salt, time, memory, threads, keyLen)
+	}
+
+	fields[5] = base64.RawStdEncoding.EncodeToString(key)
+	return strings.Join(fields, "$"), nil
+}
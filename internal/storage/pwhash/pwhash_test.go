@@ -0,0 +1,72 @@
+package pwhash_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/pwhash"
+)
+
+// hashes of "password", made by libxcrypt unless noted
+var hashes = []string{
+	// sha512-crypt, with the default and explicit rounds
+	"$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/",
+	"$6$rounds=1000$saltsalt$Z/J9iYO1iE9xnr8JPQL57ZWsVRtVjrUv3CiWc/wKWseqXgSqn3HFYJ/Ng7YXa8XlLj.wpdAwHOJJzuGFqBBRa0",
+
+	// yescrypt, with the defaults, other costs, and with p and t set
+	"$y$j9T$abcdefghijklmnop$7asOTx5b6Exfl3myM6K0pLBn.I2hsEvu7G0F7NMfaO.",
+	"$y$jC5$abcd$jEUzowHmF/H1JEaXzCToYT5rpWlcNdlv83SSV2LZtS8",
+	"$y$j9T..$abcd$gFQu7yaSNCRBJzEgHxWRE2EUZG6nmOPsgLjjwhsRSD9",
+	"$y$j8T/0$abcd$ygm3NygC3p55Xho98RzrdJA760lcYBirLUgKq3lviF0",
+
+	// bcrypt
+	"$2y$05$abcdefghijklmnopqrstuuWG29KuyeAicPCJODk1zjyGvyQUU2awu",
+
+	// argon2i from the reference implementation's readme, and argon2id
+	"$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+	"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+}
+
+func TestVerify(t *testing.T) {
+	for _, hash := range hashes {
+		require.True(t, pwhash.Supported(hash), hash)
+		require.NoError(t, pwhash.Verify(hash, "password"), hash)
+		require.ErrorIs(t, pwhash.Verify(hash, "Password"), pwhash.ErrMismatch, hash)
+	}
+
+	// other passwords and salts
+	require.NoError(t, pwhash.Verify("$y$j9T$abcdefghijklmnop$pLCmL.WFP4llpuknjZB0lCp8KKEVl43CyXQupwneDY0", ""))
+	require.NoError(t, pwhash.Verify("$y$jDT$0123456789abcdef$bBI4hetcsTSP3D8oe7Z.MHb/6yYpusVfOFLGifxb179",
+		"pässwörd with a long long long long long long long long long long long value"))
+	require.NoError(t, pwhash.Verify("$6$0123456789abcdef$3afLNad0fyt3ysnmffZy.saDqFDKlfqG648zOu62sFvaN6pXEmg8O1ntQMgDaQEsnL9BZ8iaWO.Ph8w0Oo2XV.",
+		"pässwörd with a long long long long long long long long long long long value"))
+	require.NoError(t, pwhash.Verify("$6$0123456789abcdef$F2ysjt5Ng5qVz2/gDtbz.ycdictosXpZ7Xsgu8PlbAws/.ekNFWz9XrSKXBI0tVYfdxX.nsVfGs7qe4jMrOWH0", ""))
+}
+
+func TestVerifyUnsupported(t *testing.T) {
+	// locked, empty and unknown hashes never match
+	for _, hash := range []string{"", "*", "!", "!$6$saltsalt$qFmFH", "password", "$1$saltsalt$abc", "$apr1$salt$abc"} {
+		require.False(t, pwhash.Supported(hash), hash)
+		require.ErrorIs(t, pwhash.Verify(hash, "password"), pwhash.ErrUnsupported, hash)
+	}
+
+	// and broken ones are errors
+	for _, hash := range []string{
+		"$y$j9T$ab",
+		"$y$j9T$abc$hash",
+		"$y$$abcd$hash",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1a",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1a",
+		"$argon2id$v=19$m=4194304,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1a",
+		"$argon2id$v=19$m=65536,t=4294967295,p=1$c29tZXNhbHQ$CTFhFdXPJO1a",
+		"$argon2id$v=19$m=65536,t=2,p=255$c29tZXNhbHQ$CTFhFdXPJO1a",
+		"$2y$05$short",
+		"$6$rounds=10000001$saltsalt$qFmFH",
+		"$6$rounds=9999999999$saltsalt$qFmFH",
+	} {
+		err := pwhash.Verify(hash, "password")
+		require.Error(t, err, hash)
+		require.NotErrorIs(t, err, pwhash.ErrMismatch, hash)
+	}
+}
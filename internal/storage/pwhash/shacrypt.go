@@ -0,0 +1,163 @@
+package pwhash
+
+import (
+	"crypto/sha512"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// the sha-crypt limits, from https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	shaSaltMax      = 16
+	shaRoundsPrefix = "rounds="
+	shaRoundsMin    = 1000
+	shaRoundsMax    = 999999999
+	shaRoundsDef    = 5000
+)
+
+// the most rounds a hash can ask for... the spec allows far more, but a
+// hash that takes minutes to check is a way to tie up the server
+const shaRoundsLimit = 10000000
+
+// the $6$ hash of the password with the salt and rounds of the setting
+func sha512Crypt(password, setting string) (string, error) {
+	rest := strings.TrimPrefix(setting, "$6$")
+
+	rounds := shaRoundsDef
+	roundsCustom := false
+	if strings.HasPrefix(rest, shaRoundsPrefix) {
+		value, after, ok := strings.Cut(strings.TrimPrefix(rest, shaRoundsPrefix), "$")
+		if !ok {
+			return "", errors.New("malformed sha512-crypt rounds")
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", errors.New("malformed sha512-crypt rounds")
+		}
+		// out of range values are clamped rather than rejected
+		switch {
+		case n < shaRoundsMin:
+			rounds = shaRoundsMin
+		case n > shaRoundsMax:
+			rounds = shaRoundsMax
+		default:
+			rounds = int(n)
+		}
+		if rounds > shaRoundsLimit {
+			return "", errors.New("too many sha512-crypt rounds")
+		}
+		roundsCustom = true
+		rest = after
+	}
+
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > shaSaltMax {
+		salt = salt[:shaSaltMax]
+	}
+
+	pw := []byte(password)
+	sb := []byte(salt)
+
+	// digest b is the password, salt and password
+	h := sha512.New()
+	h.Write(pw)
+	h.Write(sb)
+	h.Write(pw)
+	b := h.Sum(nil)
+
+	// digest a is the password, salt, and b as long as the password, then
+	// b or the password for each bit of the password's length
+	h.Reset()
+	h.Write(pw)
+	h.Write(sb)
+	h.Write(repeat(b, len(pw)))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pw)
+		}
+	}
+	a := h.Sum(nil)
+
+	// the password and salt sequences
+	h.Reset()
+	for i := 0; i < len(pw); i++ {
+		h.Write(pw)
+	}
+	p := repeat(h.Sum(nil), len(pw))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(sb)
+	}
+	s := repeat(h.Sum(nil), len(sb))
+
+	// and all the rounds
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if roundsCustom {
+		out.WriteString(shaRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+
+	// the bytes are taken in an order of their own
+	for i := 0; i < 21; i++ {
+		x, y, z := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			x, y, z = y, z, x
+		case 2:
+			x, y, z = z, x, y
+		}
+		encode24(&out, c[x], c[y], c[z], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+
+	return out.String(), nil
+}
+
+// the sequence repeated to the length
+func repeat(seq []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		n := length - len(out)
+		if n > len(seq) {
+			n = len(seq)
+		}
+		out = append(out, seq[:n]...)
+	}
+	return out
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint32(b2)<<16 | uint32(b1)<<8 | uint32(b0)
+	for i := 0; i < n; i++ {
+		out.WriteByte(itoa64[w&0x3f])
+		w >>= 6
+	}
+}
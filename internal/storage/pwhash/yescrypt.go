@@ -0,0 +1,536 @@
+package pwhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// yescrypt as crypt(3) uses it, following the reference implementation from
+// https://www.openwall.com/yescrypt/... only the standard pwxform settings
+// are supported, which are the only ones libxcrypt creates
+
+const (
+	yesRW       = 0x002
+	yesDefaults = yesRW | 0x004 | 0x010 | 0x020 | 0x080 // 6 rounds, gather 4, simple 2, 12k sbox
+	yesPrehash  = 0x10000000
+
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+
+	pwxBytes = pwxGather * pwxSimple * 8
+	pwxWords = pwxBytes / 4
+	sBytes   = 3 * (1 << sWidth) * pwxSimple * 8
+	sWords   = sBytes / 4
+	sMask    = ((1 << sWidth) - 1) * pwxSimple * 8
+	sPairs   = (1 << sWidth) * pwxSimple
+
+	yesHashLen = 32
+)
+
+type yesParams struct {
+	flags uint32
+	N     uint64
+	r     uint32
+	p     uint32
+	t     uint32
+}
+
+// the $y$ hash of the password with the parameters and salt of the setting
+func yescrypt(password, setting string) (string, error) {
+	params, salt, prefix, err := parseYescrypt(setting)
+	if err != nil {
+		return "", err
+	}
+
+	hash := yescryptKdf([]byte(password), salt, params, yesHashLen)
+	return prefix + "$" + encode64(hash), nil
+}
+
+func parseYescrypt(setting string) (*yesParams, []byte, string, error) {
+	malformed := errors.New("malformed yescrypt setting")
+
+	src := strings.TrimPrefix(setting, "$y$")
+
+	flavor, src, ok := decode64Uint32(src, 0)
+	if !ok {
+		return nil, nil, "", malformed
+	}
+	var params yesParams
+	if flavor < yesRW {
+		params.flags = flavor
+	} else if flavor <= yesRW+(0x3fc>>2) {
+		params.flags = yesRW + ((flavor - yesRW) << 2)
+	} else {
+		return nil, nil, "", malformed
+	}
+	if params.flags != yesDefaults {
+		return nil, nil, "", ErrUnsupported
+	}
+
+	nLog2, src, ok := decode64Uint32(src, 1)
+	if !ok || nLog2 > 63 {
+		return nil, nil, "", malformed
+	}
+	params.N = 1 << nLog2
+	params.r, src, ok = decode64Uint32(src, 1)
+	if !ok {
+		return nil, nil, "", malformed
+	}
+	params.p = 1
+
+	// the optional parameters
+	if len(src) > 0 && src[0] != '$' {
+		var have uint32
+		have, src, ok = decode64Uint32(src, 1)
+		if !ok {
+			return nil, nil, "", malformed
+		}
+		if have&1 != 0 {
+			params.p, src, ok = decode64Uint32(src, 2)
+			if !ok {
+				return nil, nil, "", malformed
+			}
+		}
+		if have&2 != 0 {
+			params.t, src, ok = decode64Uint32(src, 1)
+			if !ok {
+				return nil, nil, "", malformed
+			}
+		}
+		// upgrades and rom aren't supported by crypt(3) either
+		if have&^3 != 0 {
+			return nil, nil, "", ErrUnsupported
+		}
+	}
+	if len(src) == 0 || src[0] != '$' {
+		return nil, nil, "", malformed
+	}
+	src = src[1:]
+
+	// sanity check them, so a bad hash can't take all the memory
+	if params.N <= 1 || params.N > 1<<30 || params.r < 1 || params.p < 1 ||
+		uint64(params.r)*uint64(params.p) >= 1<<30 || params.N/uint64(params.p) <= 1 ||
+		uint64(params.r)*params.N > 1<<21 {
+		return nil, nil, "", ErrUnsupported
+	}
+
+	saltStr, _, _ := strings.Cut(src, "$")
+	salt, ok := decode64(saltStr)
+	if !ok {
+		return nil, nil, "", malformed
+	}
+
+	prefix := setting[:len(setting)-len(src)] + saltStr
+	return &params, salt, prefix, nil
+}
+
+func yescryptKdf(password, salt []byte, params *yesParams, keyLen int) []byte {
+	N, r, p := params.N, params.r, params.p
+
+	// big enough hashes are pre-hashed with a sixty fourth of the memory
+	if p >= 1 && N/uint64(p) >= 0x100 && N/uint64(p)*uint64(r) >= 0x20000 {
+		pre := yesParams{flags: params.flags | yesPrehash, N: N >> 6, r: r, p: p}
+		password = yescryptBody(password, salt, &pre, 32)
+	}
+	return yescryptBody(password, salt, params, keyLen)
+}
+
+func yescryptBody(password, salt []byte, params *yesParams, keyLen int) []byte {
+	N, r, p := params.N, int(params.r), int(params.p)
+	s := 32 * r
+
+	key := "yescrypt"
+	if params.flags&yesPrehash != 0 {
+		key = "yescrypt-prehash"
+	}
+	password = hmacSha256([]byte(key), password)
+
+	b := pbkdf2.Key(password, salt, 1, 128*r*p, sha256.New)
+	password = append([]byte{}, b[:32]...)
+
+	// the blocks as words, laid out the way the reference implementation's
+	// simd code wants them, which pwxform depends on
+	B := make([]uint32, s*p)
+	for i := 0; i < len(B); i += 16 {
+		for k := 0; k < 16; k++ {
+			B[i+k] = binary.LittleEndian.Uint32(b[4*(i+k*5%16):])
+		}
+	}
+
+	V := make([]uint32, uint64(s)*N)
+	S := make([]uint32, sWords*p)
+	smix(B, r, N, p, params.t, params.flags, V, S, password)
+
+	for i := 0; i < len(B); i += 16 {
+		for k := 0; k < 16; k++ {
+			binary.LittleEndian.PutUint32(b[4*(i+k*5%16):], B[i+k])
+		}
+	}
+
+	dk := pbkdf2.Key(password, b, 1, keyLen, sha256.New)
+	if params.flags&yesPrehash != 0 {
+		return dk
+	}
+
+	// the scram style client key and its stored key
+	clientKey := hmacSha256(dk, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	copy(dk, storedKey[:])
+	return dk
+}
+
+type pwxformCtx struct {
+	S0, S1, S2 []uint32
+	w          int
+}
+
+func smix(B []uint32, r int, N uint64, p int, t uint32, flags uint32, V, S []uint32, password []byte) {
+	s := 32 * r
+
+	nChunk := N / uint64(p)
+	nLoopAll := nChunk
+	if t <= 1 {
+		if t != 0 {
+			nLoopAll *= 2
+		}
+		nLoopAll = (nLoopAll + 2) / 3
+	} else {
+		nLoopAll *= uint64(t - 1)
+	}
+	nLoopRW := nLoopAll / uint64(p)
+
+	nChunk &^= 1
+	nLoopAll = (nLoopAll + 1) &^ 1
+	nLoopRW = (nLoopRW + 1) &^ 1
+
+	XY := make([]uint32, 2*s)
+	ctxs := make([]*pwxformCtx, p)
+
+	vChunk := uint64(0)
+	for i := 0; i < p; i++ {
+		np := nChunk
+		if i == p-1 {
+			np = N - vChunk
+		}
+		Bp := B[s*i : s*(i+1)]
+		Vp := V[uint64(s)*vChunk:]
+
+		// the sboxes come from classic scrypt with r=1
+		Sp := S[sWords*i : sWords*(i+1)]
+		smix1(Bp[:32], 1, sBytes/128, flags&^yesRW, Sp, XY, nil)
+		ctxs[i] = &pwxformCtx{
+			S2: Sp[:2*sPairs],
+			S1: Sp[2*sPairs : 4*sPairs],
+			S0: Sp[4*sPairs:],
+		}
+		if i == 0 {
+			copy(password, hmacSha256(blockBytes(Bp[s-16:]), password))
+		}
+
+		smix1(Bp, r, np, flags, Vp, XY, ctxs[i])
+		smix2(Bp, r, p2floor(np), nLoopRW, flags, Vp, XY, ctxs[i])
+
+		vChunk += nChunk
+	}
+
+	for i := 0; i < p; i++ {
+		Bp := B[s*i : s*(i+1)]
+		smix2(Bp, r, N, nLoopAll-nLoopRW, flags&^yesRW, V, XY, ctxs[i])
+	}
+}
+
+func smix1(B []uint32, r int, N uint64, flags uint32, V, XY []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	X := XY[:s]
+	copy(X, B)
+
+	for i := uint64(0); i < N; i++ {
+		copy(V[i*uint64(s):], X)
+		if flags&yesRW != 0 && i > 1 {
+			j := wrap(integerify(X, r), i)
+			blockXor(X, V[j*uint64(s):(j+1)*uint64(s)])
+		}
+		if ctx != nil {
+			blockmixPwxform(X, r, ctx)
+		} else {
+			blockmixSalsa8(X, XY[s:2*s], r)
+		}
+	}
+
+	copy(B, X)
+}
+
+func smix2(B []uint32, r int, N, nLoop uint64, flags uint32, V, XY []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	X := XY[:s]
+	copy(X, B)
+
+	for i := uint64(0); i < nLoop; i++ {
+		j := integerify(X, r) & (N - 1)
+		Vj := V[j*uint64(s) : (j+1)*uint64(s)]
+		blockXor(X, Vj)
+		if flags&yesRW != 0 {
+			copy(Vj, X)
+		}
+		if ctx != nil {
+			blockmixPwxform(X, r, ctx)
+		} else {
+			blockmixSalsa8(X, XY[s:2*s], r)
+		}
+	}
+
+	copy(B, X)
+}
+
+func blockmixSalsa8(B, Y []uint32, r int) {
+	var X [16]uint32
+	copy(X[:], B[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		blockXor(X[:], B[i*16:(i+1)*16])
+		salsa20(X[:], 8)
+		copy(Y[i*16:], X[:])
+	}
+	for i := 0; i < r; i++ {
+		copy(B[i*16:(i+1)*16], Y[(2*i)*16:])
+		copy(B[(i+r)*16:(i+r+1)*16], Y[(2*i+1)*16:])
+	}
+}
+
+func blockmixPwxform(B []uint32, r int, ctx *pwxformCtx) {
+	r1 := 128 * r / pwxBytes
+
+	var X [pwxWords]uint32
+	copy(X[:], B[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			blockXor(X[:], B[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(X[:], ctx)
+		copy(B[i*pwxWords:], X[:])
+	}
+
+	i := (r1 - 1) * pwxBytes / 64
+	salsa20(B[i*16:(i+1)*16], 2)
+	for i++; i < 2*r; i++ {
+		blockXor(B[i*16:(i+1)*16], B[(i-1)*16:i*16])
+		salsa20(B[i*16:(i+1)*16], 2)
+	}
+}
+
+func pwxform(B []uint32, ctx *pwxformCtx) {
+	S0, S1, S2 := ctx.S0, ctx.S1, ctx.S2
+	w := ctx.w
+
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			Xj := B[j*2*pwxSimple : (j+1)*2*pwxSimple]
+			p0 := S0[(Xj[0]&sMask)/4:]
+			p1 := S1[(Xj[1]&sMask)/4:]
+
+			for k := 0; k < pwxSimple; k++ {
+				s0 := uint64(p0[2*k+1])<<32 | uint64(p0[2*k])
+				s1 := uint64(p1[2*k+1])<<32 | uint64(p1[2*k])
+
+				x := uint64(Xj[2*k+1]) * uint64(Xj[2*k])
+				x += s0
+				x ^= s1
+
+				Xj[2*k] = uint32(x)
+				Xj[2*k+1] = uint32(x >> 32)
+
+				if i != 0 && i != pwxRounds-1 {
+					S2[2*w] = uint32(x)
+					S2[2*w+1] = uint32(x >> 32)
+					w++
+				}
+			}
+		}
+	}
+
+	ctx.S0, ctx.S1, ctx.S2 = S2, S0, S1
+	ctx.w = w & (sPairs - 1)
+}
+
+func salsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = B[i]
+	}
+
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+
+	for i := 0; i < 16; i++ {
+		B[i] += x[i*5%16]
+	}
+}
+
+// the last block's first 64 bits, with the high word where the layout puts it
+func integerify(X []uint32, r int) uint64 {
+	last := X[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+func p2floor(x uint64) uint64 {
+	for y := x & (x - 1); y != 0; y = x & (x - 1) {
+		x = y
+	}
+	return x
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+func blockXor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// the block in the byte order the reference implementation keeps it
+func blockBytes(X []uint32) []byte {
+	out := make([]byte, 4*len(X))
+	for i := 0; i < len(X); i += 16 {
+		for k := 0; k < 16; k++ {
+			binary.LittleEndian.PutUint32(out[4*(i+k*5%16):], X[i+k])
+		}
+	}
+	return out
+}
+
+func hmacSha256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// yescrypt's variable length encoding of the parameters
+func decode64Uint32(src string, min uint32) (uint32, string, bool) {
+	if len(src) == 0 {
+		return 0, src, false
+	}
+	c := uint32(strings.IndexByte(itoa64, src[0]))
+	if c > 63 {
+		return 0, src, false
+	}
+	src = src[1:]
+
+	dst := min
+	start, end, chars, nbits := uint32(0), uint32(47), 1, uint32(0)
+	for c > end {
+		dst += (end + 1 - start) << nbits
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		nbits += 6
+	}
+	dst += (c - start) << nbits
+
+	for chars--; chars > 0; chars-- {
+		if len(src) == 0 {
+			return 0, src, false
+		}
+		c = uint32(strings.IndexByte(itoa64, src[0]))
+		if c > 63 {
+			return 0, src, false
+		}
+		src = src[1:]
+		nbits -= 6
+		dst += c << nbits
+	}
+	return dst, src, true
+}
+
+// the little endian base64 of the salt and hash
+func decode64(src string) ([]byte, bool) {
+	var out []byte
+	for len(src) > 0 {
+		var value, nbits uint32
+		for len(src) > 0 && nbits < 24 {
+			c := strings.IndexByte(itoa64, src[0])
+			if c < 0 {
+				return nil, false
+			}
+			src = src[1:]
+			value |= uint32(c) << nbits
+			nbits += 6
+		}
+		if nbits < 12 {
+			return nil, false
+		}
+		for ; nbits >= 8; nbits -= 8 {
+			out = append(out, byte(value))
+			value >>= 8
+		}
+		if value != 0 {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func encode64(src []byte) string {
+	var out strings.Builder
+	for i := 0; i < len(src); {
+		var value, nbits uint32
+		for nbits < 24 && i < len(src) {
+			value |= uint32(src[i]) << nbits
+			nbits += 8
+			i++
+		}
+		for n := uint32(0); n < nbits; n += 6 {
+			out.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	return out.String()
+}
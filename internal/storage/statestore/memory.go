@@ -0,0 +1,123 @@
+package statestore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+func NewMemory() StateStore {
+	ms := memoryStore{
+		buckets: make(map[string]map[string]*memoryEntry),
+	}
+	for _, bucket := range Buckets {
+		ms.buckets[bucket] = make(map[string]*memoryEntry)
+	}
+	return &ms
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryStore struct {
+	mutex   sync.Mutex
+	buckets map[string]map[string]*memoryEntry
+}
+
+func (ms *memoryStore) Put(bucket, key string, value []byte, expires time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries, err := ms.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	entries[key] = &memoryEntry{value: value, expires: expires}
+
+	return nil
+}
+
+func (ms *memoryStore) Get(bucket, key string) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries, err := ms.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entry := entries[key]
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil, ErrNotFound
+	}
+
+	return entry.value, nil
+}
+
+func (ms *memoryStore) Delete(bucket, key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries, err := ms.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	delete(entries, key)
+
+	return nil
+}
+
+func (ms *memoryStore) Update(bucket, key string, fn UpdateFunc) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries, err := ms.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	var current []byte
+	if entry := entries[key]; entry != nil && !time.Now().After(entry.expires) {
+		current = entry.value
+	}
+
+	value, expires, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(entries, key)
+		return nil
+	}
+	entries[key] = &memoryEntry{value: value, expires: expires}
+
+	return nil
+}
+
+func (ms *memoryStore) Sweep(now time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, entries := range ms.buckets {
+		for key, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
+
+func (ms *memoryStore) bucket(name string) (map[string]*memoryEntry, error) {
+	entries := ms.buckets[name]
+	if entries == nil {
+		return nil, fmt.Errorf("statestore: unknown bucket %s", name)
+	}
+	return entries, nil
+}
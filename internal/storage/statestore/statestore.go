@@ -0,0 +1,38 @@
+package statestore
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("statestore: not found")
+)
+
+// the buckets the server state is kept in
+const (
+	BucketCodes       = "codes"
+	BucketReferences  = "references"
+	BucketRevocations = "revocations"
+)
+
+var Buckets = []string{
+	BucketCodes,
+	BucketReferences,
+	BucketRevocations,
+}
+
+// the update function is passed the current value, or nil if there isn't one,
+// and returns the new value and its expiry, or a nil value to delete it
+type UpdateFunc func(value []byte) ([]byte, time.Time, error)
+
+// every entry has an expiry, after which it's no longer returned and is
+// eventually swept away
+type StateStore interface {
+	Put(bucket, key string, value []byte, expires time.Time) error
+	Get(bucket, key string) ([]byte, error)
+	Delete(bucket, key string) error
+	Update(bucket, key string, fn UpdateFunc) error
+	Sweep(now time.Time) error
+	Close() error
+}
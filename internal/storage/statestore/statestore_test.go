@@ -0,0 +1,18 @@
+package statestore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ss := statestore.NewMemory()
+	storetest.Run(t, ss, func(d time.Duration) {
+		require.NoError(t, ss.Sweep(time.Now().Add(d)))
+	})
+}
@@ -0,0 +1,103 @@
+package storetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+)
+
+// the behaviour every state store implementation has to have... elapse moves
+// the store on in time, sweeping it if it doesn't expire entries itself
+
+func Run(t *testing.T, ss statestore.StateStore, elapse func(d time.Duration)) {
+	now := time.Now()
+	bucket := statestore.BucketCodes
+
+	// values come back until they expire
+	err := ss.Put(bucket, "key1", []byte("value1"), now.Add(time.Hour))
+	require.NoError(t, err)
+	err = ss.Put(bucket, "key2", []byte{}, now.Add(time.Hour))
+	require.NoError(t, err)
+	err = ss.Put(bucket, "expired", []byte("value"), now.Add(-time.Second))
+	require.NoError(t, err)
+
+	value, err := ss.Get(bucket, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	value, err = ss.Get(bucket, "key2")
+	require.NoError(t, err)
+	require.Empty(t, value)
+
+	_, err = ss.Get(bucket, "expired")
+	require.ErrorIs(t, err, statestore.ErrNotFound)
+
+	// buckets are separate
+	_, err = ss.Get(statestore.BucketRevocations, "key1")
+	require.ErrorIs(t, err, statestore.ErrNotFound)
+
+	_, err = ss.Get("nosuchbucket", "key1")
+	require.Error(t, err)
+
+	// updates see the current value and can replace or delete it
+	err = ss.Update(bucket, "key1", func(value []byte) ([]byte, time.Time, error) {
+		require.Equal(t, []byte("value1"), value)
+		return []byte("updated"), now.Add(time.Hour), nil
+	})
+	require.NoError(t, err)
+	value, err = ss.Get(bucket, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+
+	err = ss.Update(bucket, "expired", func(value []byte) ([]byte, time.Time, error) {
+		require.Nil(t, value)
+		return nil, time.Time{}, nil
+	})
+	require.NoError(t, err)
+
+	// a failed update changes nothing
+	failed := errors.New("failed")
+	err = ss.Update(bucket, "key1", func(value []byte) ([]byte, time.Time, error) {
+		return []byte("not written"), now.Add(time.Hour), failed
+	})
+	require.ErrorIs(t, err, failed)
+	value, err = ss.Get(bucket, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+
+	err = ss.Update(bucket, "key1", func(value []byte) ([]byte, time.Time, error) {
+		return nil, time.Time{}, nil
+	})
+	require.NoError(t, err)
+	_, err = ss.Get(bucket, "key1")
+	require.ErrorIs(t, err, statestore.ErrNotFound)
+
+	// deleting
+	err = ss.Delete(bucket, "key2")
+	require.NoError(t, err)
+	_, err = ss.Get(bucket, "key2")
+	require.ErrorIs(t, err, statestore.ErrNotFound)
+
+	err = ss.Delete(bucket, "key2")
+	require.NoError(t, err)
+
+	// entries go when they expire
+	err = ss.Put(bucket, "short", []byte("value"), now.Add(time.Minute))
+	require.NoError(t, err)
+	err = ss.Put(bucket, "long", []byte("value"), now.Add(time.Hour))
+	require.NoError(t, err)
+
+	elapse(2 * time.Minute)
+
+	err = ss.Update(bucket, "short", func(value []byte) ([]byte, time.Time, error) {
+		require.Nil(t, value)
+		return nil, time.Time{}, nil
+	})
+	require.NoError(t, err)
+	_, err = ss.Get(bucket, "long")
+	require.NoError(t, err)
+}
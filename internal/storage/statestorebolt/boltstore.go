@@ -0,0 +1,162 @@
+package statestorebolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+)
+
+// each value is stored with its expiry as unix nanoseconds in front of it
+
+func New(path string) (statestore.StateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state db: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range statestore.Buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create state buckets: %w", err)
+	}
+
+	bs := boltStore{
+		db: db,
+	}
+	return &bs, nil
+}
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (bs *boltStore) Put(bucket, key string, value []byte, expires time.Time) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), encode(value, expires))
+	})
+}
+
+func (bs *boltStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		v, expires := decode(b.Get([]byte(key)))
+		if v == nil || time.Now().After(expires) {
+			return statestore.ErrNotFound
+		}
+
+		// the data is only valid during the transaction
+		value = append([]byte{}, v...)
+		return nil
+	})
+	return value, err
+}
+
+func (bs *boltStore) Delete(bucket, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (bs *boltStore) Update(bucket, key string, fn statestore.UpdateFunc) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+
+		current, expires := decode(b.Get([]byte(key)))
+		if current != nil && time.Now().After(expires) {
+			current = nil
+		}
+		if current != nil {
+			current = append([]byte{}, current...)
+		}
+
+		value, expires, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), encode(value, expires))
+	})
+}
+
+func (bs *boltStore) Sweep(now time.Time) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range statestore.Buckets {
+			b := tx.Bucket([]byte(bucket))
+
+			// collect the expired keys first, deleting while iterating skips entries
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if _, expires := decode(v); now.After(expires) {
+					expired = append(expired, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				err := b.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return bs.db.Close()
+}
+
+func getBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, fmt.Errorf("statestore: unknown bucket %s", name)
+	}
+	return b, nil
+}
+
+func encode(value []byte, expires time.Time) []byte {
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(expires.UnixNano()))
+	copy(data[8:], value)
+	return data
+}
+
+func decode(data []byte) ([]byte, time.Time) {
+	if len(data) < 8 {
+		return nil, time.Time{}
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	return data[8:], expires
+}
@@ -0,0 +1,35 @@
+package statestorebolt_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore/storetest"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestorebolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	ss, err := statestorebolt.New(path)
+	require.NoError(t, err)
+	storetest.Run(t, ss, func(d time.Duration) {
+		require.NoError(t, ss.Sweep(time.Now().Add(d)))
+	})
+
+	// the state survives a restart
+	err = ss.Put(statestore.BucketRevocations, "revoked", []byte{}, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, ss.Close())
+
+	ss, err = statestorebolt.New(path)
+	require.NoError(t, err)
+	defer ss.Close()
+
+	_, err = ss.Get(statestore.BucketRevocations, "revoked")
+	require.NoError(t, err)
+}
@@ -0,0 +1,149 @@
+package statestoreredis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+// the leader holds a lease that it renews well before it runs out
+const (
+	leaseTTL      = 15 * time.Second
+	leaseInterval = 5 * time.Second
+)
+
+// take the lease if it's free, or extend it if we already hold it
+var leaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+// give up the lease, if we still hold it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// the keys are held in a hash shared by all instances, one elected to manage them
+func NewKeyStorage(client *redis.Client, prefix string) keystore.Storage {
+	ks := keyStorage{
+		client: client,
+		keys:   prefix + ":keys",
+		lease:  prefix + ":keys:leader",
+		id:     uuid.New().String(),
+		done:   make(chan struct{}),
+	}
+
+	ks.renew()
+	go func() {
+		ticker := time.NewTicker(leaseInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ks.renew()
+			case <-ks.done:
+				return
+			}
+		}
+	}()
+
+	return &ks
+}
+
+type keyStorage struct {
+	client *redis.Client
+	keys   string
+	lease  string
+	id     string
+	done   chan struct{}
+
+	mutex   sync.Mutex
+	leading bool
+	until   time.Time
+}
+
+func (ks *keyStorage) Load() (map[string][]byte, error) {
+	values, err := ks.client.HGetAll(context.Background(), ks.keys).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for kid, data := range values {
+		keys[kid] = []byte(data)
+	}
+	return keys, nil
+}
+
+func (ks *keyStorage) Save(kid string, data []byte) error {
+	return ks.client.HSet(context.Background(), ks.keys, kid, data).Err()
+}
+
+func (ks *keyStorage) Delete(kid string) error {
+	return ks.client.HDel(context.Background(), ks.keys, kid).Err()
+}
+
+func (ks *keyStorage) IsLeader() bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// if the lease couldn't be renewed, someone else may have it by now
+	return ks.leading && time.Now().Before(ks.until)
+}
+
+// stops renewing the lease and releases it, so another instance can take over
+func (ks *keyStorage) Close() error {
+	close(ks.done)
+
+	ks.mutex.Lock()
+	ks.leading = false
+	ks.mutex.Unlock()
+
+	return releaseScript.Run(context.Background(), ks.client, []string{ks.lease}, ks.id).Err()
+}
+
+func (ks *keyStorage) renew() {
+	start := time.Now()
+	held, err := leaseScript.Run(context.Background(), ks.client, []string{ks.lease}, ks.id, leaseTTL.Milliseconds()).Bool()
+	if err != nil {
+		log.Errorf("keystore: failed to renew leader lease: %v", err)
+		return
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// a renewal racing the close doesn't count
+	select {
+	case <-ks.done:
+		return
+	default:
+	}
+
+	if held != ks.leading {
+		if held {
+			log.Infof("keystore: this instance is now the key leader")
+		} else {
+			log.Infof("keystore: this instance is no longer the key leader")
+		}
+	}
+	ks.leading = held
+	if held {
+		ks.until = start.Add(leaseTTL)
+	}
+}
@@ -0,0 +1,126 @@
+package statestoreredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+)
+
+// how many times an update is tried when another instance changes the value
+const updateRetries = 10
+
+func New(client *redis.Client, prefix string) statestore.StateStore {
+	rs := redisStore{
+		client: client,
+		prefix: prefix,
+	}
+	return &rs
+}
+
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (rs *redisStore) Put(bucket, key string, value []byte, expires time.Time) error {
+	rkey, err := rs.key(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// redis expires the entries itself
+	ttl := time.Until(expires)
+	if ttl < time.Millisecond {
+		return rs.client.Del(ctx, rkey).Err()
+	}
+	return rs.client.Set(ctx, rkey, value, ttl).Err()
+}
+
+func (rs *redisStore) Get(bucket, key string) ([]byte, error) {
+	rkey, err := rs.key(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := rs.client.Get(context.Background(), rkey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, statestore.ErrNotFound
+	}
+	return value, err
+}
+
+func (rs *redisStore) Delete(bucket, key string) error {
+	rkey, err := rs.key(bucket, key)
+	if err != nil {
+		return err
+	}
+	return rs.client.Del(context.Background(), rkey).Err()
+}
+
+func (rs *redisStore) Update(bucket, key string, fn statestore.UpdateFunc) error {
+	rkey, err := rs.key(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// watch the key so the write fails if anyone else changes it in between
+	update := func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, rkey).Bytes()
+		if errors.Is(err, redis.Nil) {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+
+		value, expires, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			ttl := time.Until(expires)
+			if value == nil || ttl < time.Millisecond {
+				pipe.Del(ctx, rkey)
+			} else {
+				pipe.Set(ctx, rkey, value, ttl)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < updateRetries; i++ {
+		err = rs.client.Watch(ctx, update, rkey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("statestore: too much contention updating %s", rkey)
+}
+
+func (rs *redisStore) Sweep(now time.Time) error {
+	// redis expires entries by itself
+	return nil
+}
+
+func (rs *redisStore) Close() error {
+	return rs.client.Close()
+}
+
+func (rs *redisStore) key(bucket, key string) (string, error) {
+	for _, b := range statestore.Buckets {
+		if b == bucket {
+			return rs.prefix + ":" + bucket + ":" + key, nil
+		}
+	}
+	return "", fmt.Errorf("statestore: unknown bucket %s", bucket)
+}
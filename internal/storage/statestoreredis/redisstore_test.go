@@ -0,0 +1,89 @@
+package statestoreredis_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore/storetest"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestoreredis"
+)
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	ss := statestoreredis.New(client, "idp")
+	storetest.Run(t, ss, mr.FastForward)
+
+	// everything is under the prefix, so one redis can hold more than one cluster
+	err := ss.Put(statestore.BucketCodes, "code", []byte("value"), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, mr.Exists("idp:codes:code"))
+
+	other := statestoreredis.New(client, "other")
+	_, err = other.Get(statestore.BucketCodes, "code")
+	require.ErrorIs(t, err, statestore.ErrNotFound)
+}
+
+func TestRedisKeyStorage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	// only one instance leads
+	ks1 := statestoreredis.NewKeyStorage(client, "idp")
+	ks2 := statestoreredis.NewKeyStorage(client, "idp")
+	require.True(t, ks1.(keystore.Leader).IsLeader())
+	require.False(t, ks2.(keystore.Leader).IsLeader())
+
+	// the keys are shared
+	err := ks1.Save("kid1", []byte("key data"))
+	require.NoError(t, err)
+
+	keys, err := ks2.Load()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"kid1": []byte("key data")}, keys)
+
+	err = ks2.Delete("kid1")
+	require.NoError(t, err)
+	keys, err = ks1.Load()
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// and they all work together
+	ks, err := keystore.New(ks1, nil, []string{"ES256"}, 0, 0, nil)
+	require.NoError(t, err)
+	kf, err := keystore.New(ks2, nil, []string{"ES256"}, 0, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, ks.GetPublicKeys(), kf.GetPublicKeys())
+
+	// losing the lease stops the leader...
+	mr.Set("idp:keys:leader", "someone-else")
+	require.Eventually(t, func() bool {
+		return !ks1.(keystore.Leader).IsLeader()
+	}, 10*time.Second, 100*time.Millisecond)
+	require.False(t, ks2.(keystore.Leader).IsLeader())
+
+	// ... and once it's free again, one instance takes it
+	mr.Del("idp:keys:leader")
+	require.Eventually(t, func() bool {
+		return ks1.(keystore.Leader).IsLeader() != ks2.(keystore.Leader).IsLeader()
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// closing the leader hands over to the other straight away
+	leader, follower := ks, ks2
+	if ks2.(keystore.Leader).IsLeader() {
+		leader, follower = kf, ks1
+	}
+	err = leader.Close()
+	require.NoError(t, err)
+	require.False(t, mr.Exists("idp:keys:leader"))
+	require.Eventually(t, func() bool {
+		return follower.(keystore.Leader).IsLeader()
+	}, 10*time.Second, 100*time.Millisecond)
+}
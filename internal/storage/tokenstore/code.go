@@ -0,0 +1,249 @@
+package tokenstore
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+)
+
+var (
+	ErrCodeNotFound = errors.New("tokenstore: code not found")
+	ErrCodeExpired  = errors.New("tokenstore: code has expired")
+	ErrCodeReplayed = errors.New("tokenstore: code has already been redeemed")
+	ErrCodeMismatch = errors.New("tokenstore: code was not issued for this request")
+)
+
+// the PKCE code challenge methods
+const (
+	ChallengePlain = "plain"
+	ChallengeS256  = "S256"
+)
+
+var ChallengeMethods = []string{ChallengeS256, ChallengePlain}
+
+// how often expired codes and tokens are cleaned out, and how long expired codes
+// are kept so a late redemption is reported as expired
+const (
+	janitorInterval = time.Minute
+	codeGrace       = 5 * time.Minute
+)
+
+// the code's grant, and once redeemed, the tokens issued from it... it's kept
+// until the later of the code and token expiry
+type codeData struct {
+	Grant    *TokenInfo           `json:"grant"`
+	Expires  time.Time            `json:"expires"`
+	Retain   time.Time            `json:"retain"`
+	Issued   map[string]time.Time `json:"issued,omitempty"`
+	Redeemed bool                 `json:"redeemed,omitempty"`
+}
+
+func (ts *tokenStore) Put(ti *TokenInfo) (string, error) {
+
+	code := uuid.New().String()
+
+	lifetime := ts.lifetimes.Code
+	if client := ts.cstore.Get(ti.ClientID); client != nil {
+		lifetime = client.Lifetimes.Code
+	}
+
+	// the grant is stored, the tokens aren't minted until it's redeemed... the
+	//   user's password has no business being in there
+	grant := *ti
+	if grant.User != nil {
+		user := *grant.User
+		user.Password = ""
+		grant.User = &user
+	}
+	if grant.CodeChallenge != "" && grant.CodeChallengeMethod == "" {
+		grant.CodeChallengeMethod = ChallengePlain
+	}
+
+	now := time.Now()
+	cd := codeData{
+		Grant:   &grant,
+		Expires: now.Add(lifetime),
+		Retain:  now.Add(lifetime + codeGrace),
+	}
+	data, err := json.Marshal(&cd)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode grant: %w", err)
+	}
+
+	err = ts.sstore.Put(statestore.BucketCodes, code, data, cd.Retain)
+	if err != nil {
+		return "", fmt.Errorf("failed to store grant: %w", err)
+	}
+
+	return code, nil
+}
+
+func (ts *tokenStore) Redeem(clientID, code, redirectURL, verifier string) (*TokenInfo, error) {
+
+	lifetime := ts.lifetimes.AccessToken
+	if client := ts.cstore.Get(clientID); client != nil {
+		lifetime = client.Lifetimes.AccessToken
+	}
+
+	var grant *TokenInfo
+	var failure error
+	var replayed map[string]time.Time
+
+	err := ts.sstore.Update(statestore.BucketCodes, code, func(value []byte) ([]byte, time.Time, error) {
+		if value == nil {
+			return nil, time.Time{}, ErrCodeNotFound
+		}
+		var cd codeData
+		err := json.Unmarshal(value, &cd)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to decode grant: %w", err)
+		}
+
+		if cd.Grant.ClientID != clientID {
+			return nil, time.Time{}, errors.New("tokenstore: incorrect client id provided")
+		}
+
+		// a second redemption means the code has leaked, so anything issued from
+		//   it can't be trusted either
+		if cd.Redeemed {
+			replayed = cd.Issued
+			return nil, time.Time{}, ErrCodeReplayed
+		}
+
+		// there's only one attempt at redeeming a code
+		now := time.Now()
+		if now.After(cd.Expires) {
+			failure = ErrCodeExpired
+			return nil, time.Time{}, nil
+		}
+		if cd.Grant.RedirectURL != redirectURL || !checkVerifier(cd.Grant.CodeChallenge, cd.Grant.CodeChallengeMethod, verifier) {
+			failure = ErrCodeMismatch
+			return nil, time.Time{}, nil
+		}
+
+		// the code is kept while its tokens are valid to catch any replay
+		cd.Redeemed = true
+		cd.Retain = now.Add(lifetime)
+		grant = cd.Grant
+
+		value, err = json.Marshal(&cd)
+		return value, cd.Retain, err
+	})
+	if errors.Is(err, ErrCodeReplayed) {
+		ts.revoke(replayed)
+		log.Warnf("tokenstore: code for client %s replayed, revoked its tokens", clientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if failure != nil {
+		return nil, failure
+	}
+
+	grant.GrantID = code
+
+	return grant, nil
+}
+
+func checkVerifier(challenge, method, verifier string) bool {
+	// without a challenge there must be no verifier, and with one there must be
+	if challenge == "" || verifier == "" {
+		return challenge == "" && verifier == ""
+	}
+	if !validVerifier(verifier) {
+		return false
+	}
+
+	if method == ChallengeS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(verifier)) == 1
+}
+
+// the verifier is 43 to 128 unreserved characters, RFC 7636 section 4.1
+func validVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (ts *tokenStore) recordIssued(grantID, atoken string, exp time.Time) error {
+	if grantID == "" {
+		return nil
+	}
+
+	return ts.sstore.Update(statestore.BucketCodes, grantID, func(value []byte) ([]byte, time.Time, error) {
+		if value == nil {
+			return nil, time.Time{}, nil
+		}
+		var cd codeData
+		err := json.Unmarshal(value, &cd)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to decode grant: %w", err)
+		}
+
+		if cd.Issued == nil {
+			cd.Issued = make(map[string]time.Time)
+		}
+		cd.Issued[referenceKey(atoken)] = exp
+		if exp.After(cd.Retain) {
+			cd.Retain = exp
+		}
+
+		value, err = json.Marshal(&cd)
+		return value, cd.Retain, err
+	})
+}
+
+func (ts *tokenStore) revoke(issued map[string]time.Time) {
+	for key, exp := range issued {
+		err := ts.sstore.Delete(statestore.BucketReferences, key)
+		if err == nil {
+			err = ts.sstore.Put(statestore.BucketRevocations, key, []byte{}, exp)
+		}
+		if err != nil {
+			log.Errorf("tokenstore: failed to revoke token: %v", err)
+		}
+	}
+}
+
+func (ts *tokenStore) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ts.sweep(now)
+		case <-ts.done:
+			return
+		}
+	}
+}
+
+func (ts *tokenStore) sweep(now time.Time) {
+	err := ts.sstore.Sweep(now)
+	if err != nil {
+		log.Errorf("tokenstore: failed to sweep expired state: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package tokenstore
+
+import (
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-jose/go-jose/v3"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
+)
+
+func (ts *tokenStore) UserInfoToken(clientID string, claims map[string]interface{}) (string, error) {
+
+	// the userinfo response is signed then, if requested, encrypted
+	uiclaims := make(jwt.MapClaims)
+	for k, v := range claims {
+		uiclaims[k] = v
+	}
+	uiclaims["iss"] = ts.issuer
+	uiclaims["aud"] = clientID
+
+	alg := ""
+	client := ts.cstore.Get(clientID)
+	if client != nil {
+		alg = client.UserInfoSignedAlg
+	}
+
+	ss, err := ts.sign(uiclaims, alg, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to sign userinfo token: %w", err)
+	}
+
+	if client == nil || client.UserInfoEncryption == nil {
+		return ss, nil
+	}
+
+	return encrypt(client.UserInfoEncryption, ss)
+}
+
+func encrypt(enc *clientstore.Encryption, signed string) (string, error) {
+
+	recipient := jose.Recipient{
+		Algorithm: jose.KeyAlgorithm(enc.Alg),
+		Key:       enc.Key,
+	}
+	opts := (&jose.EncrypterOptions{}).WithContentType("JWT")
+
+	encrypter, err := jose.NewEncrypter(jose.ContentEncryption(enc.Enc), recipient, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to create encrypter: %w", err)
+	}
+
+	jwe, err := encrypter.Encrypt([]byte(signed))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt token: %w", err)
+	}
+
+	return jwe.CompactSerialize()
+}
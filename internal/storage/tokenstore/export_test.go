@@ -0,0 +1,7 @@
+package tokenstore
+
+import "time"
+
+func Sweep(ts TokenStore, now time.Time) {
+	ts.(*tokenStore).sweep(now)
+}
@@ -0,0 +1,116 @@
+package tokenstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+)
+
+var (
+	ErrTokenInactive = errors.New("tokenstore: token is not active")
+)
+
+func (ts *tokenStore) opaqueAccessToken(ti *TokenInfo, audience string, now, exp time.Time) (string, error) {
+
+	claims, err := ts.jwtAccessClaims(ti, audience, now, exp)
+	if err != nil {
+		return "", err
+	}
+
+	// the token is just a random reference to the claims
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to create access token: %w", err)
+	}
+	reference := base64.RawURLEncoding.EncodeToString(b)
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode access token claims: %w", err)
+	}
+	err = ts.sstore.Put(statestore.BucketReferences, referenceKey(reference), data, exp)
+	if err != nil {
+		return "", fmt.Errorf("failed to store access token: %w", err)
+	}
+
+	return reference, nil
+}
+
+func (ts *tokenStore) Lookup(accessToken string) (map[string]interface{}, error) {
+
+	// revoked tokens are inactive whatever they are
+	key := referenceKey(accessToken)
+
+	_, err := ts.sstore.Get(statestore.BucketRevocations, key)
+	if err == nil {
+		return nil, ErrTokenInactive
+	}
+	if !errors.Is(err, statestore.ErrNotFound) {
+		return nil, fmt.Errorf("failed to check revocations: %w", err)
+	}
+
+	// check for an opaque token next, it's the cheapest lookup
+	data, err := ts.sstore.Get(statestore.BucketReferences, key)
+	if err == nil {
+		var claims map[string]interface{}
+		err = json.Unmarshal(data, &claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode access token claims: %w", err)
+		}
+		return claims, nil
+	}
+	if !errors.Is(err, statestore.ErrNotFound) {
+		return nil, fmt.Errorf("failed to look up access token: %w", err)
+	}
+
+	// otherwise it has to be one of our signed access tokens
+	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := ts.kstore.GetPublicKeys()[kid]
+		if key == nil {
+			return nil, fmt.Errorf("unknown key id: %s", kid)
+		}
+		if token.Method.Alg() != key.Alg {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.Key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInactive, err)
+	}
+
+	// id tokens and userinfo responses are signed with the same keys, so
+	//   only what's marked as an access token is accepted
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["iss"] != ts.issuer || !isAccessToken(token) {
+		return nil, ErrTokenInactive
+	}
+
+	return claims, nil
+}
+
+// rfc9068 access tokens have their own type, legacy ones say what they're for
+func isAccessToken(token *jwt.Token) bool {
+	typ, _ := token.Header["typ"].(string)
+	typ = strings.TrimPrefix(strings.ToLower(typ), "application/")
+	if typ == "at+jwt" {
+		return true
+	}
+	return token.Claims.(jwt.MapClaims)["token_use"] == "access"
+}
+
+func referenceKey(reference string) string {
+	// store the hash so the store never holds usable bearer tokens
+	sum := sha256.Sum256([]byte(reference))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
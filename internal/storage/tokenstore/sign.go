@@ -0,0 +1,112 @@
+package tokenstore
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+)
+
+func (ts *tokenStore) sign(claims jwt.MapClaims, alg, typ string) (string, error) {
+
+	if alg == "" {
+		alg = ts.alg
+	}
+	kid, signer, err := ts.kstore.GetSigningKey(alg)
+	if err != nil {
+		return "", err
+	}
+	if typ == "" {
+		typ = "JWT"
+	}
+
+	// the signing is done through the crypto.Signer so the key never needs
+	//   to be held here
+	token := jwt.Token{
+		Header: map[string]interface{}{
+			"typ": typ,
+			"alg": alg,
+			"kid": kid,
+		},
+		Claims: claims,
+	}
+
+	input, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+	sig, err := keystore.Sign(signer, alg, []byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + jwt.EncodeSegment(sig), nil
+}
+
+func accessTokenHash(alg, atoken string) (string, error) {
+
+	// the left half of the hash used by the signing algorithm
+	var h hash.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h = sha256.New()
+	case "ES384":
+		h = sha512.New384()
+	case "EdDSA":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	h.Write([]byte(atoken))
+	sum := h.Sum(nil)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+// jwt-go doesn't know about EdDSA, so register it for verification
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod("EdDSA", func() jwt.SigningMethod {
+		return &signingMethodEdDSA{}
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	sig, err := keystore.Sign(priv, "EdDSA", []byte(signingString))
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(sig), nil
+}
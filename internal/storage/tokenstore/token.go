@@ -1,9 +1,9 @@
 package tokenstore
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +11,7 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
 
+	"github.com/parlaynu/studio1767-idp/internal/config"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
@@ -22,15 +23,70 @@ type TokenInfo struct {
 	State        string
 	Nonce        string
 	ResponseType string
+	AuthTime     time.Time
+	AuthMethod   string
+
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// set when the grant has been redeemed, to track the tokens issued from it
+	GrantID string
+}
+
+// the scopes tokens are issued for
+var Scopes = []string{"openid", "profile", "email"}
+
+// the claims put in id tokens
+var IdTokenClaims = []string{
+	"token_use",
+	"event_id",
+	"iss",
+	"sub",
+	"aud",
+	"exp",
+	"iat",
+	"nonce",
+	"at_hash",
+	"given_name",
+	"family_name",
+	"username",
+	"email",
+	"email_verified",
+	"groups",
+}
+
+// the identity claims that can be released from an access token
+var UserClaims = []string{
+	"sub",
+	"name",
+	"given_name",
+	"family_name",
+	"preferred_username",
+	"username",
+	"email",
+	"email_verified",
+	"groups",
 }
 
+// the authentication methods, emitted in the amr claim
+const (
+	AuthMethodPassword = "pwd"
+	AuthMethodMtls     = "mtls"
+)
+
 func (ts *tokenStore) NewToken(ti *TokenInfo) (Token, error) {
 
+	// use the client's settings if it has them
+	profile, lifetimes, idAlg, audience := ts.profile, ts.lifetimes, ts.alg, ts.audience
+	client := ts.cstore.Get(ti.ClientID)
+	if client != nil {
+		profile, lifetimes, idAlg, audience = client.AccessTokenProfile, client.Lifetimes, client.IdTokenSignedAlg, client.Audience
+	}
+
 	// get the times
 	now := time.Now()
-	duration := time.Hour * 24
-	exp := now.Add(duration)
-	now = now.Add(time.Second * -5)
+	atExp := now.Add(lifetimes.AccessToken)
+	idExp := now.Add(lifetimes.IdToken)
 
 	// an event id
 	event_id := uuid.New().String()
@@ -38,10 +94,10 @@ func (ts *tokenStore) NewToken(ti *TokenInfo) (Token, error) {
 	// the oatoken
 	token := make(Token)
 	token["token_type"] = "Bearer"
-	token["expires_in"] = strconv.Itoa(int(duration.Seconds()) - 1)
+	token["expires_in"] = strconv.Itoa(int(lifetimes.AccessToken.Seconds()))
 
 	// create the access token
-	atoken, err := ts.accessToken(ti, now, exp, event_id)
+	atoken, err := ts.accessToken(ti, profile, audience, now, atExp, event_id)
 	if err != nil {
 		return nil, err
 	}
@@ -49,23 +105,46 @@ func (ts *tokenStore) NewToken(ti *TokenInfo) (Token, error) {
 
 	// create the idtoken
 	if ti.Scopes["openid"] {
-		idtoken, err := ts.openidToken(ti, now, exp, event_id, atoken)
+		idtoken, err := ts.openidToken(ti, idAlg, now, idExp, event_id, atoken)
 		if err != nil {
 			return nil, err
 		}
 
+		// nest the signed token inside an encrypted one if the client asked for it
+		if client != nil && client.IdTokenEncryption != nil {
+			idtoken, err = encrypt(client.IdTokenEncryption, idtoken)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		token["id_token"] = idtoken
 	}
 
+	err = ts.recordIssued(ti.GrantID, atoken, atExp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record issued token: %w", err)
+	}
+
 	return token, nil
 }
 
-func (ts *tokenStore) accessToken(ti *TokenInfo, now, exp time.Time, event_id string) (string, error) {
+func (ts *tokenStore) accessToken(ti *TokenInfo, profile, audience string, now, exp time.Time, event_id string) (string, error) {
+
+	switch profile {
+	case config.ProfileRFC9068:
+		return ts.jwtAccessToken(ti, audience, now, exp)
+	case config.ProfileOpaque:
+		return ts.opaqueAccessToken(ti, audience, now, exp)
+	}
 
 	// create the claims
 	claims := make(jwt.MapClaims)
 
-	subject := base64.RawURLEncoding.EncodeToString([]byte(ti.User.Email))
+	subject, err := ts.subjectFor(ti.User)
+	if err != nil {
+		return "", err
+	}
 
 	claims["token_use"] = "access"
 	claims["event_id"] = event_id
@@ -75,11 +154,7 @@ func (ts *tokenStore) accessToken(ti *TokenInfo, now, exp time.Time, event_id st
 	claims["exp"] = exp.Unix()
 	claims["iat"] = now.Unix()
 
-	scopes := make([]string, 0, len(ti.Scopes))
-	for scope := range ti.Scopes {
-		scopes = append(scopes, scope)
-	}
-	claims["scope"] = strings.Join(scopes, " ")
+	claims["scope"] = scopeString(ti.Scopes)
 
 	if ti.Scopes["profile"] {
 		claims["name"] = ti.User.FullName
@@ -94,12 +169,22 @@ func (ts *tokenStore) accessToken(ti *TokenInfo, now, exp time.Time, event_id st
 		claims["email_verified"] = true
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	ss, err := ts.sign(claims, "", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to sign access token: %w", err)
+	}
+
+	return ss, nil
+}
+
+func (ts *tokenStore) jwtAccessToken(ti *TokenInfo, audience string, now, exp time.Time) (string, error) {
 
-	kid, key := ts.kstore.GetPrivateKey()
-	token.Header["kid"] = kid
+	claims, err := ts.jwtAccessClaims(ti, audience, now, exp)
+	if err != nil {
+		return "", err
+	}
 
-	ss, err := token.SignedString(key)
+	ss, err := ts.sign(claims, "", "at+jwt")
 	if err != nil {
 		return "", fmt.Errorf("failed to sign access token: %w", err)
 	}
@@ -107,11 +192,61 @@ func (ts *tokenStore) accessToken(ti *TokenInfo, now, exp time.Time, event_id st
 	return ss, nil
 }
 
-func (ts *tokenStore) openidToken(ti *TokenInfo, now, exp time.Time, event_id, atoken string) (string, error) {
+func (ts *tokenStore) jwtAccessClaims(ti *TokenInfo, audience string, now, exp time.Time) (jwt.MapClaims, error) {
+
+	// create the claims as per RFC 9068
+	claims := make(jwt.MapClaims)
+
+	subject, err := ts.subjectFor(ti.User)
+	if err != nil {
+		return nil, err
+	}
+
+	claims["iss"] = ts.issuer
+	claims["sub"] = subject
+	// the token is for the resource servers, not the client
+	claims["aud"] = audience
+	claims["client_id"] = ti.ClientID
+	claims["exp"] = exp.Unix()
+	claims["iat"] = now.Unix()
+	claims["jti"] = uuid.New().String()
+	claims["scope"] = scopeString(ti.Scopes)
+
+	if !ti.AuthTime.IsZero() {
+		claims["auth_time"] = ti.AuthTime.Unix()
+	}
+	if ti.AuthMethod != "" {
+		claims["amr"] = []string{ti.AuthMethod}
+	}
+
+	// groups are authorization attributes so are always included
+	if len(ti.User.Groups) > 0 {
+		claims["groups"] = ti.User.Groups
+	}
+
+	if ti.Scopes["profile"] {
+		claims["name"] = ti.User.FullName
+		claims["given_name"] = ti.User.GivenName
+		claims["family_name"] = ti.User.FamilyName
+		claims["preferred_username"] = ti.User.Name
+	}
+
+	if ti.Scopes["email"] {
+		claims["email"] = ti.User.Email
+		claims["email_verified"] = true
+	}
+
+	return claims, nil
+}
+
+func (ts *tokenStore) openidToken(ti *TokenInfo, alg string, now, exp time.Time, event_id, atoken string) (string, error) {
 	// create the claims
 	claims := make(jwt.MapClaims)
 
-	subject := base64.RawURLEncoding.EncodeToString([]byte(ti.User.Email))
+	subject, err := ts.subjectFor(ti.User)
+	if err != nil {
+		return "", err
+	}
 
 	claims["token_use"] = "id"
 	claims["event_id"] = event_id
@@ -125,8 +260,11 @@ func (ts *tokenStore) openidToken(ti *TokenInfo, now, exp time.Time, event_id, a
 		claims["nonce"] = ti.Nonce
 	}
 
-	athash := sha256.Sum256([]byte(atoken))
-	claims["at_hash"] = base64.RawURLEncoding.EncodeToString(athash[:16])
+	athash, err := accessTokenHash(alg, atoken)
+	if err != nil {
+		return "", err
+	}
+	claims["at_hash"] = athash
 
 	claims["given_name"] = ti.User.GivenName
 	claims["family_name"] = ti.User.FamilyName
@@ -136,15 +274,38 @@ func (ts *tokenStore) openidToken(ti *TokenInfo, now, exp time.Time, event_id, a
 
 	claims["groups"] = ti.User.Groups
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-
-	kid, key := ts.kstore.GetPrivateKey()
-	token.Header["kid"] = kid
-
-	ss, err := token.SignedString(key)
+	ss, err := ts.sign(claims, alg, "")
 	if err != nil {
 		return "", fmt.Errorf("failed to sign openid token: %w", err)
 	}
 
 	return ss, nil
 }
+
+func (ts *tokenStore) subjectFor(user *userdb.User) (string, error) {
+	// the subject must never change for a user, so only fall back to the
+	//   email address when running in the legacy compatibility mode
+	switch ts.subject {
+	case config.SubjectId:
+		if user.Id == "" {
+			return "", fmt.Errorf("tokenstore: no id for user %s", user.Name)
+		}
+		return user.Id, nil
+	case config.SubjectUid:
+		if user.UidNumber <= 0 {
+			return "", fmt.Errorf("tokenstore: no uid number for user %s", user.Name)
+		}
+		return strconv.Itoa(user.UidNumber), nil
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(user.Email)), nil
+}
+
+func scopeString(scopes map[string]bool) string {
+	names := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		names = append(names, scope)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
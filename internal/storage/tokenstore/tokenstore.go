@@ -1,82 +1,60 @@
 package tokenstore
 
 import (
-	"errors"
-	"sync"
-	"time"
-
-	"github.com/google/uuid"
-
+	"github.com/parlaynu/studio1767-idp/internal/config"
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
 )
 
 type Token map[string]string
 
 type TokenStore interface {
-	Put(clientID string, tk Token) string
-	Get(clientID string, code string) (Token, error)
+	Put(ti *TokenInfo) (string, error)
+	Redeem(clientID, code, redirectURL, verifier string) (*TokenInfo, error)
 
 	NewToken(ti *TokenInfo) (Token, error)
+	Lookup(accessToken string) (map[string]interface{}, error)
+	UserInfoToken(clientID string, claims map[string]interface{}) (string, error)
+
+	Close() error
 }
 
-func New(issuerURL string, ks keystore.KeyStore) TokenStore {
+func New(cfg *config.Config, cs clientstore.ClientStore, ks keystore.KeyStore, ss statestore.StateStore) TokenStore {
 
 	// create the structure
 	ts := tokenStore{
-		issuer: issuerURL,
-		tokens: make(map[string]*storeData),
-		kstore: ks,
+		issuer:    cfg.IssuerURL,
+		subject:   cfg.Tokens.Subject,
+		profile:   cfg.Tokens.AccessTokenProfile,
+		audience:  cfg.Tokens.DefaultAudience(cfg.IssuerURL),
+		lifetimes: cfg.Tokens.Lifetimes.Inherit(config.DefaultLifetimes),
+		alg:       cfg.Keys.DefaultAlg(),
+		cstore:    cs,
+		kstore:    ks,
+		sstore:    ss,
+		done:      make(chan struct{}),
 	}
 
-	return &ts
-}
+	go ts.janitor()
 
-type storeData struct {
-	stamp    time.Time
-	clientID string
-	token    Token
+	return &ts
 }
 
 type tokenStore struct {
-	mutex  sync.Mutex
-	issuer string
-	tokens map[string]*storeData
-	kstore keystore.KeyStore
+	issuer    string
+	subject   string
+	profile   string
+	audience  string
+	lifetimes config.Lifetimes
+	alg       string
+	cstore    clientstore.ClientStore
+	kstore    keystore.KeyStore
+	sstore    statestore.StateStore
+	done      chan struct{}
 }
 
-func (ts *tokenStore) Put(clientID string, tk Token) string {
-
-	code := uuid.New().String()
-
-	td := storeData{
-		stamp:    time.Now(),
-		clientID: clientID,
-		token:    tk,
-	}
-
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-
-	ts.tokens[code] = &td
-
-	return code
-}
-
-func (ts *tokenStore) Get(cliendID, code string) (Token, error) {
-
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-
-	td := ts.tokens[code]
-	if td == nil {
-		return nil, errors.New("tokenstore: token not found")
-	}
-
-	if td.clientID != cliendID {
-		return nil, errors.New("tokenstore: incorrect client id provided")
-	}
-
-	delete(ts.tokens, code)
-
-	return td.token, nil
+func (ts *tokenStore) Close() error {
+	close(ts.done)
+	return nil
 }
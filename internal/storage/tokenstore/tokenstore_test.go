@@ -1,20 +1,38 @@
 package tokenstore_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-jose/go-jose/v3"
 	"github.com/stretchr/testify/require"
 
+	"github.com/parlaynu/studio1767-idp/internal/config"
+	"github.com/parlaynu/studio1767-idp/internal/storage/clientstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/keystore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestore"
+	"github.com/parlaynu/studio1767-idp/internal/storage/statestorebolt"
 	"github.com/parlaynu/studio1767-idp/internal/storage/tokenstore"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
 func TestTokenStore(t *testing.T) {
-	ks, err := keystore.New(5)
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
 	require.NoError(t, err)
 
-	ts := tokenstore.New("https://issuer.example,com", ks)
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example,com",
+	}
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
 
 	type TokenInfo struct {
 		User         *userdb.User
@@ -27,9 +45,9 @@ func TestTokenStore(t *testing.T) {
 	}
 
 	user := userdb.User{
-		UserId:     1001,
-		GroupId:    1001,
-		UserName:   "tokenuser",
+		UidNumber:  1001,
+		GidNumber:  1001,
+		Name:       "tokenuser",
 		Password:   "tokenpass",
 		FullName:   "token user",
 		GivenName:  "token",
@@ -53,11 +71,560 @@ func TestTokenStore(t *testing.T) {
 		ResponseType: "code",
 	}
 
+	// the grant is stored against the code, and the tokens minted from it
+	code, err := ts.Put(&ti)
+	require.NoError(t, err)
+	grant, err := ts.Redeem(ti.ClientID, code, ti.RedirectURL, "")
+	require.NoError(t, err)
+	require.Equal(t, code, grant.GrantID)
+
+	// everything but the password is kept
+	require.Empty(t, grant.User.Password)
+	grant.User.Password = user.Password
+	require.Equal(t, user, *grant.User)
+	require.Equal(t, ti.Scopes, grant.Scopes)
+	require.Equal(t, ti.Nonce, grant.Nonce)
+
+	token, err := ts.NewToken(&ti)
+	require.NoError(t, err)
+	require.NotEmpty(t, token["access_token"])
+	require.NotEmpty(t, token["id_token"])
+}
+
+func TestTokenSubject(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	user := userdb.User{
+		Id:        "3f1c6d2e-8a4b-4c1e-9d7a-0b5e2f6a9c13",
+		UidNumber: 1001,
+		Name:      "tokenuser",
+		Email:     "token@example.com",
+	}
+
+	tests := []struct {
+		source  string
+		subject string
+	}{
+		{config.SubjectLegacy, base64.RawURLEncoding.EncodeToString([]byte(user.Email))},
+		{config.SubjectId, user.Id},
+		{config.SubjectUid, "1001"},
+	}
+
+	for _, test := range tests {
+		cfg := config.Config{
+			IssuerURL: "https://issuer.example.com",
+		}
+		cfg.Tokens.Subject = test.source
+		ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+		ti := tokenstore.TokenInfo{
+			User:     &user,
+			ClientID: "clientid",
+			Scopes:   map[string]bool{"openid": true},
+		}
+		token, err := ts.NewToken(&ti)
+		require.NoError(t, err)
+
+		for _, name := range []string{"access_token", "id_token"} {
+			claims := parseClaims(t, ks, token[name])
+			require.Equal(t, test.subject, claims["sub"])
+		}
+	}
+
+	// a missing id must not silently fall back to another value
+	cfg := config.Config{}
+	cfg.Tokens.Subject = config.SubjectId
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user.Id = ""
+	ti := tokenstore.TokenInfo{
+		User:   &user,
+		Scopes: map[string]bool{"openid": true},
+	}
+	_, err = ts.NewToken(&ti)
+	require.Error(t, err)
+
+	// and neither must a missing uid, which is 0
+	cfg.Tokens.Subject = config.SubjectUid
+	ts = tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user.UidNumber = 0
+	_, err = ts.NewToken(&ti)
+	require.Error(t, err)
+}
+
+func parseClaims(t *testing.T, ks keystore.KeyStore, raw string) jwt.MapClaims {
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return ks.GetPublicKeys()[kid].Key, nil
+	})
+	require.NoError(t, err)
+
+	return token.Claims.(jwt.MapClaims)
+}
+
+func TestAccessTokenProfile(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Clients: []*config.ClientConfig{
+			{Id: "legacy"},
+			{Id: "rfc9068", AccessTokenProfile: config.ProfileRFC9068},
+			{Id: "resource", AccessTokenProfile: config.ProfileRFC9068, Audience: "https://api.example.com"},
+		},
+	}
+	cfg.Tokens.AccessTokenProfile = config.ProfileLegacy
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:   "tokenuser",
+		Email:  "token@example.com",
+		Groups: []string{"tokengroup1"},
+	}
+	authTime := time.Now().Add(-time.Minute)
+
+	// the legacy client keeps the original claims
+	ti := tokenstore.TokenInfo{
+		User:       &user,
+		ClientID:   "legacy",
+		Scopes:     map[string]bool{"openid": true},
+		AuthTime:   authTime,
+		AuthMethod: tokenstore.AuthMethodPassword,
+	}
+	token, err := ts.NewToken(&ti)
+	require.NoError(t, err)
+
+	claims := parseClaims(t, ks, token["access_token"])
+	require.Equal(t, "access", claims["token_use"])
+	require.Nil(t, claims["client_id"])
+
+	// the rfc9068 client gets the standard claims and header
+	ti.ClientID = "rfc9068"
+	ti.Scopes = map[string]bool{"openid": true, "email": true}
+	token, err = ts.NewToken(&ti)
+	require.NoError(t, err)
+
+	raw := token["access_token"]
+	claims = parseClaims(t, ks, raw)
+	require.Nil(t, claims["token_use"])
+	require.Nil(t, claims["event_id"])
+	require.Equal(t, "rfc9068", claims["client_id"])
+	require.Equal(t, "https://issuer.example.com", claims["aud"])
+	require.Equal(t, "email openid", claims["scope"])
+	require.Equal(t, float64(authTime.Unix()), claims["auth_time"])
+	require.Equal(t, []interface{}{tokenstore.AuthMethodPassword}, claims["amr"])
+	require.Nil(t, claims["acr"])
+	require.Equal(t, []interface{}{"tokengroup1"}, claims["groups"])
+	require.NotEmpty(t, claims["jti"])
+
+	parsed, _, err := new(jwt.Parser).ParseUnverified(raw, jwt.MapClaims{})
+	require.NoError(t, err)
+	require.Equal(t, "at+jwt", parsed.Header["typ"])
+
+	// a configured audience names the resource servers
+	ti.ClientID = "resource"
+	token, err = ts.NewToken(&ti)
+	require.NoError(t, err)
+	claims = parseClaims(t, ks, token["access_token"])
+	require.Equal(t, "resource", claims["client_id"])
+	require.Equal(t, "https://api.example.com", claims["aud"])
+}
+
+func TestOpaqueAccessToken(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Clients: []*config.ClientConfig{
+			{Id: "opaque", AccessTokenProfile: config.ProfileOpaque},
+			{Id: "jwt", AccessTokenProfile: config.ProfileRFC9068},
+			{Id: "legacy", AccessTokenProfile: config.ProfileLegacy},
+		},
+	}
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:   "tokenuser",
+		Email:  "token@example.com",
+		Groups: []string{"tokengroup1"},
+	}
+	ti := tokenstore.TokenInfo{
+		User:     &user,
+		ClientID: "opaque",
+		Scopes:   map[string]bool{"openid": true, "email": true},
+	}
+
+	// the opaque token carries nothing, but resolves to the claims
+	token, err := ts.NewToken(&ti)
+	require.NoError(t, err)
+
+	_, _, err = new(jwt.Parser).ParseUnverified(token["access_token"], jwt.MapClaims{})
+	require.Error(t, err)
+
+	claims, err := ts.Lookup(token["access_token"])
+	require.NoError(t, err)
+	require.Equal(t, "opaque", claims["client_id"])
+	require.Equal(t, user.Email, claims["email"])
+
+	// signed access tokens resolve too, but id tokens and userinfo responses,
+	//   signed with the same keys, do not
+	ti.ClientID = "jwt"
+	token, err = ts.NewToken(&ti)
+	require.NoError(t, err)
+
+	claims, err = ts.Lookup(token["access_token"])
+	require.NoError(t, err)
+	require.Equal(t, "jwt", claims["client_id"])
+
+	_, err = ts.Lookup(token["id_token"])
+	require.ErrorIs(t, err, tokenstore.ErrTokenInactive)
+
+	userinfo, err := ts.UserInfoToken("jwt", map[string]interface{}{"sub": "tokenuser"})
+	require.NoError(t, err)
+	_, err = ts.Lookup(userinfo)
+	require.ErrorIs(t, err, tokenstore.ErrTokenInactive)
+
+	// and nor are the legacy profile's id tokens
+	ti.ClientID = "legacy"
+	token, err = ts.NewToken(&ti)
+	require.NoError(t, err)
+
+	_, err = ts.Lookup(token["access_token"])
+	require.NoError(t, err)
+	_, err = ts.Lookup(token["id_token"])
+	require.ErrorIs(t, err, tokenstore.ErrTokenInactive)
+
+	_, err = ts.Lookup("not-a-token")
+	require.ErrorIs(t, err, tokenstore.ErrTokenInactive)
+}
+
+func TestTokenLifetimes(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Clients: []*config.ClientConfig{
+			{
+				Id: "client",
+				Lifetimes: config.Lifetimes{
+					AccessToken: 5 * time.Minute,
+					Code:        time.Millisecond,
+				},
+			},
+		},
+	}
+	cfg.Tokens.Lifetimes.IdToken = time.Hour
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:  "tokenuser",
+		Email: "token@example.com",
+	}
+	ti := tokenstore.TokenInfo{
+		User:     &user,
+		ClientID: "client",
+		Scopes:   map[string]bool{"openid": true},
+	}
+
+	// the access token comes from the client, the id token from the global settings
 	token, err := ts.NewToken(&ti)
 	require.NoError(t, err)
+	require.Equal(t, "300", token["expires_in"])
+
+	claims := parseClaims(t, ks, token["access_token"])
+	require.Equal(t, float64(300), claims["exp"].(float64)-claims["iat"].(float64))
+
+	claims = parseClaims(t, ks, token["id_token"])
+	require.Equal(t, float64(3600), claims["exp"].(float64)-claims["iat"].(float64))
+
+	// the code is only valid for a short time
+	code, err := ts.Put(&ti)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = ts.Redeem(ti.ClientID, code, ti.RedirectURL, "")
+	require.ErrorIs(t, err, tokenstore.ErrCodeExpired)
+}
+
+func TestEncryptedIdToken(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Clients: []*config.ClientConfig{
+			{
+				Id:                   "rsa",
+				EncryptionKey:        rsaKey.Public(),
+				IdTokenEncryptedAlg:  "RSA-OAEP",
+				IdTokenEncryptedEnc:  "A256GCM",
+				UserInfoEncryptedAlg: "RSA-OAEP-256",
+				UserInfoEncryptedEnc: "A128CBC-HS256",
+			},
+			{
+				Id:                  "ec",
+				EncryptionKey:       ecKey.Public(),
+				IdTokenEncryptedAlg: "ECDH-ES",
+				IdTokenEncryptedEnc: "A256GCM",
+			},
+		},
+	}
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:  "tokenuser",
+		Email: "token@example.com",
+	}
+
+	tests := []struct {
+		clientID string
+		key      interface{}
+	}{
+		{"rsa", rsaKey},
+		{"ec", ecKey},
+	}
+
+	for _, test := range tests {
+		ti := tokenstore.TokenInfo{
+			User:     &user,
+			ClientID: test.clientID,
+			Scopes:   map[string]bool{"openid": true},
+		}
+		token, err := ts.NewToken(&ti)
+		require.NoError(t, err)
+
+		// decrypt the outer token, the inner one is the signed id token
+		jwe, err := jose.ParseEncrypted(token["id_token"])
+		require.NoError(t, err)
+		require.Equal(t, "JWT", jwe.Header.ExtraHeaders[jose.HeaderContentType])
+
+		inner, err := jwe.Decrypt(test.key)
+		require.NoError(t, err)
+
+		claims := parseClaims(t, ks, string(inner))
+		require.Equal(t, test.clientID, claims["aud"])
+	}
+
+	// userinfo responses are nested the same way
+	raw, err := ts.UserInfoToken("rsa", map[string]interface{}{"sub": "tokenuser"})
+	require.NoError(t, err)
+
+	jwe, err := jose.ParseEncrypted(raw)
+	require.NoError(t, err)
+	inner, err := jwe.Decrypt(rsaKey)
+	require.NoError(t, err)
+
+	claims := parseClaims(t, ks, string(inner))
+	require.Equal(t, "tokenuser", claims["sub"])
+	require.Equal(t, "rsa", claims["aud"])
+}
+
+func TestIdTokenSigningAlg(t *testing.T) {
+	algs := []string{"ES256", "RS256", "PS256", "ES384", "EdDSA"}
+	ks, err := keystore.New(nil, nil, algs, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Keys:      config.Keys{Algorithms: algs},
+		Tokens:    config.Tokens{AccessTokenProfile: config.ProfileRFC9068},
+	}
+	for _, alg := range algs {
+		cfg.Clients = append(cfg.Clients, &config.ClientConfig{Id: alg, IdTokenSignedAlg: alg})
+	}
+	cfg.Clients = append(cfg.Clients, &config.ClientConfig{Id: "default"})
+	cfg.Clients = append(cfg.Clients, &config.ClientConfig{Id: "userinfo", IdTokenSignedAlg: "RS256", UserInfoSignedAlg: "EdDSA"})
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:  "tokenuser",
+		Email: "token@example.com",
+	}
+
+	for _, client := range cfg.Clients {
+		ti := tokenstore.TokenInfo{
+			User:     &user,
+			ClientID: client.Id,
+			Scopes:   map[string]bool{"openid": true},
+		}
+		token, err := ts.NewToken(&ti)
+		require.NoError(t, err)
+
+		// the id token uses the client's algorithm, the first configured if it
+		//   didn't register one
+		want := client.IdTokenSignedAlg
+		if want == "" {
+			want = algs[0]
+		}
+		idtoken, err := jwt.Parse(token["id_token"], func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			require.Equal(t, want, ks.GetPublicKeys()[kid].Alg)
+			return ks.GetPublicKeys()[kid].Key, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, idtoken.Header["alg"])
+
+		// userinfo responses use the client's algorithm for them, or the id token's
+		uiwant := client.UserInfoSignedAlg
+		if uiwant == "" {
+			uiwant = want
+		}
+		userinfo, err := ts.UserInfoToken(client.Id, map[string]interface{}{"sub": "tokenuser"})
+		require.NoError(t, err)
+		claims := parseClaims(t, ks, userinfo)
+		require.Equal(t, client.Id, claims["aud"])
+		uitoken, _, err := new(jwt.Parser).ParseUnverified(userinfo, jwt.MapClaims{})
+		require.NoError(t, err)
+		require.Equal(t, uiwant, uitoken.Header["alg"])
+
+		// access tokens always use the default algorithm
+		atoken, _, err := new(jwt.Parser).ParseUnverified(token["access_token"], jwt.MapClaims{})
+		require.NoError(t, err)
+		require.Equal(t, algs[0], atoken.Header["alg"])
+
+		_, err = ts.Lookup(token["access_token"])
+		require.NoError(t, err)
+	}
+}
+
+func TestCodeLifecycle(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+		Tokens:    config.Tokens{AccessTokenProfile: config.ProfileOpaque},
+	}
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, statestore.NewMemory())
+
+	user := userdb.User{
+		Name:  "tokenuser",
+		Email: "token@example.com",
+	}
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	newCode := func() string {
+		ti := tokenstore.TokenInfo{
+			User:                &user,
+			ClientID:            "client",
+			Scopes:              map[string]bool{"openid": true},
+			RedirectURL:         "https://redirect.example.com",
+			CodeChallenge:       challenge,
+			CodeChallengeMethod: tokenstore.ChallengeS256,
+		}
+		code, err := ts.Put(&ti)
+		require.NoError(t, err)
+		return code
+	}
+
+	// the code is bound to the redirect url and the challenge, and a failed
+	//   attempt uses it up
+	tests := []struct {
+		redirectURL string
+		verifier    string
+	}{
+		{"https://other.example.com", verifier},
+		{"https://redirect.example.com", ""},
+		{"https://redirect.example.com", "wrong-verifier"},
+		{"https://redirect.example.com", challenge},
+	}
+	for _, test := range tests {
+		code := newCode()
+		_, err := ts.Redeem("client", code, test.redirectURL, test.verifier)
+		require.ErrorIs(t, err, tokenstore.ErrCodeMismatch)
+
+		_, err = ts.Redeem("client", code, "https://redirect.example.com", verifier)
+		require.ErrorIs(t, err, tokenstore.ErrCodeNotFound)
+	}
+
+	// a replayed code revokes the tokens issued from it
+	code := newCode()
+	grant, err := ts.Redeem("client", code, "https://redirect.example.com", verifier)
+	require.NoError(t, err)
+	token, err := ts.NewToken(grant)
+	require.NoError(t, err)
+	_, err = ts.Lookup(token["access_token"])
+	require.NoError(t, err)
+
+	_, err = ts.Redeem("client", code, "https://redirect.example.com", verifier)
+	require.ErrorIs(t, err, tokenstore.ErrCodeReplayed)
+	_, err = ts.Lookup(token["access_token"])
+	require.ErrorIs(t, err, tokenstore.ErrTokenInactive)
+
+	// plain challenges still need a well formed verifier
+	for _, plain := range []string{"too-short", strings.Repeat("a", 129), strings.Repeat("a", 42) + "!"} {
+		ti := tokenstore.TokenInfo{
+			User:                &user,
+			ClientID:            "client",
+			RedirectURL:         "https://redirect.example.com",
+			CodeChallenge:       plain,
+			CodeChallengeMethod: tokenstore.ChallengePlain,
+		}
+		code, err := ts.Put(&ti)
+		require.NoError(t, err)
+		_, err = ts.Redeem("client", code, "https://redirect.example.com", plain)
+		require.ErrorIs(t, err, tokenstore.ErrCodeMismatch)
+	}
+
+	// the janitor clears out codes once they're of no further use
+	code = newCode()
+	tokenstore.Sweep(ts, time.Now().Add(time.Hour))
+	_, err = ts.Redeem("client", code, "https://redirect.example.com", verifier)
+	require.ErrorIs(t, err, tokenstore.ErrCodeNotFound)
+}
+
+func TestGrantPersistence(t *testing.T) {
+	ks, err := keystore.New(nil, nil, nil, 0, 0, nil)
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		IssuerURL: "https://issuer.example.com",
+	}
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	ss, err := statestorebolt.New(path)
+	require.NoError(t, err)
+	ts := tokenstore.New(&cfg, clientstore.New(&cfg), ks, ss)
+
+	user := userdb.User{
+		Name:  "tokenuser",
+		Email: "token@example.com",
+	}
+	ti := tokenstore.TokenInfo{
+		User:        &user,
+		ClientID:    "client",
+		Scopes:      map[string]bool{"openid": true},
+		RedirectURL: "https://redirect.example.com",
+		AuthTime:    time.Now().Truncate(time.Second),
+	}
+	code, err := ts.Put(&ti)
+	require.NoError(t, err)
+	require.NoError(t, ss.Close())
+
+	// a code issued before a restart can be redeemed after it
+	ss, err = statestorebolt.New(path)
+	require.NoError(t, err)
+	defer ss.Close()
+	ts = tokenstore.New(&cfg, clientstore.New(&cfg), ks, ss)
+
+	grant, err := ts.Redeem("client", code, "https://redirect.example.com", "")
+	require.NoError(t, err)
+	require.Equal(t, "tokenuser", grant.User.Name)
+	require.True(t, ti.AuthTime.Equal(grant.AuthTime))
 
-	code := ts.Put(ti.ClientID, token)
-	token2, err := ts.Get(ti.ClientID, code)
+	token, err := ts.NewToken(grant)
 	require.NoError(t, err)
-	require.Equal(t, token, token2)
+	require.NotEmpty(t, token["id_token"])
 }
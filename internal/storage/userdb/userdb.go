@@ -8,10 +8,33 @@ type UserDb interface {
 	VerifyUser(userName, password string) (*User, error)
 	LookupUser(userName string) (*User, error)
 	LookupGroup(groupName string) (*Group, error)
+	Close() error
+}
+
+// a user database that can be changed... passwords are hashed by the database
+type WritableUserDb interface {
+	UserDb
+
+	ListUsers() ([]*User, error)
+	CreateUser(user *User, password string) error
+	UpdateUser(user *User) error
+	DeleteUser(userName string) error
+	SetPassword(userName, password string) error
+
+	ListGroups() ([]*Group, error)
+	CreateGroup(group *Group) error
+	DeleteGroup(groupName string) error
+}
+
+// a user database whose users and groups can change under it... fn is called
+// with the names of those that changed, or with none if any of them could have
+type ChangeNotifier interface {
+	OnChange(fn func(userNames, groupNames []string))
 }
 
 type User struct {
 	Dn         string
+	Id         string   `yaml:"id"`
 	Name       string   `yaml:"name"`
 	UidNumber  int      `yaml:"uid"`
 	GidNumber  int      `yaml:"gid"`
@@ -32,4 +55,6 @@ type Group struct {
 var (
 	ErrUserNotFound  = errors.New("user not found")
 	ErrGroupNotFound = errors.New("group not found")
+	ErrUserExists    = errors.New("user already exists")
+	ErrGroupExists   = errors.New("group already exists")
 )
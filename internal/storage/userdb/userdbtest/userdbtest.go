@@ -0,0 +1,90 @@
+package userdbtest
+
+import (
+	"fmt"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+// a user database for testing what's built on top of one... it counts the
+// calls made to it, and fails them with Err if that's set
+type Source struct {
+	Users  map[string]*userdb.User
+	Groups map[string]*userdb.Group
+	Err    error
+
+	Verifies     int
+	Lookups      int
+	GroupLookups int
+
+	onChange []func(userNames, groupNames []string)
+}
+
+func NewSource(users ...*userdb.User) *Source {
+	s := Source{
+		Users:  make(map[string]*userdb.User),
+		Groups: make(map[string]*userdb.Group),
+	}
+	for _, user := range users {
+		s.Users[user.Name] = user
+	}
+	return &s
+}
+
+func (s *Source) VerifyUser(userName, password string) (*userdb.User, error) {
+	s.Verifies++
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	user, ok := s.Users[userName]
+	if !ok || user.Password != password {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	return copyUser(user), nil
+}
+
+func (s *Source) LookupUser(userName string) (*userdb.User, error) {
+	s.Lookups++
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	user, ok := s.Users[userName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	return copyUser(user), nil
+}
+
+func (s *Source) LookupGroup(groupName string) (*userdb.Group, error) {
+	s.GroupLookups++
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	group, ok := s.Groups[groupName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+	}
+	cgroup := *group
+	return &cgroup, nil
+}
+
+func (s *Source) Close() error {
+	return nil
+}
+
+func (s *Source) OnChange(fn func(userNames, groupNames []string)) {
+	s.onChange = append(s.onChange, fn)
+}
+
+// tell whoever's listening that the users and groups changed
+func (s *Source) Change(userNames, groupNames []string) {
+	for _, fn := range s.onChange {
+		fn(userNames, groupNames)
+	}
+}
+
+func copyUser(user *userdb.User) *userdb.User {
+	cuser := *user
+	cuser.Groups = append([]string(nil), user.Groups...)
+	return &cuser
+}
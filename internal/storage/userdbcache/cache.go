@@ -0,0 +1,221 @@
+package userdbcache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+// a user database that keeps what it's been told, for a while
+type CachingUserDb interface {
+	userdb.UserDb
+
+	// forget about the user or group, or everything
+	InvalidateUser(userName string)
+	InvalidateGroup(groupName string)
+	InvalidateAll()
+}
+
+// cache lookups in front of another user database, remembering misses for negativeTTL
+func NewUserDb(udb userdb.UserDb, ttl, negativeTTL time.Duration, size int) CachingUserDb {
+	c := cache{
+		udb:         udb,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		now:         time.Now,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+
+	// forget what's changed in the source as soon as it does
+	if n, ok := udb.(userdb.ChangeNotifier); ok {
+		n.OnChange(c.invalidate)
+	}
+
+	return &c
+}
+
+type cache struct {
+	udb         userdb.UserDb
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int // unbounded if zero
+	now         func() time.Time
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	user    *userdb.User
+	group   *userdb.Group
+	expires time.Time
+}
+
+func userKey(userName string) string {
+	return "user:" + userName
+}
+
+func groupKey(groupName string) string {
+	return "group:" + groupName
+}
+
+func (c *cache) VerifyUser(userName, password string) (*userdb.User, error) {
+	// passwords are always checked by the source
+	user, err := c.udb.VerifyUser(userName, password)
+	if err != nil {
+		return nil, err
+	}
+	c.put(userKey(userName), &entry{user: copyUser(user)}, c.ttl)
+	return user, nil
+}
+
+func (c *cache) LookupUser(userName string) (*userdb.User, error) {
+	key := userKey(userName)
+	if e, ok := c.get(key); ok {
+		if e.user == nil {
+			return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+		}
+		return copyUser(e.user), nil
+	}
+
+	user, err := c.udb.LookupUser(userName)
+	if errors.Is(err, userdb.ErrUserNotFound) {
+		c.put(key, &entry{}, c.negativeTTL)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, &entry{user: copyUser(user)}, c.ttl)
+	return user, nil
+}
+
+func (c *cache) LookupGroup(groupName string) (*userdb.Group, error) {
+	key := groupKey(groupName)
+	if e, ok := c.get(key); ok {
+		if e.group == nil {
+			return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+		}
+		group := *e.group
+		return &group, nil
+	}
+
+	group, err := c.udb.LookupGroup(groupName)
+	if errors.Is(err, userdb.ErrGroupNotFound) {
+		c.put(key, &entry{}, c.negativeTTL)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	cgroup := *group
+	c.put(key, &entry{group: &cgroup}, c.ttl)
+	return group, nil
+}
+
+func (c *cache) Close() error {
+	return c.udb.Close()
+}
+
+func (c *cache) InvalidateUser(userName string) {
+	c.remove(userKey(userName))
+}
+
+func (c *cache) InvalidateGroup(groupName string) {
+	c.remove(groupKey(groupName))
+}
+
+func (c *cache) InvalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// caches further up hear about the source's changes too
+func (c *cache) OnChange(fn func(userNames, groupNames []string)) {
+	if n, ok := c.udb.(userdb.ChangeNotifier); ok {
+		n.OnChange(fn)
+	}
+}
+
+func (c *cache) invalidate(userNames, groupNames []string) {
+	if len(userNames) == 0 && len(groupNames) == 0 {
+		c.InvalidateAll()
+		return
+	}
+	for _, userName := range userNames {
+		c.InvalidateUser(userName)
+	}
+	for _, groupName := range groupNames {
+		c.InvalidateGroup(groupName)
+	}
+}
+
+func (c *cache) get(key string) (*entry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if c.now().After(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+func (c *cache) put(key string, e *entry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	e.key = key
+	e.expires = c.now().Add(ttl)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+
+	// make room by dropping what's been used least recently
+	for c.size > 0 && c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+func (c *cache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func copyUser(user *userdb.User) *userdb.User {
+	cuser := *user
+	cuser.Groups = append([]string(nil), user.Groups...)
+	return &cuser
+}
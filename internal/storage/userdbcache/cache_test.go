@@ -0,0 +1,195 @@
+package userdbcache_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb/userdbtest"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbcache"
+)
+
+func TestUserCache(t *testing.T) {
+	src := newSource()
+	udb := userdbcache.NewUserDb(src, time.Hour, time.Hour, 0)
+
+	// lookups are cached
+	for i := 0; i < 3; i++ {
+		u, err := udb.LookupUser("user1")
+		require.NoError(t, err)
+		require.Equal(t, "user1@example.com", u.Email)
+	}
+	require.Equal(t, 1, src.Lookups)
+
+	// and callers can't change what's cached
+	u, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	u.Groups[0] = "changed"
+	u, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1"}, u.Groups)
+
+	// so are misses
+	for i := 0; i < 3; i++ {
+		_, err := udb.LookupUser("user2")
+		require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	}
+	require.Equal(t, 2, src.Lookups)
+
+	// other errors aren't
+	src.Err = errors.New("down")
+	for i := 0; i < 2; i++ {
+		_, err := udb.LookupUser("user3")
+		require.Error(t, err)
+	}
+	require.Equal(t, 4, src.Lookups)
+	src.Err = nil
+
+	// until they're invalidated
+	src.Users["user2"] = &userdb.User{Name: "user2", Password: "password2"}
+	udb.InvalidateUser("user2")
+	_, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, 5, src.Lookups)
+
+	udb.InvalidateAll()
+	_, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, 6, src.Lookups)
+
+	// groups too
+	for i := 0; i < 2; i++ {
+		g, err := udb.LookupGroup("group1")
+		require.NoError(t, err)
+		require.Equal(t, 2001, g.GidNumber)
+		_, err = udb.LookupGroup("group2")
+		require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+	}
+	require.Equal(t, 2, src.GroupLookups)
+
+	udb.InvalidateGroup("group1")
+	_, err = udb.LookupGroup("group1")
+	require.NoError(t, err)
+	require.Equal(t, 3, src.GroupLookups)
+}
+
+func TestUserCacheVerify(t *testing.T) {
+	src := newSource()
+	udb := userdbcache.NewUserDb(src, time.Hour, time.Hour, 0)
+
+	// passwords always go to the source
+	for i := 0; i < 3; i++ {
+		_, err := udb.VerifyUser("user1", "password1")
+		require.NoError(t, err)
+		_, err = udb.VerifyUser("user1", "wrong")
+		require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	}
+	require.Equal(t, 6, src.Verifies)
+
+	// a good one fills the cache, a bad one doesn't poison it
+	_, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, 0, src.Lookups)
+}
+
+func TestUserCacheExpiry(t *testing.T) {
+	src := newSource()
+	udb := userdbcache.NewUserDb(src, time.Minute, time.Second, 0)
+	now := time.Now()
+	userdbcache.SetNow(udb, func() time.Time { return now })
+
+	_, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	_, err = udb.LookupUser("user2")
+	require.Error(t, err)
+	now = now.Add(10 * time.Second)
+
+	// misses expire on their own schedule
+	_, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	_, err = udb.LookupUser("user2")
+	require.Error(t, err)
+	require.Equal(t, 3, src.Lookups)
+
+	now = now.Add(time.Minute)
+	_, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, 4, src.Lookups)
+
+	// no negative ttl, no negative caching
+	udb = userdbcache.NewUserDb(src, time.Hour, 0, 0)
+	for i := 0; i < 2; i++ {
+		_, err = udb.LookupUser("user2")
+		require.Error(t, err)
+	}
+	require.Equal(t, 6, src.Lookups)
+}
+
+func TestUserCacheChanges(t *testing.T) {
+	src := newSource()
+	src.Users["user2"] = &userdb.User{Name: "user2"}
+	udb := userdbcache.NewUserDb(src, time.Hour, time.Hour, 0)
+
+	lookup := func() {
+		for _, name := range []string{"user1", "user2"} {
+			_, err := udb.LookupUser(name)
+			require.NoError(t, err)
+		}
+		_, err := udb.LookupGroup("group1")
+		require.NoError(t, err)
+	}
+	lookup()
+
+	// the source's changes are forgotten straight away
+	src.Change([]string{"user1"}, nil)
+	lookup()
+	require.Equal(t, 3, src.Lookups)
+	require.Equal(t, 1, src.GroupLookups)
+
+	src.Change(nil, []string{"group1"})
+	lookup()
+	require.Equal(t, 3, src.Lookups)
+	require.Equal(t, 2, src.GroupLookups)
+
+	// and with no names it could be anything
+	src.Change(nil, nil)
+	lookup()
+	require.Equal(t, 5, src.Lookups)
+	require.Equal(t, 3, src.GroupLookups)
+
+	// caches in front of caches hear about them too
+	outer := userdbcache.NewUserDb(udb, time.Hour, time.Hour, 0)
+	_, err := outer.LookupUser("user1")
+	require.NoError(t, err)
+	src.Users["user1"].Email = "changed@example.com"
+	src.Change([]string{"user1"}, nil)
+	u, err := outer.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, "changed@example.com", u.Email)
+}
+
+func TestUserCacheSize(t *testing.T) {
+	src := newSource()
+	for i := 2; i <= 3; i++ {
+		name := fmt.Sprintf("user%d", i)
+		src.Users[name] = &userdb.User{Name: name}
+	}
+	udb := userdbcache.NewUserDb(src, time.Hour, time.Hour, 2)
+
+	// the least recently used goes when it's full
+	for _, name := range []string{"user1", "user2", "user1", "user3", "user1", "user2"} {
+		_, err := udb.LookupUser(name)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, src.Lookups)
+}
+
+func newSource() *userdbtest.Source {
+	src := userdbtest.NewSource(&userdb.User{Name: "user1", Password: "password1", Email: "user1@example.com", Groups: []string{"group1"}})
+	src.Groups["group1"] = &userdb.Group{Name: "group1", GidNumber: 2001}
+	return src
+}
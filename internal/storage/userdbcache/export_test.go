@@ -0,0 +1,9 @@
+package userdbcache
+
+import (
+	"time"
+)
+
+func SetNow(udb CachingUserDb, now func() time.Time) {
+	udb.(*cache).now = now
+}
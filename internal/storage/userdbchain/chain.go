@@ -0,0 +1,211 @@
+package userdbchain
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+// a user database in a chain, and the users it's asked about
+type Backend struct {
+	UserDb userdb.UserDb
+
+	Match       []string // patterns the login name must match, if any
+	Domains     []string // domains the login name must be in, if any
+	StripDomain bool     // only pass the part before the @ to the database
+	MergeGroups bool     // only add groups to users owned by other backends
+}
+
+// consult each of the backends in order... a user is owned by the first one
+// that knows about them, and only that one checks their password
+func NewUserDb(backends []*Backend) userdb.UserDb {
+	return &chain{
+		backends: backends,
+	}
+}
+
+type chain struct {
+	backends []*Backend
+}
+
+func (ch *chain) VerifyUser(userName, password string) (*userdb.User, error) {
+	for _, backend := range ch.backends {
+		if backend.MergeGroups || !backend.matches(userName) {
+			continue
+		}
+		user, err := backend.UserDb.VerifyUser(backend.name(userName), password)
+		if err == nil {
+			return ch.mergeGroups(userName, backend.user(userName, user))
+		}
+		if !errors.Is(err, userdb.ErrUserNotFound) {
+			return nil, err
+		}
+
+		// a backend that has the user owns them, so a wrong password isn't
+		//   tried further down the chain
+		_, lerr := backend.UserDb.LookupUser(backend.name(userName))
+		if lerr == nil {
+			return nil, err
+		}
+		if !errors.Is(lerr, userdb.ErrUserNotFound) {
+			return nil, lerr
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+}
+
+func (ch *chain) LookupUser(userName string) (*userdb.User, error) {
+	owner, user, err := ch.owner(userName)
+	if err != nil {
+		return nil, err
+	}
+	return ch.mergeGroups(userName, owner.user(userName, user))
+}
+
+func (ch *chain) LookupGroup(groupName string) (*userdb.Group, error) {
+	for _, backend := range ch.backends {
+		group, err := backend.UserDb.LookupGroup(groupName)
+		if errors.Is(err, userdb.ErrGroupNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return group, nil
+	}
+	return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+}
+
+func (ch *chain) Close() error {
+	var errs []error
+	for _, backend := range ch.backends {
+		errs = append(errs, backend.UserDb.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// changes to the backends are passed on... users of a backend that strips
+// their domain are known by more than one name, so any change to them could
+// be to anything
+func (ch *chain) OnChange(fn func(userNames, groupNames []string)) {
+	for _, backend := range ch.backends {
+		n, ok := backend.UserDb.(userdb.ChangeNotifier)
+		if !ok {
+			continue
+		}
+		strip := backend.StripDomain
+		n.OnChange(func(userNames, groupNames []string) {
+			if strip && len(userNames) > 0 {
+				fn(nil, nil)
+				return
+			}
+			fn(userNames, groupNames)
+		})
+	}
+}
+
+// the first backend that owns the user... a backend that fails stops the
+// search, so an outage can't hand the user to someone further down the chain
+func (ch *chain) owner(userName string) (*Backend, *userdb.User, error) {
+	for _, backend := range ch.backends {
+		if backend.MergeGroups || !backend.matches(userName) {
+			continue
+		}
+		user, err := backend.UserDb.LookupUser(backend.name(userName))
+		if errors.Is(err, userdb.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return backend, user, nil
+	}
+	return nil, nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+}
+
+// add the groups the user is in from the backends that only supply groups
+func (ch *chain) mergeGroups(userName string, user *userdb.User) (*userdb.User, error) {
+	// the backend's slice may be shared, so add to a copy
+	groups := append([]string{}, user.Groups...)
+	for _, backend := range ch.backends {
+		if !backend.MergeGroups || !backend.matches(userName) {
+			continue
+		}
+		other, err := backend.UserDb.LookupUser(backend.name(userName))
+		if errors.Is(err, userdb.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range other.Groups {
+			if !contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	user.Groups = groups
+	return user, nil
+}
+
+func (b *Backend) matches(userName string) bool {
+	if len(b.Domains) > 0 {
+		_, domain, ok := strings.Cut(userName, "@")
+		if !ok {
+			return false
+		}
+		found := false
+		for _, d := range b.Domains {
+			found = found || strings.EqualFold(d, domain)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(b.Match) == 0 {
+		return true
+	}
+	for _, pattern := range b.Match {
+		if ok, _ := path.Match(pattern, userName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the name the backend knows the user by
+func (b *Backend) name(userName string) string {
+	if b.StripDomain {
+		local, _, _ := strings.Cut(userName, "@")
+		return local
+	}
+	return userName
+}
+
+// the user as the chain knows them... users of a backend that strips the
+// domain keep their full name, and their id is put in the backend's first
+// domain so it can't be mistaken for another backend's user with the same
+// local part
+func (b *Backend) user(userName string, user *userdb.User) *userdb.User {
+	if !b.StripDomain {
+		return user
+	}
+	user.Name = userName
+	if user.Id != "" && len(b.Domains) > 0 {
+		user.Id = user.Id + "@" + strings.ToLower(b.Domains[0])
+	}
+	return user
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
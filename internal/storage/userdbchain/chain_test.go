@@ -0,0 +1,179 @@
+package userdbchain_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb/userdbtest"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbchain"
+)
+
+func TestChainOwnership(t *testing.T) {
+	local := userdbtest.NewSource(
+		&userdb.User{Name: "admin", Password: "local", Groups: []string{"admins"}},
+		&userdb.User{Name: "user1", Password: "local", Groups: []string{"local"}},
+	)
+	local.Groups["admins"] = &userdb.Group{Name: "admins", GidNumber: 1001}
+	directory := userdbtest.NewSource(
+		&userdb.User{Name: "user1", Password: "directory", Groups: []string{"staff"}},
+		&userdb.User{Name: "user2", Password: "directory", Groups: []string{"staff"}},
+	)
+	directory.Groups["admins"] = &userdb.Group{Name: "admins", GidNumber: 2001}
+	directory.Groups["staff"] = &userdb.Group{Name: "staff", GidNumber: 2002}
+
+	udb := userdbchain.NewUserDb([]*userdbchain.Backend{
+		{UserDb: local, Match: []string{"admin", "svc-*"}},
+		{UserDb: directory},
+	})
+
+	// the first backend that matches and knows the user owns them, and
+	//   checks the password without a separate lookup
+	u, err := udb.VerifyUser("admin", "local")
+	require.NoError(t, err)
+	require.Equal(t, []string{"admins"}, u.Groups)
+	require.Equal(t, 1, local.Verifies)
+	require.Equal(t, 0, local.Lookups)
+
+	// and names that don't match skip the backend
+	u, err = udb.VerifyUser("user1", "directory")
+	require.NoError(t, err)
+	require.Equal(t, []string{"staff"}, u.Groups)
+	_, err = udb.VerifyUser("user1", "local")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// matching backends that don't know the user pass them on
+	_, err = udb.VerifyUser("svc-backup", "local")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, "user2", u.Name)
+
+	// only the owner checks the password
+	directory.Users["admin"] = &userdb.User{Name: "admin", Password: "directory"}
+	_, err = udb.VerifyUser("admin", "directory")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// a failing backend doesn't hand its users to the next one
+	local.Err = errors.New("down")
+	_, err = udb.VerifyUser("admin", "directory")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, userdb.ErrUserNotFound)
+	local.Err = nil
+
+	// the first backend with the group has it
+	g, err := udb.LookupGroup("admins")
+	require.NoError(t, err)
+	require.Equal(t, 1001, g.GidNumber)
+	g, err = udb.LookupGroup("staff")
+	require.NoError(t, err)
+	require.Equal(t, 2002, g.GidNumber)
+	_, err = udb.LookupGroup("nobody")
+	require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+
+	// and a failing backend doesn't hand its groups on either
+	lookups := directory.GroupLookups
+	local.Err = errors.New("down")
+	_, err = udb.LookupGroup("staff")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, userdb.ErrGroupNotFound)
+	require.Equal(t, lookups, directory.GroupLookups)
+	local.Err = nil
+}
+
+func TestChainDomains(t *testing.T) {
+	corp := userdbtest.NewSource(&userdb.User{Id: "1000", Name: "user1", Password: "corp", Groups: []string{"corp"}})
+	partner := userdbtest.NewSource(&userdb.User{Id: "1000", Name: "user1@partner.com", Password: "partner", Groups: []string{"partner"}})
+
+	udb := userdbchain.NewUserDb([]*userdbchain.Backend{
+		{UserDb: corp, Domains: []string{"corp.com", "corp.net"}, StripDomain: true},
+		{UserDb: partner, Domains: []string{"partner.com"}},
+	})
+
+	// the domain picks the backend, which may only see the local part
+	u, err := udb.VerifyUser("user1@corp.com", "corp")
+	require.NoError(t, err)
+	require.Equal(t, []string{"corp"}, u.Groups)
+	_, err = udb.VerifyUser("user1@CORP.NET", "corp")
+	require.NoError(t, err)
+
+	u, err = udb.VerifyUser("user1@partner.com", "partner")
+	require.NoError(t, err)
+	require.Equal(t, []string{"partner"}, u.Groups)
+
+	// but the users keep their full names, and ids that can't clash
+	u, err = udb.LookupUser("user1@corp.net")
+	require.NoError(t, err)
+	require.Equal(t, "user1@corp.net", u.Name)
+	require.Equal(t, "1000@corp.com", u.Id)
+	u, err = udb.LookupUser("user1@partner.com")
+	require.NoError(t, err)
+	require.Equal(t, "user1@partner.com", u.Name)
+	require.Equal(t, "1000", u.Id)
+
+	// names without a domain, or with any other, belong to neither
+	_, err = udb.LookupUser("user1")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	_, err = udb.LookupUser("user1@other.com")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+}
+
+func TestChainMergeGroups(t *testing.T) {
+	directory := userdbtest.NewSource(&userdb.User{Name: "user1", Password: "directory", Groups: []string{"staff", "vpn"}})
+	extra := userdbtest.NewSource(
+		&userdb.User{Name: "user1", Password: "extra", Groups: []string{"vpn", "deploy"}},
+		&userdb.User{Name: "user2", Password: "extra", Groups: []string{"deploy"}},
+	)
+
+	udb := userdbchain.NewUserDb([]*userdbchain.Backend{
+		{UserDb: directory},
+		{UserDb: extra, MergeGroups: true},
+	})
+
+	// groups are added without duplicates
+	u, err := udb.VerifyUser("user1", "directory")
+	require.NoError(t, err)
+	require.Equal(t, []string{"staff", "vpn", "deploy"}, u.Groups)
+	u, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"staff", "vpn", "deploy"}, u.Groups)
+
+	// without changing what the owner has
+	require.Equal(t, []string{"staff", "vpn"}, directory.Users["user1"].Groups)
+
+	// but those backends never own users or check passwords
+	_, err = udb.VerifyUser("user1", "extra")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	_, err = udb.LookupUser("user2")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+}
+
+func TestChainChanges(t *testing.T) {
+	corp := userdbtest.NewSource()
+	local := userdbtest.NewSource()
+
+	udb := userdbchain.NewUserDb([]*userdbchain.Backend{
+		{UserDb: corp, Domains: []string{"corp.com"}, StripDomain: true},
+		{UserDb: local},
+	})
+
+	var userNames, groupNames []string
+	udb.(userdb.ChangeNotifier).OnChange(func(u, g []string) {
+		userNames, groupNames = u, g
+	})
+
+	// the backends' changes are passed on
+	local.Change([]string{"user1"}, []string{"group1"})
+	require.Equal(t, []string{"user1"}, userNames)
+	require.Equal(t, []string{"group1"}, groupNames)
+
+	// but the chain doesn't know which names the stripped users go by
+	corp.Change([]string{"user1"}, nil)
+	require.Nil(t, userNames)
+	require.Nil(t, groupNames)
+	corp.Change(nil, []string{"group1"})
+	require.Nil(t, userNames)
+	require.Equal(t, []string{"group1"}, groupNames)
+}
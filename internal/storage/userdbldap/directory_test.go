@@ -0,0 +1,379 @@
+package userdbldap_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// a directory that speaks just enough ldap over tls to bind and search
+type directory struct {
+	url       string
+	caFile    string
+	tlsConfig *tls.Config
+
+	mutex    sync.Mutex
+	entries  []*ldap.Entry
+	conns    map[net.Conn]bool
+	dials    int
+	searches int
+	failRoot bool
+	dropNext bool
+}
+
+func newDirectory(t *testing.T) *directory {
+	cert, caFile, _ := selfSigned(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	d := directory{
+		url:       "ldaps://" + listener.Addr().String(),
+		caFile:    caFile,
+		tlsConfig: &tls.Config{RootCAs: roots},
+		conns:     make(map[net.Conn]bool),
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		d.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			d.mutex.Lock()
+			d.dials++
+			d.conns[conn] = true
+			d.mutex.Unlock()
+
+			go d.serve(conn)
+		}
+	}()
+
+	return &d
+}
+
+// a certificate that's its own ca, and the files it and its key are in
+func selfSigned(t *testing.T) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "directory"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, certFile, keyFile
+}
+
+// entries with a userPassword can be bound as
+func (d *directory) add(dn string, attrs map[string][]string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.entries = append(d.entries, ldap.NewEntry(dn, attrs))
+}
+
+func (d *directory) addValue(dn, attr, value string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	entry := d.entry(dn)
+	for _, a := range entry.Attributes {
+		if a.Name == attr {
+			a.Values = append(a.Values, value)
+			return
+		}
+	}
+	entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(attr, []string{value}))
+}
+
+func (d *directory) dial() (*ldap.Conn, error) {
+	return ldap.DialURL(d.url, ldap.DialWithTLSConfig(d.tlsConfig))
+}
+
+// the number of connections and searches so far
+func (d *directory) counts() (int, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.dials, d.searches
+}
+
+func (d *directory) open() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.conns)
+}
+
+// make reading the root DSE fail, which is how connections are health checked
+func (d *directory) failRootDSE(fail bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.failRoot = fail
+}
+
+// drop the connection the next search comes in on
+func (d *directory) dropNextSearch() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.dropNext = true
+}
+
+// drop all the connections
+func (d *directory) drop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for conn := range d.conns {
+		conn.Close()
+	}
+}
+
+func (d *directory) serve(conn net.Conn) {
+	defer func() {
+		d.mutex.Lock()
+		delete(d.conns, conn)
+		d.mutex.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var replies []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			replies = append(replies, d.bind(op))
+		case ldap.ApplicationSearchRequest:
+			var ok bool
+			replies, ok = d.search(op)
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+
+		for _, reply := range replies {
+			envelope := ber.NewSequence("")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(reply)
+			_, err := conn.Write(envelope.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *directory) bind(op *ber.Packet) *ber.Packet {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	dn := ber.DecodeString(op.Children[1].Data.Bytes())
+	password := ber.DecodeString(op.Children[2].Data.Bytes())
+
+	entry := d.entry(dn)
+	if entry == nil || password == "" || entry.GetAttributeValue("userPassword") != password {
+		return result(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+	}
+	return result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+}
+
+func (d *directory) search(op *ber.Packet) ([]*ber.Packet, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.searches++
+	if d.dropNext {
+		d.dropNext = false
+		return nil, false
+	}
+
+	base := strings.ToLower(ber.DecodeString(op.Children[0].Data.Bytes()))
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+
+	// the root DSE
+	if base == "" {
+		if d.failRoot {
+			return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnavailable)}, true
+		}
+		return []*ber.Packet{
+			entryPacket(ldap.NewEntry("", nil)),
+			result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+		}, true
+	}
+
+	var replies []*ber.Packet
+	found := false
+	for _, entry := range d.entries {
+		dn := strings.ToLower(entry.DN)
+		below := strings.HasSuffix(dn, ","+base)
+		found = found || dn == base || below
+		if dn != base && (scope == ldap.ScopeBaseObject || !below) {
+			continue
+		}
+		if d.match(entry, filter) {
+			replies = append(replies, entryPacket(entry))
+		}
+	}
+	if !found {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject)}, true
+	}
+	return append(replies, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)), true
+}
+
+func (d *directory) entry(dn string) *ldap.Entry {
+	for _, entry := range d.entries {
+		if strings.EqualFold(entry.DN, dn) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (d *directory) match(entry *ldap.Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !d.match(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if d.match(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !d.match(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		attr := ber.DecodeString(filter.Children[0].Data.Bytes())
+		value := ber.DecodeString(filter.Children[1].Data.Bytes())
+		return hasValue(entry, attr, value)
+	case ldap.FilterPresent:
+		attr := ber.DecodeString(filter.Data.Bytes())
+		return strings.EqualFold(attr, "objectClass") || len(entry.GetEqualFoldAttributeValues(attr)) > 0
+	case ldap.FilterExtensibleMatch:
+		var rule, attr, value string
+		for _, child := range filter.Children {
+			switch child.Tag {
+			case ldap.MatchingRuleAssertionMatchingRule:
+				rule = ber.DecodeString(child.Data.Bytes())
+			case ldap.MatchingRuleAssertionType:
+				attr = ber.DecodeString(child.Data.Bytes())
+			case ldap.MatchingRuleAssertionMatchValue:
+				value = ber.DecodeString(child.Data.Bytes())
+			}
+		}
+		return rule == "1.2.840.113556.1.4.1941" && d.inChain(entry, attr, value, map[string]bool{})
+	}
+	return false
+}
+
+// active directory's in chain matching, following members that are groups
+func (d *directory) inChain(entry *ldap.Entry, attr, value string, seen map[string]bool) bool {
+	seen[strings.ToLower(entry.DN)] = true
+	for _, member := range entry.GetEqualFoldAttributeValues(attr) {
+		if strings.EqualFold(member, value) {
+			return true
+		}
+		if group := d.entry(member); group != nil && !seen[strings.ToLower(member)] && d.inChain(group, attr, value, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasValue(entry *ldap.Entry, attr, value string) bool {
+	for _, v := range entry.GetEqualFoldAttributeValues(attr) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return packet
+}
+
+func entryPacket(entry *ldap.Entry) *ber.Packet {
+	attrs := ber.NewSequence("")
+	for _, attr := range entry.Attributes {
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range attr.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		a := ber.NewSequence("")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr.Name, ""))
+		a.AppendChild(values)
+		attrs.AppendChild(a)
+	}
+
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, ""))
+	packet.AppendChild(attrs)
+	return packet
+}
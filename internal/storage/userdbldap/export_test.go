@@ -0,0 +1,111 @@
+package userdbldap
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func UserFilter(s *Schema, userName string) string {
+	return s.userFilter(userName)
+}
+
+func MemberFilter(s *Schema, userName, userDn string) string {
+	return s.memberFilter(userName, userDn)
+}
+
+func GroupFilter(s *Schema, groupName string) string {
+	return s.groupFilter(groupName)
+}
+
+func InChainFilter(s *Schema, userDn string) string {
+	return s.inChainFilter(userDn)
+}
+
+func ParentFilter(s *Schema, groupDn string) string {
+	return s.parentFilter(groupDn)
+}
+
+type Servers = servers
+
+func NewServers(urls []string, failover string) (*Servers, error) {
+	return newServers(urls, failover, &tls.Config{})
+}
+
+func Order(ss *Servers) []string {
+	var urls []string
+	for _, srv := range ss.order() {
+		urls = append(urls, srv.url)
+	}
+	return urls
+}
+
+func Dial(ss *Servers) error {
+	l, err := ss.dial()
+	if err == nil {
+		l.Close()
+	}
+	return err
+}
+
+func Record(ss *Servers, url string, err error) {
+	for _, srv := range ss.list {
+		if srv.url == url {
+			ss.record(srv, err)
+		}
+	}
+}
+
+type Pool = pool
+
+var ErrPoolExhausted = errPoolExhausted
+
+func NewPool(dial func() (*ldap.Conn, error), size int, idleTimeout, waitTimeout time.Duration) *Pool {
+	p := newPool(dial, size, idleTimeout)
+	p.waitTimeout = waitTimeout
+	return p
+}
+
+func WithConn(p *Pool, fn func(l *ldap.Conn) error) error {
+	return p.withConn(fn)
+}
+
+func Prune(p *Pool) {
+	p.prune()
+}
+
+func ClosePool(p *Pool) {
+	p.close()
+}
+
+func Idle(p *Pool) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.idle)
+}
+
+// make the idle connections look like they haven't been used for a while
+func Age(p *Pool, by time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, pc := range p.idle {
+		pc.lastUsed = pc.lastUsed.Add(-by)
+	}
+}
+
+type GroupCache = groupCache
+
+func NewGroupCache(ttl time.Duration) *GroupCache {
+	return &groupCache{ttl: ttl}
+}
+
+func PutGroup(gc *GroupCache, dn string) {
+	gc.put(&cachedGroup{dn: dn})
+}
+
+func CachedGroups(gc *GroupCache) int {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	return len(gc.groups)
+}
@@ -0,0 +1,241 @@
+package userdbldap
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// the names of all the groups the user is in, directly or through other groups
+func (ldp *ldapDb) resolveGroups(l *ldap.Conn, userName, userDn string, entry *ldap.Entry) ([]string, error) {
+	s := ldp.schema
+
+	// the directory can do all the work
+	if s.InChain {
+		return ldp.searchGroupNames(l, s.inChainFilter(userDn))
+	}
+
+	// the groups the user is directly in
+	var direct []string
+	if s.MemberOfAttr != "" {
+		direct = entry.GetEqualFoldAttributeValues(s.MemberOfAttr)
+	} else {
+		groups, err := ldp.searchGroups(l, s.memberFilter(userName, userDn))
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			direct = append(direct, group.dn)
+		}
+	}
+
+	// follow the groups the groups are in... members listed by login name can
+	//   only be users, so there's nothing to follow for those
+	seen := make(map[string]bool)
+	for _, dn := range direct {
+		seen[strings.ToLower(dn)] = true
+	}
+	if s.MemberOfAttr != "" || s.MemberValue == MemberDn {
+		frontier := direct
+		for depth := 0; depth < s.NestedDepth && len(frontier) > 0; depth++ {
+			var next []string
+			for _, dn := range frontier {
+				group, err := ldp.groupByDn(l, dn)
+				if err != nil {
+					return nil, err
+				}
+				if group == nil {
+					continue
+				}
+				parents, err := ldp.groupParents(l, group)
+				if err != nil {
+					return nil, err
+				}
+				for _, parent := range parents {
+					if !seen[strings.ToLower(parent)] {
+						seen[strings.ToLower(parent)] = true
+						next = append(next, parent)
+					}
+				}
+			}
+			frontier = next
+		}
+	}
+
+	// and get their names
+	names := make([]string, 0, len(seen))
+	for dn := range seen {
+		group, err := ldp.groupByDn(l, dn)
+		if err != nil {
+			return nil, err
+		}
+		if group != nil && group.name != "" {
+			names = append(names, group.name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+type cachedGroup struct {
+	dn      string
+	name    string
+	parents []string // nil until they're looked up
+	expires time.Time
+}
+
+type groupCache struct {
+	ttl    time.Duration
+	mutex  sync.Mutex
+	groups map[string]*cachedGroup
+	swept  time.Time
+}
+
+func (gc *groupCache) get(dn string) *cachedGroup {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	group := gc.groups[strings.ToLower(dn)]
+	if group == nil || time.Now().After(group.expires) {
+		return nil
+	}
+	return group
+}
+
+func (gc *groupCache) put(group *cachedGroup) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	if gc.groups == nil {
+		gc.groups = make(map[string]*cachedGroup)
+	}
+
+	// drop what's expired while we're here, but only once a ttl so it isn't
+	//   a scan of the whole cache on every insert
+	now := time.Now()
+	if now.Sub(gc.swept) >= gc.ttl {
+		for key, g := range gc.groups {
+			if now.After(g.expires) {
+				delete(gc.groups, key)
+			}
+		}
+		gc.swept = now
+	}
+
+	group.expires = now.Add(gc.ttl)
+	gc.groups[strings.ToLower(group.dn)] = group
+}
+
+// the group with the dn, or nil if it isn't one
+func (ldp *ldapDb) groupByDn(l *ldap.Conn, dn string) (*cachedGroup, error) {
+	if group := ldp.groups.get(dn); group != nil {
+		return group, nil
+	}
+
+	s := ldp.schema
+	attrs := []string{s.GroupAttr}
+	if s.MemberOfAttr != "" {
+		attrs = append(attrs, s.MemberOfAttr)
+	}
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		s.GroupFilter,
+		attrs,
+		nil,
+	)
+	sr, err := l.Search(searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, nil
+	}
+
+	group := cachedGroup{
+		dn:   sr.Entries[0].DN,
+		name: sr.Entries[0].GetEqualFoldAttributeValue(s.GroupAttr),
+	}
+	if s.MemberOfAttr != "" {
+		group.parents = append([]string{}, sr.Entries[0].GetEqualFoldAttributeValues(s.MemberOfAttr)...)
+	}
+	ldp.groups.put(&group)
+
+	return &group, nil
+}
+
+// the dns of the groups the group is a member of
+func (ldp *ldapDb) groupParents(l *ldap.Conn, group *cachedGroup) ([]string, error) {
+	if group.parents != nil {
+		return group.parents, nil
+	}
+
+	parents, err := ldp.searchGroups(l, ldp.schema.parentFilter(group.dn))
+	if err != nil {
+		return nil, err
+	}
+
+	dns := []string{}
+	for _, parent := range parents {
+		dns = append(dns, parent.dn)
+	}
+
+	// cache a copy rather than changing what others may be reading
+	ngroup := *group
+	ngroup.parents = dns
+	ldp.groups.put(&ngroup)
+
+	return dns, nil
+}
+
+// the groups matching the filter, which are cached as they're found
+func (ldp *ldapDb) searchGroups(l *ldap.Conn, filter string) ([]*cachedGroup, error) {
+	searchRequest := ldap.NewSearchRequest(
+		ldp.searchBase,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{"dn", ldp.schema.GroupAttr},
+		nil,
+	)
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]*cachedGroup, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		group := ldp.groups.get(entry.DN)
+		if group == nil {
+			group = &cachedGroup{
+				dn:   entry.DN,
+				name: entry.GetEqualFoldAttributeValue(ldp.schema.GroupAttr),
+			}
+			ldp.groups.put(group)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (ldp *ldapDb) searchGroupNames(l *ldap.Conn, filter string) ([]string, error) {
+	groups, err := ldp.searchGroups(l, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, group := range groups {
+		if group.name != "" {
+			names = append(names, group.name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,196 @@
+package userdbldap_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbldap"
+)
+
+const (
+	searchDn = "cn=search,dc=example,dc=com"
+	userDn   = "uid=user1,ou=people,dc=example,dc=com"
+)
+
+func groupDn(name string) string {
+	return "cn=" + name + ",ou=groups,dc=example,dc=com"
+}
+
+// a directory with user1 in group1, which is in group2, which is in group3
+func newGroupDirectory(t *testing.T) *directory {
+	d := newDirectory(t)
+	d.add(searchDn, map[string][]string{"userPassword": {"secret"}})
+	d.add(userDn, map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"user1"},
+		"memberOf":    {groupDn("group1")},
+	})
+	d.add(groupDn("group1"), map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group1"},
+		"member":      {userDn},
+		"memberOf":    {groupDn("group2")},
+	})
+	d.add(groupDn("group2"), map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group2"},
+		"member":      {groupDn("group1")},
+		"memberOf":    {groupDn("group3")},
+	})
+	d.add(groupDn("group3"), map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group3"},
+		"member":      {groupDn("group2")},
+	})
+	return d
+}
+
+func newGroupUserDb(t *testing.T, d *directory, overrides *userdbldap.Schema) userdb.UserDb {
+	schema, err := userdbldap.LoadSchema("rfc2307bis", overrides)
+	require.NoError(t, err)
+
+	udb, err := userdbldap.NewUserDb([]string{d.url}, "", "dc=example,dc=com", searchDn, "secret", schema, d.tlsConfig, 1, 0, time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { udb.Close() })
+
+	return udb
+}
+
+func TestLookupGroup(t *testing.T) {
+	d := newGroupDirectory(t)
+	d.add("cn=group1,ou=other,dc=example,dc=com", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group1"},
+	})
+	udb := newGroupUserDb(t, d, nil)
+
+	g, err := udb.LookupGroup("group2")
+	require.NoError(t, err)
+	require.Equal(t, groupDn("group2"), g.Dn)
+
+	// only a search that finds nothing means there's no such group
+	_, err = udb.LookupGroup("missing")
+	require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+
+	_, err = udb.LookupGroup("group1")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, userdb.ErrGroupNotFound)
+
+	schema, err := userdbldap.LoadSchema("rfc2307bis", nil)
+	require.NoError(t, err)
+	udb, err = userdbldap.NewUserDb([]string{d.url}, "", "dc=missing,dc=com", searchDn, "secret", schema, d.tlsConfig, 1, 0, time.Hour)
+	require.NoError(t, err)
+	defer udb.Close()
+
+	_, err = udb.LookupGroup("group2")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, userdb.ErrGroupNotFound)
+}
+
+func TestNestedGroups(t *testing.T) {
+	d := newGroupDirectory(t)
+
+	// each level of nesting is followed up to the depth
+	for depth, groups := range [][]string{
+		{"group1"},
+		{"group1", "group2"},
+		{"group1", "group2", "group3"},
+		{"group1", "group2", "group3"},
+	} {
+		udb := newGroupUserDb(t, d, &userdbldap.Schema{NestedDepth: depth})
+		u, err := udb.LookupUser("user1")
+		require.NoError(t, err)
+		require.Equal(t, groups, u.Groups, "depth %d", depth)
+	}
+
+	// and what's been found is cached
+	udb := newGroupUserDb(t, d, &userdbldap.Schema{NestedDepth: 3})
+	_, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	_, before := d.counts()
+	u, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1", "group2", "group3"}, u.Groups)
+	_, after := d.counts()
+	require.Equal(t, 2, after-before)
+}
+
+func TestGroupCycles(t *testing.T) {
+	d := newGroupDirectory(t)
+
+	// group3 is also in group1, so they go round in circles, and group4 is in itself
+	d.addValue(groupDn("group1"), "member", groupDn("group3"))
+	d.addValue(groupDn("group3"), "memberOf", groupDn("group1"))
+	d.add(groupDn("group4"), map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group4"},
+		"member":      {groupDn("group3"), groupDn("group4")},
+	})
+
+	for _, overrides := range []*userdbldap.Schema{
+		{NestedDepth: 10},
+		{NestedDepth: 10, MemberOfAttr: "memberOf"},
+		{InChain: true},
+	} {
+		udb := newGroupUserDb(t, d, overrides)
+		u, err := udb.LookupUser("user1")
+		require.NoError(t, err)
+		if overrides.MemberOfAttr != "" {
+			// nothing says group4 is in anything
+			require.Equal(t, []string{"group1", "group2", "group3"}, u.Groups)
+		} else {
+			require.Equal(t, []string{"group1", "group2", "group3", "group4"}, u.Groups)
+		}
+	}
+}
+
+func TestMemberOfGroups(t *testing.T) {
+	d := newGroupDirectory(t)
+
+	// the groups come from the memberOf attributes rather than searches
+	//   for the groups' members
+	udb := newGroupUserDb(t, d, &userdbldap.Schema{NestedDepth: 1, MemberOfAttr: "memberOf"})
+	u, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1", "group2"}, u.Groups)
+
+	// groups it can't find are left out
+	d.add("uid=user2,ou=people,dc=example,dc=com", map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"user2"},
+		"memberOf":    {groupDn("group1"), groupDn("missing")},
+	})
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1", "group2"}, u.Groups)
+}
+
+func TestInChainGroups(t *testing.T) {
+	d := newGroupDirectory(t)
+
+	// the directory follows the nesting, however deep it goes
+	udb := newGroupUserDb(t, d, &userdbldap.Schema{InChain: true})
+	_, before := d.counts()
+	u, err := udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1", "group2", "group3"}, u.Groups)
+	_, after := d.counts()
+	require.Equal(t, 2, after-before)
+}
+
+func TestGroupCacheSweep(t *testing.T) {
+	gc := userdbldap.NewGroupCache(100 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		userdbldap.PutGroup(gc, groupDn(fmt.Sprint(i)))
+	}
+	require.Equal(t, 100, userdbldap.CachedGroups(gc))
+
+	// what's expired is dropped the next time it's swept
+	time.Sleep(150 * time.Millisecond)
+	userdbldap.PutGroup(gc, groupDn("new"))
+	require.Equal(t, 1, userdbldap.CachedGroups(gc))
+}
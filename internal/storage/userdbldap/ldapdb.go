@@ -2,43 +2,59 @@ package userdbldap
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
-func NewUserDb(ldapServer string, ldapPort int, searchBase, searchDn, searchPw string, cafile string) (userdb.UserDb, error) {
-	// create the tls config
-	cacert, err := os.ReadFile(cafile)
+// the pool and group cache settings used if they're not configured
+const (
+	defaultPoolSize      = 4
+	defaultIdleTimeout   = 5 * time.Minute
+	defaultGroupCacheTTL = 5 * time.Minute
+)
+
+func NewUserDb(urls []string, failover, searchBase, searchDn, searchPw string, schema *Schema, tlsConfig *tls.Config, poolSize int, idleTimeout, groupCacheTTL time.Duration) (userdb.UserDb, error) {
+	servers, err := newServers(urls, failover, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(cacert)
-
-	tlsConfig := tls.Config{
-		MinVersion: tls.VersionTLS13,
-		RootCAs:    caCertPool,
-		ServerName: ldapServer,
-	}
 
 	// create the struct
 	ldp := ldapDb{
-		server:     fmt.Sprintf("%s:%d", ldapServer, ldapPort),
-		tlsConfig:  &tlsConfig,
+		servers:    servers,
 		searchBase: searchBase,
 		searchDn:   searchDn,
 		searchPw:   searchPw,
+		schema:     schema,
+	}
+
+	// with a client certificate and no search user, bind as the certificate
+	ldp.external = searchDn == "" && len(tlsConfig.Certificates) > 0
+
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
 	}
+	if groupCacheTTL <= 0 {
+		groupCacheTTL = defaultGroupCacheTTL
+	}
+	ldp.groups.ttl = groupCacheTTL
+	ldp.pool = newPool(ldp.searchConn, poolSize, idleTimeout)
 
-	// do a test connection just to make sure it's all ok
-	err = ldp.testBind()
+	// connect and bind to make sure it's all ok
+	err = ldp.pool.withConn(func(l *ldap.Conn) error {
+		return nil
+	})
 	if err != nil {
+		ldp.pool.close()
 		return nil, err
 	}
 
@@ -46,11 +62,14 @@ func NewUserDb(ldapServer string, ldapPort int, searchBase, searchDn, searchPw s
 }
 
 type ldapDb struct {
-	server     string
-	tlsConfig  *tls.Config
+	servers    *servers
+	external   bool
 	searchBase string
 	searchDn   string
 	searchPw   string
+	schema     *Schema
+	pool       *pool
+	groups     groupCache
 }
 
 func (ldp *ldapDb) VerifyUser(userName, userPw string) (*userdb.User, error) {
@@ -73,47 +92,80 @@ func (ldp *ldapDb) LookupUser(userName string) (*userdb.User, error) {
 }
 
 func (ldp *ldapDb) LookupGroup(groupName string) (*userdb.Group, error) {
+	// only a search that finds nothing is a missing group... anything else,
+	//   like the directory being down, mustn't be taken for one
 	group, err := ldp.findGroup(groupName)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w %w", groupName, userdb.ErrGroupNotFound, err)
+		return nil, err
 	}
 	return group, nil
 }
 
-func (ldp *ldapDb) testBind() error {
-	l, err := ldap.Dial("tcp", ldp.server)
-	if err != nil {
-		return err
-	}
-	defer l.Close()
+func (ldp *ldapDb) Close() error {
+	ldp.pool.close()
 	return nil
 }
 
-func (ldp *ldapDb) findUser(userName, userPw string) (*userdb.User, error) {
-	l, err := ldap.Dial("tcp", ldp.server)
+func (ldp *ldapDb) searchConn() (*ldap.Conn, error) {
+	l, err := ldp.servers.dial()
 	if err != nil {
 		return nil, err
 	}
-	defer l.Close()
 
-	// upgrade to tls
-	err = l.StartTLS(ldp.tlsConfig)
+	// bind with the search user
+	if ldp.external {
+		err = l.ExternalBind()
+	} else {
+		err = l.Bind(ldp.searchDn, ldp.searchPw)
+	}
 	if err != nil {
+		l.Close()
 		return nil, err
 	}
+	return l, nil
+}
 
-	// bind with the search user
-	err = l.Bind(ldp.searchDn, ldp.searchPw)
+func (ldp *ldapDb) bindUser(userDn, userPw string) error {
+	// binding changes who the connection is, so it's done on its own one
+	//   rather than one from the pool
+	l, err := ldp.servers.dial()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return l.Bind(userDn, userPw)
+}
+
+func (ldp *ldapDb) findUser(userName, userPw string) (*userdb.User, error) {
+	var user *userdb.User
+	err := ldp.pool.withConn(func(l *ldap.Conn) error {
+		var err error
+		user, err = ldp.searchUser(l, userName)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// check the password if it's given
+	if len(userPw) != 0 {
+		err = ldp.bindUser(user.Dn, userPw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (ldp *ldapDb) searchUser(l *ldap.Conn, userName string) (*userdb.User, error) {
 	// search for the user
 	searchRequest := ldap.NewSearchRequest(
 		ldp.searchBase,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(objectClass=posixAccount)(uid=%s))", userName),
-		[]string{"dn", "uidNumber", "gidNumber", "cn", "sn", "givenName", "mail"},
+		ldp.schema.userFilter(userName),
+		ldp.schema.userAttributes(),
 		nil,
 	)
 
@@ -126,14 +178,6 @@ func (ldp *ldapDb) findUser(userName, userPw string) (*userdb.User, error) {
 	}
 	userDn := sr.Entries[0].DN
 
-	// rebind as the user if the password is given
-	if len(userPw) != 0 {
-		err = l.Bind(userDn, userPw)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	// create the user object
 	user := userdb.User{
 		Dn:        userDn,
@@ -144,84 +188,69 @@ func (ldp *ldapDb) findUser(userName, userPw string) (*userdb.User, error) {
 	}
 
 	for _, attr := range sr.Entries[0].Attributes {
-		switch attr.Name {
-		case "uidNumber":
-			uidNumber, err := strconv.Atoi(attr.Values[0])
-			if err != nil {
-				return nil, err
+		// an attribute can be mapped to more than one field
+		for field, name := range ldp.schema.Attributes {
+			if !strings.EqualFold(attr.Name, name) || len(attr.Values) == 0 {
+				continue
 			}
-			user.UidNumber = uidNumber
-		case "gidNumber":
-			gidNumber, err := strconv.Atoi(attr.Values[0])
-			if err != nil {
-				return nil, err
+			switch field {
+			case FieldId:
+				user.Id = formatId(attr)
+			case FieldUidNumber:
+				uidNumber, err := strconv.Atoi(attr.Values[0])
+				if err != nil {
+					return nil, err
+				}
+				user.UidNumber = uidNumber
+			case FieldGidNumber:
+				gidNumber, err := strconv.Atoi(attr.Values[0])
+				if err != nil {
+					return nil, err
+				}
+				user.GidNumber = gidNumber
+			case FieldFullName:
+				user.FullName = attr.Values[0]
+			case FieldGivenName:
+				user.GivenName = attr.Values[0]
+			case FieldFamilyName:
+				user.FamilyName = attr.Values[0]
+			case FieldEmail:
+				user.Email = attr.Values[0]
 			}
-			user.GidNumber = gidNumber
-		case "cn":
-			user.FullName = attr.Values[0]
-		case "sn":
-			user.FamilyName = attr.Values[0]
-		case "givenName":
-			user.GivenName = attr.Values[0]
-		case "mail":
-			user.Email = attr.Values[0]
 		}
 	}
 
-	// search for the groups the user is part of
-	searchRequest = ldap.NewSearchRequest(
-		ldp.searchBase,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(objectClass=posixGroup)(memberUid=%s))", userName),
-		[]string{"dn", "cn"},
-		nil,
-	)
-	sr, err = l.Search(searchRequest)
+	// the groups the user is part of
+	user.Groups, err = ldp.resolveGroups(l, userName, userDn, sr.Entries[0])
 	if err != nil {
 		return nil, err
 	}
 
-	if len(sr.Entries) > 0 {
-		var groups []string
-		for _, attr := range sr.Entries[0].Attributes {
-			if attr.Name == "cn" {
-				for _, v := range attr.Values {
-					groups = append(groups, v)
-				}
-				break
-			}
-		}
-		user.Groups = groups
-	}
-
 	return &user, nil
 }
 
 func (ldp *ldapDb) findGroup(groupName string) (*userdb.Group, error) {
-	l, err := ldap.Dial("tcp", ldp.server)
-	if err != nil {
-		return nil, err
-	}
-	defer l.Close()
-
-	// upgrade to tls
-	err = l.StartTLS(ldp.tlsConfig)
-	if err != nil {
-		return nil, err
-	}
+	var group *userdb.Group
+	err := ldp.pool.withConn(func(l *ldap.Conn) error {
+		var err error
+		group, err = ldp.searchGroup(l, groupName)
+		return err
+	})
+	return group, err
+}
 
-	// bind with the search user
-	err = l.Bind(ldp.searchDn, ldp.searchPw)
-	if err != nil {
-		return nil, err
+func (ldp *ldapDb) searchGroup(l *ldap.Conn, groupName string) (*userdb.Group, error) {
+	// search for the group
+	attrs := []string{"dn"}
+	gidAttr := ldp.schema.Attributes[FieldGidNumber]
+	if gidAttr != "" {
+		attrs = append(attrs, gidAttr)
 	}
-
-	// search for the user
 	searchRequest := ldap.NewSearchRequest(
 		ldp.searchBase,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(objectClass=posixGroup)(cn=%s))", groupName),
-		[]string{"dn", "gidNumber"},
+		ldp.schema.groupFilter(groupName),
+		attrs,
 		nil,
 	)
 
@@ -229,9 +258,12 @@ func (ldp *ldapDb) findGroup(groupName string) (*userdb.Group, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(sr.Entries) != 1 {
+	if len(sr.Entries) == 0 {
 		return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
 	}
+	if len(sr.Entries) > 1 {
+		return nil, fmt.Errorf("%s: %d groups have the name", groupName, len(sr.Entries))
+	}
 
 	group := &userdb.Group{
 		Dn:        sr.Entries[0].DN,
@@ -240,7 +272,7 @@ func (ldp *ldapDb) findGroup(groupName string) (*userdb.Group, error) {
 	}
 
 	for _, attr := range sr.Entries[0].Attributes {
-		if attr.Name == "gidNumber" {
+		if gidAttr != "" && strings.EqualFold(attr.Name, gidAttr) && len(attr.Values) > 0 {
 			gidNumber, err := strconv.Atoi(attr.Values[0])
 			if err != nil {
 				return nil, err
@@ -252,3 +284,18 @@ func (ldp *ldapDb) findGroup(groupName string) (*userdb.Group, error) {
 
 	return group, nil
 }
+
+func formatId(attr *ldap.EntryAttribute) string {
+	// active directory's objectGUID is a binary value, so format it in the
+	//   usual mixed-endian GUID string form
+	if strings.EqualFold(attr.Name, "objectGUID") && len(attr.ByteValues[0]) == 16 {
+		b := attr.ByteValues[0]
+		return fmt.Sprintf("%x-%x-%x-%x-%x",
+			[]byte{b[3], b[2], b[1], b[0]},
+			[]byte{b[5], b[4]},
+			[]byte{b[7], b[6]},
+			b[8:10],
+			b[10:16])
+	}
+	return attr.Values[0]
+}
@@ -0,0 +1,217 @@
+package userdbldap
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// connections that have been idle this long are checked before they're used
+const healthCheckAfter = 30 * time.Second
+
+// how long to wait for a connection when they're all in use
+const acquireTimeout = 10 * time.Second
+
+var (
+	errPoolExhausted = errors.New("userdbldap: timed out waiting for a connection")
+	errPoolClosed    = errors.New("userdbldap: connection pool is closed")
+)
+
+// a bounded pool of connections bound as the search user
+func newPool(dial func() (*ldap.Conn, error), size int, idleTimeout time.Duration) *pool {
+	p := pool{
+		dial:        dial,
+		idleTimeout: idleTimeout,
+		waitTimeout: acquireTimeout,
+		slots:       make(chan struct{}, size),
+		done:        make(chan struct{}),
+	}
+
+	go p.pruner()
+
+	return &p
+}
+
+type pool struct {
+	dial        func() (*ldap.Conn, error)
+	idleTimeout time.Duration
+	waitTimeout time.Duration
+	slots       chan struct{}
+	done        chan struct{}
+
+	mutex  sync.Mutex
+	idle   []*pooledConn
+	closed bool
+}
+
+type pooledConn struct {
+	conn     *ldap.Conn
+	lastUsed time.Time
+}
+
+// run with a pooled connection, retrying once on a fresh one if it's gone bad
+func (p *pool) withConn(fn func(l *ldap.Conn) error) error {
+	err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { <-p.slots }()
+
+	pc, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = fn(pc.conn)
+	if isNetworkError(err) || pc.conn.IsClosing() {
+		pc.conn.Close()
+
+		pc, err = p.connect()
+		if err != nil {
+			return err
+		}
+		err = fn(pc.conn)
+	}
+	p.put(pc, err)
+
+	return err
+}
+
+func (p *pool) acquire() error {
+	select {
+	case <-p.done:
+		return errPoolClosed
+	default:
+	}
+
+	timer := time.NewTimer(p.waitTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errPoolExhausted
+	case <-p.done:
+		return errPoolClosed
+	}
+}
+
+func (p *pool) get() (*pooledConn, error) {
+	now := time.Now()
+	for {
+		// use the most recently used connection, so the rest can go idle
+		p.mutex.Lock()
+		if len(p.idle) == 0 {
+			p.mutex.Unlock()
+			break
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mutex.Unlock()
+
+		if pc.conn.IsClosing() || now.Sub(pc.lastUsed) > p.idleTimeout {
+			pc.conn.Close()
+			continue
+		}
+		if now.Sub(pc.lastUsed) > healthCheckAfter && !healthy(pc.conn) {
+			pc.conn.Close()
+			continue
+		}
+		return pc, nil
+	}
+
+	return p.connect()
+}
+
+func (p *pool) connect() (*pooledConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{conn: conn}, nil
+}
+
+func (p *pool) put(pc *pooledConn, err error) {
+	if isNetworkError(err) || pc.conn.IsClosing() {
+		pc.conn.Close()
+		return
+	}
+	pc.lastUsed = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		pc.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+// close connections nobody has wanted for a while
+func (p *pool) pruner() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.prune()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pool) prune() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// the oldest are at the front
+	now := time.Now()
+	n := 0
+	for n < len(p.idle) && now.Sub(p.idle[n].lastUsed) > p.idleTimeout {
+		p.idle[n].conn.Close()
+		n++
+	}
+	if n > 0 {
+		log.Debugf("userdbldap: closed %d idle connections", n)
+		p.idle = append(p.idle[:0], p.idle[n:]...)
+	}
+}
+
+func (p *pool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+
+	for _, pc := range p.idle {
+		pc.conn.Close()
+	}
+	p.idle = nil
+}
+
+func healthy(l *ldap.Conn) bool {
+	// read the root DSE, which every server allows
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 5, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+	_, err := l.Search(searchRequest)
+	return err == nil
+}
+
+func isNetworkError(err error) bool {
+	return err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
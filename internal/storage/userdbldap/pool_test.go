@@ -0,0 +1,163 @@
+package userdbldap_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbldap"
+)
+
+func newTestPool(t *testing.T, size int) (*directory, *userdbldap.Pool) {
+	d := newDirectory(t)
+	d.add("cn=search,dc=example,dc=com", map[string][]string{"userPassword": {"secret"}})
+
+	dial := func() (*ldap.Conn, error) {
+		l, err := d.dial()
+		if err != nil {
+			return nil, err
+		}
+		err = l.Bind("cn=search,dc=example,dc=com", "secret")
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	p := userdbldap.NewPool(dial, size, time.Hour, 100*time.Millisecond)
+	t.Cleanup(func() { userdbldap.ClosePool(p) })
+
+	return d, p
+}
+
+func search(l *ldap.Conn) error {
+	searchRequest := ldap.NewSearchRequest(
+		"dc=example,dc=com",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		nil,
+		nil,
+	)
+	_, err := l.Search(searchRequest)
+	return err
+}
+
+func TestPoolBounded(t *testing.T) {
+	d, p := newTestPool(t, 1)
+
+	// hold the only connection
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go userdbldap.WithConn(p, func(l *ldap.Conn) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	// nobody else gets one until it's given back
+	err := userdbldap.WithConn(p, search)
+	require.ErrorIs(t, err, userdbldap.ErrPoolExhausted)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return userdbldap.Idle(p) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and then it's reused
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	dials, _ := d.counts()
+	require.Equal(t, 1, dials)
+}
+
+func TestPoolPrune(t *testing.T) {
+	d, p := newTestPool(t, 2)
+
+	err := userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	require.Equal(t, 1, userdbldap.Idle(p))
+
+	// recently used connections are kept
+	userdbldap.Prune(p)
+	require.Equal(t, 1, userdbldap.Idle(p))
+
+	// and ones nobody wants are closed
+	userdbldap.Age(p, 2*time.Hour)
+	userdbldap.Prune(p)
+	require.Equal(t, 0, userdbldap.Idle(p))
+	require.Eventually(t, func() bool {
+		return d.open() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// closing the pool closes what's idle and stops it being used
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	userdbldap.ClosePool(p)
+	require.Equal(t, 0, userdbldap.Idle(p))
+	require.Eventually(t, func() bool {
+		return d.open() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = userdbldap.WithConn(p, search)
+	require.Error(t, err)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	d, p := newTestPool(t, 2)
+
+	err := userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+
+	// a connection that's been idle a while is checked and reused
+	userdbldap.Age(p, time.Minute)
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	dials, searches := d.counts()
+	require.Equal(t, 1, dials)
+	require.Equal(t, 3, searches)
+
+	// or replaced if it fails the check
+	d.failRootDSE(true)
+	userdbldap.Age(p, time.Minute)
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	dials, searches = d.counts()
+	require.Equal(t, 2, dials)
+	require.Equal(t, 5, searches)
+}
+
+func TestPoolReconnect(t *testing.T) {
+	d, p := newTestPool(t, 2)
+
+	err := userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+
+	// a connection that's lost while it's being used is retried on a new one
+	d.dropNextSearch()
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	dials, searches := d.counts()
+	require.Equal(t, 2, dials)
+	require.Equal(t, 3, searches)
+
+	// one that's lost while idle is replaced
+	d.drop()
+	require.Eventually(t, func() bool {
+		return d.open() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	err = userdbldap.WithConn(p, search)
+	require.NoError(t, err)
+	dials, _ = d.counts()
+	require.Equal(t, 3, dials)
+
+	// and errors from the directory itself aren't retried
+	err = userdbldap.WithConn(p, func(l *ldap.Conn) error {
+		return l.Bind("cn=search,dc=example,dc=com", "wrong")
+	})
+	require.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+	dials, _ = d.counts()
+	require.Equal(t, 3, dials)
+}
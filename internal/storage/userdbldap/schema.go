@@ -0,0 +1,224 @@
+package userdbldap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// how a directory lays out its users and groups
+type Schema struct {
+	UserFilter  string // selects user entries
+	LoginAttr   string // the user attribute matched against the login name
+	GroupFilter string // selects group entries
+	GroupAttr   string // the group attribute holding its name
+	MemberAttr  string // the group attribute listing its members
+	MemberValue string // whether members are listed by login name or dn
+
+	MemberOfAttr string // the user and group attribute listing the groups they're in
+	NestedDepth  int    // how many levels of groups in groups are followed
+	InChain      bool   // let active directory follow the nested groups
+
+	// the user attributes for each of the user fields
+	Attributes map[string]string
+}
+
+// how group members are listed
+const (
+	MemberLogin = "login"
+	MemberDn    = "dn"
+)
+
+// the user fields that can be mapped to attributes
+const (
+	FieldId         = "id"
+	FieldUidNumber  = "uid_number"
+	FieldGidNumber  = "gid_number"
+	FieldFullName   = "full_name"
+	FieldGivenName  = "given_name"
+	FieldFamilyName = "family_name"
+	FieldEmail      = "email"
+)
+
+var fields = []string{FieldId, FieldUidNumber, FieldGidNumber, FieldFullName, FieldGivenName, FieldFamilyName, FieldEmail}
+
+// the deepest groups can be nested
+const maxNestedDepth = 10
+
+// the schema to use if none is configured
+const DefaultSchema = "posix"
+
+// the schemas of the common directory layouts
+var Schemas = map[string]*Schema{
+	// openldap with nis.schema: posixGroup lists its members' uids
+	"posix": {
+		UserFilter:  "(objectClass=posixAccount)",
+		LoginAttr:   "uid",
+		GroupFilter: "(objectClass=posixGroup)",
+		GroupAttr:   "cn",
+		MemberAttr:  "memberUid",
+		MemberValue: MemberLogin,
+		Attributes:  posixAttributes,
+	},
+	// posix accounts with groupOfNames groups listing their members' dns
+	"rfc2307bis": {
+		UserFilter:  "(objectClass=posixAccount)",
+		LoginAttr:   "uid",
+		GroupFilter: "(objectClass=groupOfNames)",
+		GroupAttr:   "cn",
+		MemberAttr:  "member",
+		MemberValue: MemberDn,
+		Attributes:  posixAttributes,
+	},
+	"ad": {
+		UserFilter:  "(&(objectCategory=person)(objectClass=user))",
+		LoginAttr:   "sAMAccountName",
+		GroupFilter: "(objectClass=group)",
+		GroupAttr:   "cn",
+		MemberAttr:  "member",
+		MemberValue: MemberDn,
+		Attributes: map[string]string{
+			FieldId:         "objectGUID",
+			FieldUidNumber:  "uidNumber",
+			FieldGidNumber:  "gidNumber",
+			FieldFullName:   "displayName",
+			FieldGivenName:  "givenName",
+			FieldFamilyName: "sn",
+			FieldEmail:      "mail",
+		},
+	},
+}
+
+var posixAttributes = map[string]string{
+	FieldId:         "entryUUID",
+	FieldUidNumber:  "uidNumber",
+	FieldGidNumber:  "gidNumber",
+	FieldFullName:   "cn",
+	FieldGivenName:  "givenName",
+	FieldFamilyName: "sn",
+	FieldEmail:      "mail",
+}
+
+// the named schema, with anything set in the overrides replacing its settings
+func LoadSchema(name string, overrides *Schema) (*Schema, error) {
+	if name == "" {
+		name = DefaultSchema
+	}
+	preset, ok := Schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ldap schema: %s", name)
+	}
+
+	schema := *preset
+	schema.Attributes = make(map[string]string)
+	for field, attr := range preset.Attributes {
+		schema.Attributes[field] = attr
+	}
+
+	if overrides != nil {
+		override := func(value *string, with string) {
+			if with != "" {
+				*value = with
+			}
+		}
+		override(&schema.UserFilter, overrides.UserFilter)
+		override(&schema.LoginAttr, overrides.LoginAttr)
+		override(&schema.GroupFilter, overrides.GroupFilter)
+		override(&schema.GroupAttr, overrides.GroupAttr)
+		override(&schema.MemberAttr, overrides.MemberAttr)
+		override(&schema.MemberValue, overrides.MemberValue)
+		override(&schema.MemberOfAttr, overrides.MemberOfAttr)
+		if overrides.NestedDepth != 0 {
+			schema.NestedDepth = overrides.NestedDepth
+		}
+		if overrides.InChain {
+			schema.InChain = true
+		}
+
+		for field, attr := range overrides.Attributes {
+			schema.Attributes[field] = attr
+		}
+	}
+
+	// make sure it all makes sense
+	schema.UserFilter = wrapFilter(schema.UserFilter)
+	schema.GroupFilter = wrapFilter(schema.GroupFilter)
+	for _, filter := range []string{schema.UserFilter, schema.GroupFilter} {
+		_, err := ldap.CompileFilter(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ldap filter %s: %w", filter, err)
+		}
+	}
+	if schema.LoginAttr == "" || schema.GroupAttr == "" || schema.MemberAttr == "" {
+		return nil, fmt.Errorf("ldap schema needs login, group and member attributes")
+	}
+	if schema.MemberValue != MemberLogin && schema.MemberValue != MemberDn {
+		return nil, fmt.Errorf("unknown ldap member value: %s", schema.MemberValue)
+	}
+	if schema.NestedDepth < 0 || schema.NestedDepth > maxNestedDepth {
+		return nil, fmt.Errorf("nested group depth must be between 0 and %d", maxNestedDepth)
+	}
+	if schema.InChain && schema.MemberValue != MemberDn {
+		return nil, fmt.Errorf("in chain group matching needs members listed by dn")
+	}
+	for field := range schema.Attributes {
+		known := false
+		for _, f := range fields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown user field: %s", field)
+		}
+	}
+
+	return &schema, nil
+}
+
+func wrapFilter(filter string) string {
+	if filter != "" && !strings.HasPrefix(filter, "(") {
+		return "(" + filter + ")"
+	}
+	return filter
+}
+
+func (s *Schema) userFilter(userName string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", s.UserFilter, s.LoginAttr, ldap.EscapeFilter(userName))
+}
+
+func (s *Schema) memberFilter(userName, userDn string) string {
+	member := userName
+	if s.MemberValue == MemberDn {
+		member = userDn
+	}
+	return fmt.Sprintf("(&%s(%s=%s))", s.GroupFilter, s.MemberAttr, ldap.EscapeFilter(member))
+}
+
+// active directory's LDAP_MATCHING_RULE_IN_CHAIN, which walks nested groups
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+func (s *Schema) inChainFilter(userDn string) string {
+	return fmt.Sprintf("(&%s(%s:%s:=%s))", s.GroupFilter, s.MemberAttr, matchingRuleInChain, ldap.EscapeFilter(userDn))
+}
+
+func (s *Schema) parentFilter(groupDn string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", s.GroupFilter, s.MemberAttr, ldap.EscapeFilter(groupDn))
+}
+
+func (s *Schema) groupFilter(groupName string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", s.GroupFilter, s.GroupAttr, ldap.EscapeFilter(groupName))
+}
+
+// the attributes to fetch for a user
+func (s *Schema) userAttributes() []string {
+	attrs := []string{"dn"}
+	for _, field := range fields {
+		if attr := s.Attributes[field]; attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	if s.MemberOfAttr != "" {
+		attrs = append(attrs, s.MemberOfAttr)
+	}
+	return attrs
+}
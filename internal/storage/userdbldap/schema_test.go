@@ -0,0 +1,90 @@
+package userdbldap_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbldap"
+)
+
+func TestSchemaPresets(t *testing.T) {
+	// posix is the default
+	schema, err := userdbldap.LoadSchema("", nil)
+	require.NoError(t, err)
+	require.Equal(t, "(&(objectClass=posixAccount)(uid=user1))", userdbldap.UserFilter(schema, "user1"))
+	require.Equal(t, "(&(objectClass=posixGroup)(memberUid=user1))", userdbldap.MemberFilter(schema, "user1", "uid=user1,dc=example,dc=com"))
+	require.Equal(t, "(&(objectClass=posixGroup)(cn=group1))", userdbldap.GroupFilter(schema, "group1"))
+
+	schema, err = userdbldap.LoadSchema("rfc2307bis", nil)
+	require.NoError(t, err)
+	require.Equal(t, "(&(objectClass=groupOfNames)(member=uid=user1,dc=example,dc=com))", userdbldap.MemberFilter(schema, "user1", "uid=user1,dc=example,dc=com"))
+
+	schema, err = userdbldap.LoadSchema("ad", nil)
+	require.NoError(t, err)
+	require.Equal(t, "(&(&(objectCategory=person)(objectClass=user))(sAMAccountName=user1))", userdbldap.UserFilter(schema, "user1"))
+	require.Equal(t, "objectGUID", schema.Attributes[userdbldap.FieldId])
+
+	_, err = userdbldap.LoadSchema("unknown", nil)
+	require.Error(t, err)
+}
+
+func TestSchemaOverrides(t *testing.T) {
+	overrides := userdbldap.Schema{
+		UserFilter: "objectClass=inetOrgPerson",
+		Attributes: map[string]string{
+			userdbldap.FieldId:    "uid",
+			userdbldap.FieldEmail: "",
+		},
+	}
+	schema, err := userdbldap.LoadSchema("rfc2307bis", &overrides)
+	require.NoError(t, err)
+	require.Equal(t, "(&(objectClass=inetOrgPerson)(uid=user1))", userdbldap.UserFilter(schema, "user1"))
+	require.Equal(t, "uid", schema.Attributes[userdbldap.FieldId])
+	require.Equal(t, "", schema.Attributes[userdbldap.FieldEmail])
+	require.Equal(t, "sn", schema.Attributes[userdbldap.FieldFamilyName])
+
+	// the presets are left alone
+	require.Equal(t, "entryUUID", userdbldap.Schemas["rfc2307bis"].Attributes[userdbldap.FieldId])
+
+	// and bad settings are caught
+	_, err = userdbldap.LoadSchema("posix", &userdbldap.Schema{UserFilter: "(objectClass=person"})
+	require.Error(t, err)
+	_, err = userdbldap.LoadSchema("posix", &userdbldap.Schema{MemberValue: "uid"})
+	require.Error(t, err)
+	_, err = userdbldap.LoadSchema("posix", &userdbldap.Schema{Attributes: map[string]string{"phone": "telephoneNumber"}})
+	require.Error(t, err)
+}
+
+func TestFilterEscaping(t *testing.T) {
+	schema, err := userdbldap.LoadSchema("posix", nil)
+	require.NoError(t, err)
+
+	// names can't change the filter
+	require.Equal(t, `(&(objectClass=posixAccount)(uid=\2a\29\28uid=\2a))`, userdbldap.UserFilter(schema, "*)(uid=*"))
+	require.Equal(t, `(&(objectClass=posixGroup)(cn=admins\29\28cn=\2a))`, userdbldap.GroupFilter(schema, "admins)(cn=*"))
+
+	schema, err = userdbldap.LoadSchema("ad", nil)
+	require.NoError(t, err)
+	require.Equal(t, `(&(objectClass=group)(member=cn=Smith\5c, John,dc=example,dc=com))`, userdbldap.MemberFilter(schema, "jsmith", `cn=Smith\, John,dc=example,dc=com`))
+}
+
+func TestSchemaNesting(t *testing.T) {
+	overrides := userdbldap.Schema{
+		MemberOfAttr: "memberOf",
+		NestedDepth:  3,
+	}
+	schema, err := userdbldap.LoadSchema("rfc2307bis", &overrides)
+	require.NoError(t, err)
+	require.Equal(t, "(&(objectClass=groupOfNames)(member=cn=group1,dc=example,dc=com))", userdbldap.ParentFilter(schema, "cn=group1,dc=example,dc=com"))
+
+	schema, err = userdbldap.LoadSchema("ad", &userdbldap.Schema{InChain: true})
+	require.NoError(t, err)
+	require.Equal(t, "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=cn=user1,dc=example,dc=com))", userdbldap.InChainFilter(schema, "cn=user1,dc=example,dc=com"))
+
+	// posix groups list logins, so the directory can't chain them
+	_, err = userdbldap.LoadSchema("posix", &userdbldap.Schema{InChain: true})
+	require.Error(t, err)
+	_, err = userdbldap.LoadSchema("ad", &userdbldap.Schema{NestedDepth: 100})
+	require.Error(t, err)
+}
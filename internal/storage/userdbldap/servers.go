@@ -0,0 +1,187 @@
+package userdbldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// how the servers are chosen
+const (
+	FailoverOrdered    = "ordered"     // the first that's up
+	FailoverRoundRobin = "round_robin" // spread across all that are up
+)
+
+// servers that fail this many times in a row are left alone for a while
+const (
+	dialTimeout      = 10 * time.Second
+	breakerThreshold = 3
+	breakerCooldown  = 30 * time.Second
+)
+
+// the tls settings for the directory, trusting the system's roots if there's
+// no ca file, and with a client certificate if one's given
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		MinVersion: tls.VersionTLS13,
+	}
+	if caFile != "" {
+		cacert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(cacert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &tlsConfig, nil
+}
+
+type server struct {
+	url    string
+	host   string
+	scheme string
+
+	failures  int
+	openUntil time.Time
+}
+
+type servers struct {
+	tlsConfig  *tls.Config
+	roundRobin bool
+
+	mutex sync.Mutex
+	list  []*server
+	next  int
+}
+
+func newServers(urls []string, failover string, tlsConfig *tls.Config) (*servers, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no ldap servers")
+	}
+
+	ss := servers{
+		tlsConfig: tlsConfig,
+	}
+	switch failover {
+	case "", FailoverOrdered:
+	case FailoverRoundRobin:
+		ss.roundRobin = true
+	default:
+		return nil, fmt.Errorf("unknown ldap failover mode: %s", failover)
+	}
+
+	for _, u := range urls {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ldap url %s: %w", u, err)
+		}
+		if pu.Scheme != "ldap" && pu.Scheme != "ldaps" {
+			return nil, fmt.Errorf("unsupported ldap url scheme: %s", u)
+		}
+		if pu.Hostname() == "" {
+			return nil, fmt.Errorf("no host in ldap url: %s", u)
+		}
+		ss.list = append(ss.list, &server{
+			url:    u,
+			host:   pu.Hostname(),
+			scheme: pu.Scheme,
+		})
+	}
+
+	return &ss, nil
+}
+
+// connect to the first server that will have us
+func (ss *servers) dial() (*ldap.Conn, error) {
+	var lastErr error
+	for _, srv := range ss.order() {
+		l, err := ss.connect(srv)
+		ss.record(srv, err)
+		if err == nil {
+			return l, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no ldap server available: %w", lastErr)
+}
+
+func (ss *servers) order() []*server {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	start := 0
+	if ss.roundRobin {
+		start = ss.next
+		ss.next = (ss.next + 1) % len(ss.list)
+	}
+
+	// servers that keep failing go to the back, so they're only tried if
+	//   nothing else works
+	now := time.Now()
+	var up, down []*server
+	for i := range ss.list {
+		srv := ss.list[(start+i)%len(ss.list)]
+		if now.Before(srv.openUntil) {
+			down = append(down, srv)
+		} else {
+			up = append(up, srv)
+		}
+	}
+	return append(up, down...)
+}
+
+func (ss *servers) connect(srv *server) (*ldap.Conn, error) {
+	l, err := ldap.DialURL(srv.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: dialTimeout}),
+		ldap.DialWithTLSConfig(ss.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	// plain ldap is always upgraded to tls
+	if srv.scheme == "ldap" {
+		tlsConfig := ss.tlsConfig.Clone()
+		tlsConfig.ServerName = srv.host
+		err = l.StartTLS(tlsConfig)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (ss *servers) record(srv *server, err error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if err == nil {
+		srv.failures = 0
+		srv.openUntil = time.Time{}
+		return
+	}
+
+	srv.failures++
+	if srv.failures >= breakerThreshold {
+		srv.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
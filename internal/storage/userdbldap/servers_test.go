@@ -0,0 +1,135 @@
+package userdbldap_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbldap"
+)
+
+func TestServerOrder(t *testing.T) {
+	urls := []string{"ldap://ldap1.example.com", "ldaps://ldap2.example.com:636", "ldap://ldap3.example.com:389"}
+
+	// ordered always starts at the top
+	ss, err := userdbldap.NewServers(urls, userdbldap.FailoverOrdered)
+	require.NoError(t, err)
+	require.Equal(t, urls, userdbldap.Order(ss))
+	require.Equal(t, urls, userdbldap.Order(ss))
+
+	// round robin moves along each time
+	ss, err = userdbldap.NewServers(urls, userdbldap.FailoverRoundRobin)
+	require.NoError(t, err)
+	require.Equal(t, urls, userdbldap.Order(ss))
+	require.Equal(t, []string{urls[1], urls[2], urls[0]}, userdbldap.Order(ss))
+	require.Equal(t, []string{urls[2], urls[0], urls[1]}, userdbldap.Order(ss))
+	require.Equal(t, urls, userdbldap.Order(ss))
+
+	// and bad settings are caught
+	_, err = userdbldap.NewServers(nil, userdbldap.FailoverOrdered)
+	require.Error(t, err)
+	_, err = userdbldap.NewServers(urls, "random")
+	require.Error(t, err)
+	_, err = userdbldap.NewServers([]string{"http://ldap.example.com"}, "")
+	require.Error(t, err)
+	_, err = userdbldap.NewServers([]string{"ldap://"}, "")
+	require.Error(t, err)
+}
+
+func TestServerBreaker(t *testing.T) {
+	urls := []string{"ldap://ldap1.example.com", "ldap://ldap2.example.com", "ldap://ldap3.example.com"}
+
+	ss, err := userdbldap.NewServers(urls, userdbldap.FailoverOrdered)
+	require.NoError(t, err)
+
+	// a server that keeps failing goes to the back
+	failed := errors.New("failed")
+	userdbldap.Record(ss, urls[0], failed)
+	userdbldap.Record(ss, urls[0], failed)
+	require.Equal(t, urls, userdbldap.Order(ss))
+	userdbldap.Record(ss, urls[0], failed)
+	require.Equal(t, []string{urls[1], urls[2], urls[0]}, userdbldap.Order(ss))
+
+	// and comes back to the front once it works
+	userdbldap.Record(ss, urls[0], nil)
+	require.Equal(t, urls, userdbldap.Order(ss))
+
+	// a success resets the count
+	userdbldap.Record(ss, urls[1], failed)
+	userdbldap.Record(ss, urls[1], failed)
+	userdbldap.Record(ss, urls[1], nil)
+	userdbldap.Record(ss, urls[1], failed)
+	require.Equal(t, urls, userdbldap.Order(ss))
+}
+
+func TestServerDial(t *testing.T) {
+	urls := []string{fmt.Sprintf("ldap://%s", closedPort(t)), fmt.Sprintf("ldaps://%s", closedPort(t))}
+
+	ss, err := userdbldap.NewServers(urls, userdbldap.FailoverOrdered)
+	require.NoError(t, err)
+
+	// nothing's listening, so every server is tried and they're all marked down
+	for i := 0; i < 3; i++ {
+		require.Error(t, userdbldap.Dial(ss))
+	}
+	require.Equal(t, urls, userdbldap.Order(ss))
+
+	// but they're still tried when there's nothing else
+	require.Error(t, userdbldap.Dial(ss))
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	d := newDirectory(t)
+
+	// the ca file is trusted
+	tlsConfig, err := userdbldap.NewTLSConfig(d.caFile, "", "")
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig.RootCAs)
+	l, err := ldap.DialURL(d.url, ldap.DialWithTLSConfig(tlsConfig))
+	require.NoError(t, err)
+	l.Close()
+
+	// without one it's the system's roots, which don't know the directory
+	tlsConfig, err = userdbldap.NewTLSConfig("", "", "")
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig.RootCAs)
+	require.Empty(t, tlsConfig.Certificates)
+	_, err = ldap.DialURL(d.url, ldap.DialWithTLSConfig(tlsConfig))
+	require.Error(t, err)
+
+	// ca files that are missing or have no certificates are errors
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	err = os.WriteFile(empty, []byte("no certificates here\n"), 0600)
+	require.NoError(t, err)
+	for _, caFile := range []string{empty, filepath.Join(t.TempDir(), "missing.pem")} {
+		_, err = userdbldap.NewTLSConfig(caFile, "", "")
+		require.Error(t, err)
+	}
+
+	// the client certificate is loaded with its key
+	_, certFile, keyFile := selfSigned(t)
+	tlsConfig, err = userdbldap.NewTLSConfig(d.caFile, certFile, keyFile)
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.Certificates, 1)
+
+	// and has to have one that matches
+	_, _, otherKeyFile := selfSigned(t)
+	for _, files := range [][]string{{certFile, ""}, {"", keyFile}, {certFile, otherKeyFile}} {
+		_, err = userdbldap.NewTLSConfig(d.caFile, files[0], files[1])
+		require.Error(t, err)
+	}
+}
+
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
@@ -0,0 +1,67 @@
+package userdbsql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// the schema changes, applied in order and counted in user_version, so only append
+var migrations = []string{
+	`
+	CREATE TABLE users (
+		pk          INTEGER PRIMARY KEY,
+		id          TEXT UNIQUE,
+		name        TEXT NOT NULL UNIQUE,
+		uid_number  INTEGER NOT NULL DEFAULT -1,
+		gid_number  INTEGER NOT NULL DEFAULT -1,
+		password    TEXT NOT NULL DEFAULT '',
+		full_name   TEXT NOT NULL DEFAULT '',
+		given_name  TEXT NOT NULL DEFAULT '',
+		family_name TEXT NOT NULL DEFAULT '',
+		email       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE groups (
+		pk         INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL UNIQUE,
+		gid_number INTEGER NOT NULL DEFAULT -1
+	);
+	CREATE TABLE memberships (
+		user_pk  INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+		group_pk INTEGER NOT NULL REFERENCES groups(pk) ON DELETE CASCADE,
+		PRIMARY KEY (user_pk, group_pk)
+	);
+	CREATE INDEX memberships_group ON memberships(group_pk);
+	`,
+}
+
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
+
+	// pragmas can't take parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,126 @@
+package userdbsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+func NewUserDb(path string) (userdb.UserDb, error) {
+	// foreign keys are off by default in sqlite, and wait rather than fail if
+	//   something else has the database locked... the path is escaped so any '?'
+	//   or '#' in it isn't taken as part of the query
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", url.PathEscape(path))
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// bring the schema up to date
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate user database: %w", err)
+	}
+
+	return &sqlDb{db: db}, nil
+}
+
+type sqlDb struct {
+	db *sql.DB
+}
+
+func (sdb *sqlDb) VerifyUser(userName, password string) (*userdb.User, error) {
+	user, hash, err := sdb.findUser(userName)
+	if err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	return user, nil
+}
+
+func (sdb *sqlDb) LookupUser(userName string) (*userdb.User, error) {
+	user, _, err := sdb.findUser(userName)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (sdb *sqlDb) LookupGroup(groupName string) (*userdb.Group, error) {
+	group := userdb.Group{
+		Name: groupName,
+	}
+
+	row := sdb.db.QueryRow("SELECT gid_number FROM groups WHERE name = ?", groupName)
+	err := row.Scan(&group.GidNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (sdb *sqlDb) Close() error {
+	return sdb.db.Close()
+}
+
+func (sdb *sqlDb) findUser(userName string) (*userdb.User, string, error) {
+	user := userdb.User{
+		Name:     userName,
+		Password: "redacted",
+	}
+
+	var pk int64
+	var id sql.NullString
+	var hash string
+
+	row := sdb.db.QueryRow(`
+		SELECT pk, id, uid_number, gid_number, password, full_name, given_name, family_name, email
+		FROM users WHERE name = ?`, userName)
+	err := row.Scan(&pk, &id, &user.UidNumber, &user.GidNumber, &hash,
+		&user.FullName, &user.GivenName, &user.FamilyName, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	user.Id = id.String
+
+	// the groups the user is a member of
+	rows, err := sdb.db.Query(`
+		SELECT g.name FROM groups g JOIN memberships m ON m.group_pk = g.pk
+		WHERE m.user_pk = ? ORDER BY g.name`, pk)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, "", err
+		}
+		user.Groups = append(user.Groups, name)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &user, hash, nil
+}
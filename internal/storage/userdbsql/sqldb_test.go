@@ -0,0 +1,103 @@
+package userdbsql_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbsql"
+)
+
+func TestUserDb(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "users.db")
+
+	// creating the database creates the schema
+	udb, err := userdbsql.NewUserDb(dbpath)
+	require.NoError(t, err)
+
+	populate(t, dbpath)
+
+	// test successful attempts
+	{
+		u, err := udb.VerifyUser("user1", "password1")
+		require.NoError(t, err)
+		require.Equal(t, "user1", u.Name)
+		require.Equal(t, "4b9c1d1e-0000-4000-8000-000000000001", u.Id)
+		require.Equal(t, 1001, u.UidNumber)
+		require.Equal(t, "user1@example.com", u.Email)
+		require.Equal(t, []string{"group1", "group2"}, u.Groups)
+		require.Equal(t, "redacted", u.Password)
+
+		u, err = udb.LookupUser("user2")
+		require.NoError(t, err)
+		require.Equal(t, "", u.Id)
+		require.Equal(t, -1, u.UidNumber)
+		require.Equal(t, []string{"group2"}, u.Groups)
+
+		g, err := udb.LookupGroup("group1")
+		require.NoError(t, err)
+		require.Equal(t, 2001, g.GidNumber)
+	}
+
+	// test failures
+	{
+		u, err := udb.VerifyUser("user1", "incorrect-password")
+		require.ErrorIs(t, err, userdb.ErrUserNotFound)
+		require.Nil(t, u)
+
+		u, err = udb.LookupUser("non-existing-user")
+		require.ErrorIs(t, err, userdb.ErrUserNotFound)
+		require.Nil(t, u)
+
+		g, err := udb.LookupGroup("non-existing-group")
+		require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+		require.Nil(t, g)
+	}
+
+	// reopening an up to date database leaves it alone
+	udb, err = userdbsql.NewUserDb(dbpath)
+	require.NoError(t, err)
+	_, err = udb.VerifyUser("user2", "password2")
+	require.NoError(t, err)
+}
+
+func populate(t *testing.T, dbpath string) {
+	db, err := sql.Open("sqlite", dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	stmts := []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO users (pk, id, name, uid_number, gid_number, password, email) VALUES (1, ?, 'user1', 1001, 1001, ?, 'user1@example.com')`,
+			[]any{"4b9c1d1e-0000-4000-8000-000000000001", hash(t, "password1")}},
+		{`INSERT INTO users (pk, name, password) VALUES (2, 'user2', ?)`,
+			[]any{hash(t, "password2")}},
+		{`INSERT INTO groups (pk, name, gid_number) VALUES (1, 'group1', 2001), (2, 'group2', 2002)`, nil},
+		{`INSERT INTO memberships (user_pk, group_pk) VALUES (1, 2), (1, 1), (2, 2)`, nil},
+	}
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt.query, stmt.args...)
+		require.NoError(t, err)
+	}
+}
+
+func hash(t *testing.T, password string) string {
+	crypt_pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(crypt_pw)
+}
+
+func TestUserDbPath(t *testing.T) {
+	// characters that mean something in a uri stay in the file name
+	dbpath := filepath.Join(t.TempDir(), "my users?mode=ro#1.db")
+
+	_, err := userdbsql.NewUserDb(dbpath)
+	require.NoError(t, err)
+	require.FileExists(t, dbpath)
+}
@@ -0,0 +1,161 @@
+package userdbunix
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/filewatch"
+	"github.com/parlaynu/studio1767-idp/internal/storage/pwhash"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+type account struct {
+	user    userdb.User
+	hash    string
+	expires time.Time // never if zero
+}
+
+type index struct {
+	users  map[string]*account
+	groups map[string]*userdb.Group
+}
+
+// the users and groups read from a set of files, reread when they change
+type fileDb struct {
+	paths   []string
+	read    func() (*index, error)
+	watcher *filewatch.Watcher
+
+	mutex    sync.RWMutex
+	index    *index
+	onChange []func(userNames, groupNames []string)
+}
+
+func newFileDb(paths []string, read func() (*index, error)) (*fileDb, error) {
+	fdb := fileDb{
+		read: read,
+	}
+	for _, path := range paths {
+		if path != "" {
+			fdb.paths = append(fdb.paths, filepath.Clean(path))
+		}
+	}
+
+	var err error
+	fdb.index, err = read()
+	if err != nil {
+		return nil, err
+	}
+
+	// pick up changes made to the files by anything else
+	fdb.watcher, err = filewatch.New(fdb.paths, fdb.reload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch user db: %w", err)
+	}
+
+	return &fdb, nil
+}
+
+func (fdb *fileDb) VerifyUser(userName, password string) (*userdb.User, error) {
+	fdb.mutex.RLock()
+	acct, ok := fdb.index.users[userName]
+	fdb.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	if !acct.expires.IsZero() && !time.Now().Before(acct.expires) {
+		return nil, fmt.Errorf("%s: account expired: %w", userName, userdb.ErrUserNotFound)
+	}
+	err := pwhash.Verify(acct.hash, password)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	return acct.copyUser(), nil
+}
+
+func (fdb *fileDb) LookupUser(userName string) (*userdb.User, error) {
+	fdb.mutex.RLock()
+	defer fdb.mutex.RUnlock()
+
+	acct, ok := fdb.index.users[userName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	}
+	return acct.copyUser(), nil
+}
+
+func (fdb *fileDb) LookupGroup(groupName string) (*userdb.Group, error) {
+	fdb.mutex.RLock()
+	defer fdb.mutex.RUnlock()
+
+	group, ok := fdb.index.groups[groupName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+	}
+	cgroup := *group
+	return &cgroup, nil
+}
+
+func (fdb *fileDb) Close() error {
+	return fdb.watcher.Close()
+}
+
+func (fdb *fileDb) OnChange(fn func(userNames, groupNames []string)) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+
+	fdb.onChange = append(fdb.onChange, fn)
+}
+
+func (acct *account) copyUser() *userdb.User {
+	user := acct.user
+	user.Password = "redacted"
+	user.Groups = append([]string{}, acct.user.Groups...)
+	return &user
+}
+
+// add the groups to the users that are in them
+func (idx *index) addMembers(members map[string][]string) {
+	for groupName, userNames := range members {
+		for _, userName := range userNames {
+			acct, ok := idx.users[userName]
+			if !ok {
+				continue
+			}
+			found := false
+			for _, g := range acct.user.Groups {
+				found = found || g == groupName
+			}
+			if !found {
+				acct.user.Groups = append(acct.user.Groups, groupName)
+			}
+		}
+	}
+	for _, acct := range idx.users {
+		sort.Strings(acct.user.Groups)
+	}
+}
+
+func (fdb *fileDb) reload() {
+	// keep using what we have if the files are broken
+	idx, err := fdb.read()
+	if err != nil {
+		log.Errorf("userdbunix: failed to reload %v: %v", fdb.paths, err)
+		return
+	}
+
+	fdb.mutex.Lock()
+	fdb.index = idx
+	for _, fn := range fdb.onChange {
+		fn(nil, nil)
+	}
+	fdb.mutex.Unlock()
+
+	log.Infof("userdbunix: reloaded %v", fdb.paths)
+}
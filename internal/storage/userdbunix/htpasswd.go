@@ -0,0 +1,86 @@
+package userdbunix
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/pwhash"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+// users from an apache htpasswd file, with their groups from an htgroup file
+// if one is given
+func NewHtpasswdDb(htpasswdPath, htgroupPath string) (userdb.UserDb, error) {
+	read := func() (*index, error) {
+		return readHtpasswd(htpasswdPath, htgroupPath)
+	}
+	return newFileDb([]string{htpasswdPath, htgroupPath}, read)
+}
+
+func readHtpasswd(htpasswdPath, htgroupPath string) (*index, error) {
+	idx := index{
+		users:  make(map[string]*account),
+		groups: make(map[string]*userdb.Group),
+	}
+
+	// name:hash
+	err := readLines(htpasswdPath, 2, func(fields []string) error {
+		// there's no locking accounts in htpasswd files, so users that can
+		//   never log in are left out rather than being found by lookups
+		if !pwhash.Supported(fields[1]) {
+			log.Warnf("userdbunix: skipping %s in %s: unsupported password hash", fields[0], htpasswdPath)
+			return nil
+		}
+		idx.users[fields[0]] = &account{
+			user: userdb.User{
+				Id:        fields[0],
+				Name:      fields[0],
+				UidNumber: -1,
+				GidNumber: -1,
+			},
+			hash: fields[1],
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// group: member member...
+	members := make(map[string][]string)
+	if htgroupPath != "" {
+		fh, err := os.Open(htgroupPath)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+
+		scanner := bufio.NewScanner(fh)
+		for lineno := 1; scanner.Scan(); lineno++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			name, list, ok := strings.Cut(line, ":")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%s:%d: malformed entry", htgroupPath, lineno)
+			}
+			idx.groups[name] = &userdb.Group{
+				Name:      name,
+				GidNumber: -1,
+			}
+			members[name] = append(members[name], strings.Fields(list)...)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	idx.addMembers(members)
+
+	return &idx, nil
+}
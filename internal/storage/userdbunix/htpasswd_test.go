@@ -0,0 +1,56 @@
+package userdbunix_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbunix"
+)
+
+func TestHtpasswdDb(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := writeFile(t, dir, "htpasswd", `# users
+user1:`+bcryptHash+`
+user2:`+argon2idHash+`
+user3:$apr1$salt$hash
+`)
+	htgroup := writeFile(t, dir, "htgroup", `staff: user1 user2
+admins:user2
+empty:
+`)
+
+	udb, err := userdbunix.NewHtpasswdDb(htpasswd, htgroup)
+	require.NoError(t, err)
+
+	u, err := udb.VerifyUser("user1", "password")
+	require.NoError(t, err)
+	require.Equal(t, "user1", u.Id)
+	require.Equal(t, -1, u.UidNumber)
+	require.Equal(t, []string{"staff"}, u.Groups)
+
+	u, err = udb.VerifyUser("user2", "password")
+	require.NoError(t, err)
+	require.Equal(t, []string{"admins", "staff"}, u.Groups)
+
+	_, err = udb.VerifyUser("user1", "wrong")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// users with unsupported hashes are left out
+	_, err = udb.VerifyUser("user3", "password")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	_, err = udb.LookupUser("user3")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	g, err := udb.LookupGroup("empty")
+	require.NoError(t, err)
+	require.Equal(t, -1, g.GidNumber)
+
+	// the group file is optional
+	udb, err = userdbunix.NewHtpasswdDb(htpasswd, "")
+	require.NoError(t, err)
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Empty(t, u.Groups)
+}
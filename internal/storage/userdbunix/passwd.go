@@ -0,0 +1,149 @@
+package userdbunix
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+)
+
+// users from passwd(5) style files, with their passwords from shadow(5) and
+// their groups from group(5) if those are given
+func NewPasswdDb(passwdPath, shadowPath, groupPath string) (userdb.UserDb, error) {
+	read := func() (*index, error) {
+		return readPasswd(passwdPath, shadowPath, groupPath)
+	}
+	return newFileDb([]string{passwdPath, shadowPath, groupPath}, read)
+}
+
+func readPasswd(passwdPath, shadowPath, groupPath string) (*index, error) {
+	idx := index{
+		users:  make(map[string]*account),
+		groups: make(map[string]*userdb.Group),
+	}
+
+	// name:password:uid:gid:gecos:home:shell
+	err := readLines(passwdPath, 7, func(fields []string) error {
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid uid for %s: %w", fields[0], err)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("invalid gid for %s: %w", fields[0], err)
+		}
+
+		// the full name is the first of the gecos fields
+		fullName, _, _ := strings.Cut(fields[4], ",")
+
+		// the uid stays the same if the user is renamed
+		idx.users[fields[0]] = &account{
+			user: userdb.User{
+				Id:        strconv.Itoa(uid),
+				Name:      fields[0],
+				UidNumber: uid,
+				GidNumber: gid,
+				FullName:  fullName,
+			},
+			hash: fields[1],
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// name:password:lastchange:min:max:warn:inactive:expire:reserved
+	if shadowPath != "" {
+		err = readLines(shadowPath, 9, func(fields []string) error {
+			acct, ok := idx.users[fields[0]]
+			if !ok {
+				return nil
+			}
+			acct.hash = fields[1]
+
+			// the account expires at the start of the day... like an empty field,
+			//   0 is no expiry, rather than the first day of 1970
+			if fields[7] != "" && fields[7] != "0" {
+				days, err := strconv.ParseInt(fields[7], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid expiry for %s: %w", fields[0], err)
+				}
+				acct.expires = time.Unix(days*24*60*60, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// name:password:gid:members
+	members := make(map[string][]string)
+	if groupPath != "" {
+		gids := make(map[int]string)
+		err = readLines(groupPath, 4, func(fields []string) error {
+			gid, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return fmt.Errorf("invalid gid for %s: %w", fields[0], err)
+			}
+			idx.groups[fields[0]] = &userdb.Group{
+				Name:      fields[0],
+				GidNumber: gid,
+			}
+			if _, ok := gids[gid]; !ok {
+				gids[gid] = fields[0]
+			}
+			if fields[3] != "" {
+				members[fields[0]] = append(members[fields[0]], strings.Split(fields[3], ",")...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// users are always in their primary group
+		for _, acct := range idx.users {
+			if name, ok := gids[acct.user.GidNumber]; ok {
+				acct.user.Groups = append(acct.user.Groups, name)
+			}
+		}
+	}
+	idx.addMembers(members)
+
+	return &idx, nil
+}
+
+// call the handler with the fields of each entry in the file
+func readLines(path string, nfields int, handler func(fields []string) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// skip comments and the nis compat entries
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != nfields || fields[0] == "" {
+			return fmt.Errorf("%s:%d: malformed entry", path, lineno)
+		}
+		err := handler(fields)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,152 @@
+package userdbunix_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
+	"github.com/parlaynu/studio1767-idp/internal/storage/userdbunix"
+)
+
+// hashes of "password"
+const (
+	sha512Hash    = "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+	yescryptHash  = "$y$j9T$abcdefghijklmnop$7asOTx5b6Exfl3myM6K0pLBn.I2hsEvu7G0F7NMfaO."
+	bcryptHash    = "$2y$05$abcdefghijklmnopqrstuuWG29KuyeAicPCJODk1zjyGvyQUU2awu"
+	argon2idHash  = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	passwdContent = `# users
+root:x:0:0:root:/root:/bin/bash
+user1:x:1001:1001:User One,,,:/home/user1:/bin/bash
+user2:x:1002:100:User Two:/home/user2:/bin/bash
+user3:x:1003:100::/home/user3:/bin/sh
+user4:x:1004:100::/home/user4:/bin/sh
++@netgroup::::::
+`
+	shadowContent = `root:!:19000:0:99999:7:::
+user1:` + sha512Hash + `:19000:0:99999:7::0:
+user2:` + yescryptHash + `:19000:0:99999:7:::
+user3:` + sha512Hash + `:19000:0:99999:7::1:
+user4:!` + sha512Hash + `:19000:0:99999:7:::
+`
+	groupContent = `root:x:0:
+users:x:100:
+user1:x:1001:
+staff:x:2001:user1,user2
+admins:x:2002:user2
+`
+)
+
+func TestPasswdDb(t *testing.T) {
+	dir := t.TempDir()
+	passwd := writeFile(t, dir, "passwd", passwdContent)
+	shadow := writeFile(t, dir, "shadow", shadowContent)
+	group := writeFile(t, dir, "group", groupContent)
+
+	udb, err := userdbunix.NewPasswdDb(passwd, shadow, group)
+	require.NoError(t, err)
+
+	// sha512-crypt and yescrypt passwords
+	u, err := udb.VerifyUser("user1", "password")
+	require.NoError(t, err)
+	require.Equal(t, "1001", u.Id)
+	require.Equal(t, 1001, u.UidNumber)
+	require.Equal(t, 1001, u.GidNumber)
+	require.Equal(t, "User One", u.FullName)
+	require.Equal(t, "redacted", u.Password)
+	require.Equal(t, []string{"staff", "user1"}, u.Groups)
+
+	u, err = udb.VerifyUser("user2", "password")
+	require.NoError(t, err)
+	require.Equal(t, []string{"admins", "staff", "users"}, u.Groups)
+
+	_, err = udb.VerifyUser("user2", "wrong")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// locked and expired accounts can't log in, but can be looked up
+	for _, name := range []string{"root", "user3", "user4"} {
+		_, err = udb.VerifyUser(name, "password")
+		require.ErrorIs(t, err, userdb.ErrUserNotFound, name)
+		_, err = udb.LookupUser(name)
+		require.NoError(t, err, name)
+	}
+
+	_, err = udb.LookupUser("user5")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	g, err := udb.LookupGroup("staff")
+	require.NoError(t, err)
+	require.Equal(t, 2001, g.GidNumber)
+	_, err = udb.LookupGroup("nogroup")
+	require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+
+	// callers can't change what's loaded
+	u, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	u.Groups[0] = "changed"
+	u, err = udb.LookupUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"staff", "user1"}, u.Groups)
+}
+
+func TestPasswdDbNoShadow(t *testing.T) {
+	dir := t.TempDir()
+	passwd := writeFile(t, dir, "passwd", "user1:"+yescryptHash+":1001:1001::/home/user1:/bin/sh\n")
+
+	udb, err := userdbunix.NewPasswdDb(passwd, "", "")
+	require.NoError(t, err)
+
+	u, err := udb.VerifyUser("user1", "password")
+	require.NoError(t, err)
+	require.Empty(t, u.Groups)
+}
+
+func TestPasswdDbMalformed(t *testing.T) {
+	dir := t.TempDir()
+	group := writeFile(t, dir, "group", groupContent)
+
+	for _, content := range []string{"user1:x:1001\n", "user1:x:abc:1001::/:/bin/sh\n"} {
+		passwd := writeFile(t, dir, "passwd", content)
+		_, err := userdbunix.NewPasswdDb(passwd, "", group)
+		require.Error(t, err)
+	}
+
+	_, err := userdbunix.NewPasswdDb(filepath.Join(dir, "missing"), "", "")
+	require.Error(t, err)
+}
+
+func TestPasswdDbReload(t *testing.T) {
+	dir := t.TempDir()
+	passwd := writeFile(t, dir, "passwd", passwdContent)
+	shadow := writeFile(t, dir, "shadow", shadowContent)
+	group := writeFile(t, dir, "group", groupContent)
+
+	udb, err := userdbunix.NewPasswdDb(passwd, shadow, group)
+	require.NoError(t, err)
+
+	// replace the group file the way the shadow tools do
+	ngroup := writeFile(t, dir, "ngroup", groupContent+"vpn:x:2003:user1\n")
+	require.NoError(t, os.Rename(ngroup, group))
+
+	require.Eventually(t, func() bool {
+		u, err := udb.LookupUser("user1")
+		return err == nil && len(u.Groups) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a broken file is ignored
+	writeFile(t, dir, "passwd", "broken\n")
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = udb.VerifyUser("user1", "password")
+	require.NoError(t, err)
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	require.NoError(t, err)
+	return path
+}
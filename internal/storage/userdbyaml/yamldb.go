@@ -3,37 +3,40 @@ package userdbyaml
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 
+	"github.com/parlaynu/studio1767-idp/internal/config"
+	"github.com/parlaynu/studio1767-idp/internal/storage/filewatch"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 )
 
-func NewUserDb(path string) (userdb.UserDb, error) {
-	// load the config
-	fh, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer fh.Close()
+// the uid given to new users that don't have one
+const firstUid = 1000
 
-	decoder := yaml.NewDecoder(fh)
+// the subject is the token subject mode, as the uids are only required when they're the subject
+func NewUserDb(path, subject string) (userdb.WritableUserDb, error) {
+	ydb := yamlDb{
+		path:    filepath.Clean(path),
+		subject: subject,
+	}
 
-	var usercfg userConfig
-	err = decoder.Decode(&usercfg)
+	usercfg, _, err := ydb.read()
 	if err != nil {
 		return nil, err
 	}
+	ydb.users, ydb.groups = index(usercfg)
 
-	ydb := yamlDb{}
-	ydb.users = make(map[string]userdb.User)
-	ydb.groups = make(map[string]userdb.Group)
-	for _, user := range usercfg.Users {
-		ydb.users[user.Name] = user
-	}
-	for _, group := range usercfg.Groups {
-		ydb.groups[group.Name] = group
+	// pick up changes made to the file by anything else
+	ydb.watcher, err = filewatch.New([]string{ydb.path}, ydb.reload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch user db: %w", err)
 	}
 
 	return &ydb, nil
@@ -44,13 +47,48 @@ type userConfig struct {
 	Groups []userdb.Group `yaml:"groups"`
 }
 
+// what's written back to the file... the optional fields are left out when
+// they're empty, so saving doesn't fill every entry with blank values, and
+// the dn, which is only for directories, is never written
+type fileConfig struct {
+	Users  []fileUser  `yaml:"users,omitempty"`
+	Groups []fileGroup `yaml:"groups,omitempty"`
+}
+
+type fileUser struct {
+	Name       string   `yaml:"name"`
+	Id         string   `yaml:"id,omitempty"`
+	UidNumber  int      `yaml:"uid,omitempty"`
+	GidNumber  int      `yaml:"gid,omitempty"`
+	Password   string   `yaml:"password,omitempty"`
+	FullName   string   `yaml:"full_name,omitempty"`
+	GivenName  string   `yaml:"given_name,omitempty"`
+	FamilyName string   `yaml:"family_name,omitempty"`
+	Email      string   `yaml:"email,omitempty"`
+	Groups     []string `yaml:"groups,omitempty"`
+}
+
+type fileGroup struct {
+	Name      string `yaml:"name"`
+	GidNumber int    `yaml:"gid,omitempty"`
+}
+
 type yamlDb struct {
-	users  map[string]userdb.User
-	groups map[string]userdb.Group
+	path    string
+	subject string
+	watcher *filewatch.Watcher
+
+	mutex    sync.RWMutex
+	users    map[string]userdb.User
+	groups   map[string]userdb.Group
+	onChange []func(userNames, groupNames []string)
 }
 
 func (ydb *yamlDb) VerifyUser(userName, password string) (*userdb.User, error) {
+	ydb.mutex.RLock()
 	user, ok := ydb.users[userName]
+	ydb.mutex.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
 	}
@@ -62,6 +100,9 @@ func (ydb *yamlDb) VerifyUser(userName, password string) (*userdb.User, error) {
 }
 
 func (ydb *yamlDb) LookupUser(userName string) (*userdb.User, error) {
+	ydb.mutex.RLock()
+	defer ydb.mutex.RUnlock()
+
 	user, ok := ydb.users[userName]
 	if !ok {
 		return nil, fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
@@ -70,9 +111,416 @@ func (ydb *yamlDb) LookupUser(userName string) (*userdb.User, error) {
 }
 
 func (ydb *yamlDb) LookupGroup(groupName string) (*userdb.Group, error) {
+	ydb.mutex.RLock()
+	defer ydb.mutex.RUnlock()
+
 	group, ok := ydb.groups[groupName]
 	if !ok {
 		return nil, fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
 	}
 	return &group, nil
 }
+
+func (ydb *yamlDb) Close() error {
+	return ydb.watcher.Close()
+}
+
+func (ydb *yamlDb) OnChange(fn func(userNames, groupNames []string)) {
+	ydb.mutex.Lock()
+	defer ydb.mutex.Unlock()
+
+	ydb.onChange = append(ydb.onChange, fn)
+}
+
+func (ydb *yamlDb) ListUsers() ([]*userdb.User, error) {
+	ydb.mutex.RLock()
+	defer ydb.mutex.RUnlock()
+
+	users := make([]*userdb.User, 0, len(ydb.users))
+	for _, user := range ydb.users {
+		user := user
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users, nil
+}
+
+func (ydb *yamlDb) CreateUser(user *userdb.User, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return ydb.update([]string{user.Name}, nil, func(cfg *userConfig) error {
+		for _, u := range cfg.Users {
+			if u.Name == user.Name {
+				return fmt.Errorf("%s: %w", user.Name, userdb.ErrUserExists)
+			}
+		}
+		nuser := *user
+		nuser.Password = string(hash)
+		if nuser.UidNumber == 0 {
+			nuser.UidNumber = nextUid(cfg)
+		}
+		// it's the token subject, so a user without one couldn't log in
+		if nuser.Id == "" && ydb.subject == config.SubjectId {
+			nuser.Id = uuid.NewString()
+		}
+		cfg.Users = append(cfg.Users, nuser)
+		return ydb.checkUids(cfg)
+	})
+}
+
+func (ydb *yamlDb) UpdateUser(user *userdb.User) error {
+	return ydb.update([]string{user.Name}, nil, func(cfg *userConfig) error {
+		for i, u := range cfg.Users {
+			if u.Name == user.Name {
+				nuser := *user
+				nuser.Password = u.Password
+				if nuser.UidNumber == 0 {
+					nuser.UidNumber = u.UidNumber
+				}
+				if nuser.Id == "" {
+					nuser.Id = u.Id
+				}
+				cfg.Users[i] = nuser
+				return ydb.checkUids(cfg)
+			}
+		}
+		return fmt.Errorf("%s: %w", user.Name, userdb.ErrUserNotFound)
+	})
+}
+
+func (ydb *yamlDb) DeleteUser(userName string) error {
+	return ydb.update([]string{userName}, nil, func(cfg *userConfig) error {
+		for i, u := range cfg.Users {
+			if u.Name == userName {
+				cfg.Users = append(cfg.Users[:i], cfg.Users[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	})
+}
+
+func (ydb *yamlDb) SetPassword(userName, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return ydb.update([]string{userName}, nil, func(cfg *userConfig) error {
+		for i, u := range cfg.Users {
+			if u.Name == userName {
+				cfg.Users[i].Password = string(hash)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %w", userName, userdb.ErrUserNotFound)
+	})
+}
+
+func (ydb *yamlDb) ListGroups() ([]*userdb.Group, error) {
+	ydb.mutex.RLock()
+	defer ydb.mutex.RUnlock()
+
+	groups := make([]*userdb.Group, 0, len(ydb.groups))
+	for _, group := range ydb.groups {
+		group := group
+		groups = append(groups, &group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+func (ydb *yamlDb) CreateGroup(group *userdb.Group) error {
+	return ydb.update(nil, []string{group.Name}, func(cfg *userConfig) error {
+		for _, g := range cfg.Groups {
+			if g.Name == group.Name {
+				return fmt.Errorf("%s: %w", group.Name, userdb.ErrGroupExists)
+			}
+		}
+		cfg.Groups = append(cfg.Groups, *group)
+		return nil
+	})
+}
+
+func (ydb *yamlDb) DeleteGroup(groupName string) error {
+	// its members change too, so it's a change to anything
+	return ydb.update(nil, nil, func(cfg *userConfig) error {
+		found := false
+		for i, g := range cfg.Groups {
+			if g.Name == groupName {
+				cfg.Groups = append(cfg.Groups[:i], cfg.Groups[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %w", groupName, userdb.ErrGroupNotFound)
+		}
+
+		// and nobody is a member of it any more
+		for i, u := range cfg.Users {
+			var groups []string
+			for _, g := range u.Groups {
+				if g != groupName {
+					groups = append(groups, g)
+				}
+			}
+			cfg.Users[i].Groups = groups
+		}
+		return nil
+	})
+}
+
+// make the change to the file, and tell those listening about the users and groups it's to
+func (ydb *yamlDb) update(userNames, groupNames []string, change func(cfg *userConfig) error) error {
+	ydb.mutex.Lock()
+	defer ydb.mutex.Unlock()
+
+	// start from the file in case it's been edited and not reloaded yet
+	usercfg, node, err := ydb.read()
+	if err != nil {
+		return err
+	}
+
+	err = change(usercfg)
+	if err != nil {
+		return err
+	}
+
+	err = ydb.write(usercfg, node)
+	if err != nil {
+		return err
+	}
+
+	ydb.users, ydb.groups = index(usercfg)
+	ydb.changed(userNames, groupNames)
+
+	return nil
+}
+
+func (ydb *yamlDb) changed(userNames, groupNames []string) {
+	for _, fn := range ydb.onChange {
+		fn(userNames, groupNames)
+	}
+}
+
+// the file is returned as a node too, so its comments can be kept when it's rewritten
+func (ydb *yamlDb) read() (*userConfig, *yaml.Node, error) {
+	fh, err := os.Open(ydb.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fh.Close()
+
+	decoder := yaml.NewDecoder(fh)
+
+	var node yaml.Node
+	err = decoder.Decode(&node)
+	if err != nil {
+		return nil, nil, err
+	}
+	var usercfg userConfig
+	err = node.Decode(&usercfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ydb.checkUids(&usercfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &usercfg, &node, nil
+}
+
+// when the uid is the token subject, a missing uid would decode as 0 and be
+// shared by all such users, so they're rejected rather than given the same subject
+func (ydb *yamlDb) checkUids(usercfg *userConfig) error {
+	if ydb.subject != config.SubjectUid {
+		return nil
+	}
+
+	owners := make(map[int]string)
+	for _, user := range usercfg.Users {
+		if user.UidNumber <= 0 {
+			return fmt.Errorf("user %s has no uid", user.Name)
+		}
+		if owner, ok := owners[user.UidNumber]; ok {
+			return fmt.Errorf("users %s and %s have the same uid %d", owner, user.Name, user.UidNumber)
+		}
+		owners[user.UidNumber] = user.Name
+	}
+	return nil
+}
+
+// the uid after the highest in use, starting at the usual first user uid
+func nextUid(usercfg *userConfig) int {
+	uid := firstUid
+	for _, user := range usercfg.Users {
+		if user.UidNumber >= uid {
+			uid = user.UidNumber + 1
+		}
+	}
+	return uid
+}
+
+func (ydb *yamlDb) write(usercfg *userConfig, old *yaml.Node) error {
+	// the comments in the file are carried over to the new content
+	var filecfg fileConfig
+	for _, user := range usercfg.Users {
+		filecfg.Users = append(filecfg.Users, fileUser{
+			Name:       user.Name,
+			Id:         user.Id,
+			UidNumber:  user.UidNumber,
+			GidNumber:  user.GidNumber,
+			Password:   user.Password,
+			FullName:   user.FullName,
+			GivenName:  user.GivenName,
+			FamilyName: user.FamilyName,
+			Email:      user.Email,
+			Groups:     user.Groups,
+		})
+	}
+	for _, group := range usercfg.Groups {
+		filecfg.Groups = append(filecfg.Groups, fileGroup{
+			Name:      group.Name,
+			GidNumber: group.GidNumber,
+		})
+	}
+
+	var content yaml.Node
+	err := content.Encode(&filecfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode user db: %w", err)
+	}
+	doc := yaml.Node{
+		Kind:    yaml.DocumentNode,
+		Content: []*yaml.Node{&content},
+	}
+	keepComments(old, &doc)
+
+	// keep the permissions the file already has
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(ydb.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// write to a temporary file and rename it over the original, so readers
+	//   never see a partly written file
+	fh, err := os.CreateTemp(filepath.Dir(ydb.path), ".userdb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+
+	encoder := yaml.NewEncoder(fh)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err == nil {
+		err = fh.Chmod(mode)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write user db: %w", err)
+	}
+
+	return os.Rename(fh.Name(), ydb.path)
+}
+
+// copies the comments from the old node to the matching parts of the new one...
+// list entries are matched by name, so comments stay with the user or group
+// they were written for as others come and go
+func keepComments(old, node *yaml.Node) {
+	if old == nil || old.Kind != node.Kind {
+		return
+	}
+	node.HeadComment, node.LineComment, node.FootComment = old.HeadComment, old.LineComment, old.FootComment
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for i := 0; i < len(node.Content) && i < len(old.Content); i++ {
+			keepComments(old.Content[i], node.Content[i])
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			for j := 0; j+1 < len(old.Content); j += 2 {
+				if old.Content[j].Value == key {
+					keepComments(old.Content[j], node.Content[i])
+					keepComments(old.Content[j+1], node.Content[i+1])
+					break
+				}
+			}
+		}
+
+	case yaml.SequenceNode:
+		for _, entry := range node.Content {
+			name := entryName(entry)
+			for _, oentry := range old.Content {
+				if entryName(oentry) == name {
+					keepComments(oentry, entry)
+					break
+				}
+			}
+		}
+	}
+}
+
+// the name of a list entry, either the entry itself or its name field
+func entryName(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode {
+		return node.Value
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "name" {
+				return node.Content[i+1].Value
+			}
+		}
+	}
+	return ""
+}
+
+func index(usercfg *userConfig) (map[string]userdb.User, map[string]userdb.Group) {
+	users := make(map[string]userdb.User)
+	groups := make(map[string]userdb.Group)
+	for _, user := range usercfg.Users {
+		users[user.Name] = user
+	}
+	for _, group := range usercfg.Groups {
+		groups[group.Name] = group
+	}
+	return users, groups
+}
+
+func (ydb *yamlDb) reload() {
+	ydb.mutex.Lock()
+	defer ydb.mutex.Unlock()
+
+	// keep using what we have if the file is broken
+	usercfg, _, err := ydb.read()
+	if err != nil {
+		log.Errorf("userdbyaml: failed to reload %s: %v", ydb.path, err)
+		return
+	}
+	ydb.users, ydb.groups = index(usercfg)
+	ydb.changed(nil, nil)
+
+	log.Infof("userdbyaml: reloaded %s", ydb.path)
+}
@@ -3,12 +3,17 @@ package userdbyaml_test
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 
+	"github.com/parlaynu/studio1767-idp/internal/config"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdb"
 	"github.com/parlaynu/studio1767-idp/internal/storage/userdbyaml"
 )
@@ -47,7 +52,7 @@ func TestUserDb(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(dbpath)
 
-	udb, err := userdbyaml.NewUserDb(dbpath)
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
 	require.NoError(t, err)
 
 	// test successful attempts
@@ -148,3 +153,338 @@ func createUserDb(tusers []testUser, tgroups []testGroup) (string, error) {
 
 	return name, nil
 }
+
+func TestWritableUserDb(t *testing.T) {
+	dbpath, err := createUserDb([]testUser{{Name: "user1", Password: "password1"}}, []testGroup{{Name: "group1"}})
+	require.NoError(t, err)
+	defer os.Remove(dbpath)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+
+	// create a user and group
+	err = udb.CreateGroup(&userdb.Group{Name: "group2", GidNumber: 2001})
+	require.NoError(t, err)
+	err = udb.CreateGroup(&userdb.Group{Name: "group2"})
+	require.ErrorIs(t, err, userdb.ErrGroupExists)
+
+	err = udb.CreateUser(&userdb.User{Name: "user2", Email: "user2@example.com", Groups: []string{"group1", "group2"}}, "password2")
+	require.NoError(t, err)
+	err = udb.CreateUser(&userdb.User{Name: "user2"}, "password2")
+	require.ErrorIs(t, err, userdb.ErrUserExists)
+
+	u, err := udb.VerifyUser("user2", "password2")
+	require.NoError(t, err)
+	require.Equal(t, "user2@example.com", u.Email)
+	require.Equal(t, 1001, u.UidNumber)
+
+	users, err := udb.ListUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "user1", users[0].Name)
+	require.Equal(t, "user2", users[1].Name)
+
+	groups, err := udb.ListGroups()
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+
+	// updates keep the password, which is changed separately
+	u.Email = "user2@example.org"
+	u.Password = "ignored"
+	err = udb.UpdateUser(u)
+	require.NoError(t, err)
+	u, err = udb.VerifyUser("user2", "password2")
+	require.NoError(t, err)
+	require.Equal(t, "user2@example.org", u.Email)
+
+	err = udb.SetPassword("user2", "password3")
+	require.NoError(t, err)
+	_, err = udb.VerifyUser("user2", "password2")
+	require.Error(t, err)
+	_, err = udb.VerifyUser("user2", "password3")
+	require.NoError(t, err)
+
+	err = udb.SetPassword("non-existing-user", "password")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// deleting a group removes the memberships
+	err = udb.DeleteGroup("group2")
+	require.NoError(t, err)
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"group1"}, u.Groups)
+
+	err = udb.DeleteUser("user1")
+	require.NoError(t, err)
+	err = udb.DeleteUser("user1")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// the changes are in the file
+	udb, err = userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+	_, err = udb.LookupUser("user1")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+	_, err = udb.VerifyUser("user2", "password3")
+	require.NoError(t, err)
+	_, err = udb.LookupGroup("group2")
+	require.ErrorIs(t, err, userdb.ErrGroupNotFound)
+}
+
+func TestUserDbUids(t *testing.T) {
+	dir := t.TempDir()
+
+	// when the uid is the token subject, users without a uid, or sharing one,
+	//   are rejected... otherwise they're fine
+	for _, content := range []string{
+		"users:\n- name: user1\n  uid: 1000\n- name: user2\n",
+		"users:\n- name: user1\n  uid: 1000\n- name: user2\n  uid: 0\n",
+		"users:\n- name: user1\n  uid: 1000\n- name: user2\n  uid: 1000\n",
+	} {
+		dbpath := filepath.Join(dir, "users.yaml")
+		err := os.WriteFile(dbpath, []byte(content), 0600)
+		require.NoError(t, err)
+		_, err = userdbyaml.NewUserDb(dbpath, config.SubjectUid)
+		require.Error(t, err)
+
+		udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+		require.NoError(t, err)
+		udb.Close()
+	}
+
+	dbpath, err := createUserDb([]testUser{{Name: "user1", Password: "password1"}, {Name: "user2", Password: "password2"}}, nil)
+	require.NoError(t, err)
+	defer os.Remove(dbpath)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectUid)
+	require.NoError(t, err)
+
+	// and can't be made to share one
+	err = udb.CreateUser(&userdb.User{Name: "user3", UidNumber: 1000}, "password3")
+	require.Error(t, err)
+	u, err := udb.LookupUser("user2")
+	require.NoError(t, err)
+	u.UidNumber = 1000
+	err = udb.UpdateUser(u)
+	require.Error(t, err)
+
+	// updates without a uid keep the one the user has
+	u.UidNumber = 0
+	err = udb.UpdateUser(u)
+	require.NoError(t, err)
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, 1001, u.UidNumber)
+}
+
+func TestUserDbIds(t *testing.T) {
+	dbpath, err := createUserDb([]testUser{{Name: "user1", Password: "password1"}}, nil)
+	require.NoError(t, err)
+	defer os.Remove(dbpath)
+
+	// when the id is the token subject, new users are given one
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectId)
+	require.NoError(t, err)
+	defer udb.Close()
+
+	err = udb.CreateUser(&userdb.User{Name: "user2"}, "password2")
+	require.NoError(t, err)
+	u, err := udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.NotEmpty(t, u.Id)
+
+	// which updates without one keep
+	id := u.Id
+	u.Id = ""
+	err = udb.UpdateUser(u)
+	require.NoError(t, err)
+	u, err = udb.LookupUser("user2")
+	require.NoError(t, err)
+	require.Equal(t, id, u.Id)
+
+	// but the ones they're created with are used
+	err = udb.CreateUser(&userdb.User{Name: "user3", Id: "user3-id"}, "password3")
+	require.NoError(t, err)
+	u, err = udb.LookupUser("user3")
+	require.NoError(t, err)
+	require.Equal(t, "user3-id", u.Id)
+
+	// and they're not made up otherwise
+	ldb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+	defer ldb.Close()
+
+	err = ldb.CreateUser(&userdb.User{Name: "user4"}, "password4")
+	require.NoError(t, err)
+	u, err = ldb.LookupUser("user4")
+	require.NoError(t, err)
+	require.Empty(t, u.Id)
+}
+
+func TestUserDbReload(t *testing.T) {
+	dbpath, err := createUserDb([]testUser{{Name: "user1", Password: "password1"}}, nil)
+	require.NoError(t, err)
+	defer os.Remove(dbpath)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+
+	// replace the file from outside
+	npath, err := createUserDb([]testUser{{Name: "user2", Password: "password2"}}, nil)
+	require.NoError(t, err)
+	err = os.Rename(npath, dbpath)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := udb.VerifyUser("user2", "password2")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = udb.LookupUser("user1")
+	require.ErrorIs(t, err, userdb.ErrUserNotFound)
+
+	// a broken file is ignored
+	err = os.WriteFile(dbpath, []byte("users: [broken"), 0600)
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = udb.VerifyUser("user2", "password2")
+	require.NoError(t, err)
+}
+
+func TestUserDbChanges(t *testing.T) {
+	dbpath, err := createUserDb([]testUser{{Name: "user1", Password: "password1"}}, []testGroup{{Name: "group1"}})
+	require.NoError(t, err)
+	defer os.Remove(dbpath)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+	defer udb.Close()
+
+	var mutex sync.Mutex
+	var changes [][]string
+	udb.(userdb.ChangeNotifier).OnChange(func(userNames, groupNames []string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		changes = append(changes, append(userNames, groupNames...))
+	})
+	changed := func() [][]string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		c := changes
+		changes = nil
+		return c
+	}
+
+	// writes say what they changed
+	err = udb.SetPassword("user1", "password2")
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"user1"}}, changed())
+	err = udb.CreateGroup(&userdb.Group{Name: "group2", GidNumber: 2001})
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"group2"}}, changed())
+
+	// failed ones don't
+	err = udb.DeleteUser("non-existing-user")
+	require.Error(t, err)
+	require.Empty(t, changed())
+
+	// and reloads could have changed anything
+	time.Sleep(500 * time.Millisecond)
+	changed()
+	npath, err := createUserDb([]testUser{{Name: "user2", Password: "password2"}}, nil)
+	require.NoError(t, err)
+	err = os.Rename(npath, dbpath)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(changes) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, []string(nil), changed()[0])
+}
+
+func TestUserDbComments(t *testing.T) {
+	content := `# the site's users
+users:
+  # the first admin
+  - name: user1
+    uid: 1000 # fixed, it's in the nfs exports
+    groups:
+      - group1 # for the lab
+  - name: user2
+    uid: 1001
+groups:
+  - name: group1 # lab access
+    gid: 2000
+`
+	dbpath := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(dbpath, []byte(content), 0600)
+	require.NoError(t, err)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+	defer udb.Close()
+
+	// the comments stay with what they were written for
+	err = udb.DeleteUser("user2")
+	require.NoError(t, err)
+	err = udb.CreateUser(&userdb.User{Name: "user3"}, "password3")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(dbpath)
+	require.NoError(t, err)
+	require.Less(t, strings.Index(string(data), "# the first admin"), strings.Index(string(data), "name: user1"))
+	for _, comment := range []string{
+		"# the site's users",
+		"# the first admin",
+		"uid: 1000 # fixed, it's in the nfs exports",
+		"- group1 # for the lab",
+		"name: group1 # lab access",
+	} {
+		require.Contains(t, string(data), comment)
+	}
+}
+
+func TestUserDbRoundTrip(t *testing.T) {
+	content := `# the site's users
+users:
+  # the first admin
+  - name: user1
+    id: 3f1c6d2e-8a4b-4c1e-9d7a-0b5e2f6a9c13
+    uid: 1000 # fixed, it's in the nfs exports
+    gid: 1000
+    password: $2a$10$zNAKpS5TqDZnFoOyq8MDTOBDYwWWnYzNmVAX2Db/5EgSn1OMYXf.W
+    full_name: User One
+    given_name: User
+    family_name: One
+    email: user1@example.com
+    groups:
+      - group1 # for the lab
+      - group2
+  - name: user2
+    uid: 1001
+groups:
+  - name: group1 # lab access
+    gid: 2000
+  - name: group2
+`
+	dbpath := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(dbpath, []byte(content), 0600)
+	require.NoError(t, err)
+
+	udb, err := userdbyaml.NewUserDb(dbpath, config.SubjectLegacy)
+	require.NoError(t, err)
+	defer udb.Close()
+
+	// a change that's undone leaves the file as it was
+	err = udb.CreateUser(&userdb.User{Name: "user3", Dn: "uid=user3,dc=example,dc=com"}, "password3")
+	require.NoError(t, err)
+	data, err := os.ReadFile(dbpath)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "dn:")
+
+	err = udb.DeleteUser("user3")
+	require.NoError(t, err)
+	data, err = os.ReadFile(dbpath)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}